@@ -12,6 +12,7 @@ import (
 	"net/http/pprof"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -19,7 +20,9 @@ import (
 	"github.com/hashicorp/consul-esm/version"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/types"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/serf/coordinate"
 	promclient "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -90,11 +93,65 @@ type Agent struct {
 	inflightPings map[string]struct{}
 	inflightLock  sync.Mutex
 
+	// observedNodes are the probe nodes this agent only pings to record an
+	// observation for the owning agent's quorum, see NodeWatchList.Observe.
+	observedNodes     map[string]bool
+	observedNodesLock sync.Mutex
+
+	// probeQuorum is the quorum set by the leader in our node list, see
+	// NodeWatchList.Quorum. Guarded by observedNodesLock.
+	probeQuorum int
+
+	// invalidNodeMeta are the invalid probe meta values already warned about,
+	// keyed by node and meta key, see warnInvalidNodeMeta.
+	invalidNodeMeta sync.Map
+
 	// Custom func to hook into for testing.
 	watchedNodeFunc       func(map[string]bool, []*api.Node)
 	knownNodeStatuses     map[string]lastKnownStatus
 	knownNodeStatusesLock sync.Mutex
 
+	// breaker suspends critical updates and reaping when most of our probes
+	// and checks fail at once. Nil if disabled.
+	breaker *circuitBreaker
+
+	// reaper applies the reaping safeguards to nodes and services. Nil if
+	// every reap is allowed.
+	reaper *reapGuard
+
+	// localCoord is the cached coordinate of this agent that the coordinates
+	// of pinged nodes are computed from. coordClient is our own Vivaldi
+	// client, used when the coordinate is computed from the Consul servers.
+	localCoord     *coordinate.Coordinate
+	coordClient    *coordinate.Client
+	localCoordLock sync.RWMutex
+
+	// coordUpdates queues and rate limits the coordinate writes of pinged
+	// nodes.
+	coordUpdates *coordinateUpdater
+
+	// maintenance holds the maintenance markers of the external nodes and
+	// services, whose probes and checks are paused.
+	maintenance *maintenanceTracker
+
+	// nodeHealth tracks the critical probed nodes, whose other checks are
+	// suppressed.
+	nodeHealth *nodeHealthTracker
+
+	// consulTransport is the transport of the Consul client, swapped when its
+	// TLS files are reloaded.
+	consulTransport *reloadableTransport
+
+	// checksTLS is the TLS configuration of the checks. checksTLSReloaded is
+	// signalled when it's swapped, to restart the checks with it.
+	checksTLS         atomic.Pointer[checksTLS]
+	checksTLSReloaded chan struct{}
+
+	// synthetics holds the synthetic checks. syntheticsChanged is signalled
+	// when they change, to restart the running ones.
+	synthetics        *syntheticChecks
+	syntheticsChanged chan struct{}
+
 	metrics *lib.MetricsConfig
 }
 
@@ -104,6 +161,10 @@ func getPrometheusDefs(config *Config) ([]prommetrics.GaugeDefinition, []prommet
 		AgentGauges,
 		MonitoredGauges,
 		LeaderGauges,
+		BreakerGauges,
+		CoordinateGauges,
+		TLSGauges,
+		CertExpiryGauges,
 	}
 
 	// Flatten definitions and apply prefix
@@ -144,6 +205,13 @@ func NewAgent(config *Config, logger hclog.Logger) (*Agent, error) {
 		return nil, err
 	}
 
+	// Wrap the client's transport so its TLS files can be reloaded.
+	var consulTransport *reloadableTransport
+	if transport, ok := clientConf.HttpClient.Transport.(*http.Transport); ok {
+		consulTransport = newReloadableTransport(transport)
+		clientConf.HttpClient.Transport = consulTransport
+	}
+
 	gauges, summaries := getPrometheusDefs(config)
 	config.Telemetry.PrometheusOpts.GaugeDefinitions = gauges
 	config.Telemetry.PrometheusOpts.SummaryDefinitions = summaries
@@ -162,6 +230,15 @@ func NewAgent(config *Config, logger hclog.Logger) (*Agent, error) {
 		ready:             make(chan struct{}, 1),
 		inflightPings:     make(map[string]struct{}),
 		knownNodeStatuses: make(map[string]lastKnownStatus),
+		breaker:           newCircuitBreaker(logger, config),
+		reaper:            newReapGuard(logger, config),
+		coordUpdates:      newCoordinateUpdater(client, logger, config),
+		maintenance:       newMaintenanceTracker(),
+		nodeHealth:        newNodeHealthTracker(),
+		consulTransport:   consulTransport,
+		checksTLSReloaded: make(chan struct{}, 1),
+		synthetics:        newSyntheticChecks(),
+		syntheticsChanged: make(chan struct{}, 1),
 		metrics:           metricsConf,
 	}
 
@@ -180,6 +257,8 @@ func NewAgent(config *Config, logger hclog.Logger) (*Agent, error) {
 	}
 
 	metrics.SetGauge([]string{"esm", "agent", "isLeader"}, 0)
+	metrics.SetGauge([]string{"esm", "circuit_breaker", "tripped"}, 0)
+	metrics.SetGauge([]string{"esm", "coordinates", "pending"}, 0)
 
 	return &agent, nil
 }
@@ -240,6 +319,11 @@ func (a *Agent) Run() error {
 		a.runLeaderLoop()
 		wg.Done()
 	}()
+	wg.Add(1)
+	go func() {
+		a.watchTLSFiles()
+		wg.Done()
+	}()
 
 	a.ready <- struct{}{} // used for testing
 	defer func() {        // be sure to drain it between calls
@@ -667,7 +751,12 @@ REGISTER:
 			return
 
 		case <-time.After(agentTTL / 2):
-			if err := a.client.Agent().UpdateTTLOpts(ttlID, "", api.HealthPassing, a.ConsulQueryOption()); err != nil {
+			// Report a tripped circuit breaker as a warning on our own check.
+			status, output := api.HealthPassing, ""
+			if a.breaker.Tripped() {
+				status, output = api.HealthWarning, a.breaker.Status()
+			}
+			if err := a.client.Agent().UpdateTTLOpts(ttlID, output, status, a.ConsulQueryOption()); err != nil {
 				a.logger.Error("Failed to refresh agent TTL check (will reregister)", "error", err)
 				time.Sleep(retryTime)
 				goto REGISTER
@@ -683,15 +772,32 @@ func (a *Agent) watchNodeList() {
 	// Set up the update channels for the various goroutines.
 	healthNodeCh := make(chan map[string]bool, 1)
 	coordNodeCh := make(chan []*api.Node, 1)
+	maintChecksCh := make(chan api.HealthChecks, 1)
+	syntheticChecksCh := make(chan api.HealthChecks, 1)
 
 	// Start a goroutine to get health check updates from the catalog, filtering them using
 	// the results from computeWatchedNodes.
-	go a.watchHealthChecks(healthNodeCh)
+	go a.watchHealthChecks(healthNodeCh, maintChecksCh, syntheticChecksCh)
 
 	// Start a goroutine to run the pings used for coordinate and externalNodeHealth updates
 	// on the nodes returned from computeWatchedNodes.
 	go a.updateCoords(coordNodeCh)
 
+	// Start a goroutine to track the maintenance markers of the nodes and
+	// services, and set their maintenance checks.
+	go a.watchMaintenance(maintChecksCh)
+
+	// Start a goroutine to track the synthetic checks, and register their
+	// catalog checks on our services.
+	go a.watchSyntheticChecks(syntheticChecksCh)
+
+	// Keep our own coordinate up to date so it doesn't need to be fetched on
+	// every ping.
+	if !a.config.DisableCoordinateUpdates {
+		go a.maintainLocalCoordinate()
+		go a.coordUpdates.Run(a.shutdownCh)
+	}
+
 	// Watch the node list at the KV path for our service ID. This will return the list
 	// of external nodes that this agent is responsible for as decided by the leader.
 	var opts *api.QueryOptions
@@ -743,6 +849,13 @@ func (a *Agent) watchNodeList() {
 			healthNodes[node] = true
 			pingNodes[node] = true
 		}
+		observedNodes := make(map[string]bool)
+		for _, node := range nodeList.Observe {
+			if !pingNodes[node] {
+				pingNodes[node] = true
+				observedNodes[node] = true
+			}
+		}
 
 		nodes, _, err := a.client.Catalog().Nodes(&api.QueryOptions{NodeMeta: a.config.NodeMeta})
 		if err != nil {
@@ -759,6 +872,11 @@ func (a *Agent) watchNodeList() {
 			}
 		}
 
+		a.observedNodesLock.Lock()
+		a.observedNodes = observedNodes
+		a.probeQuorum = nodeList.Quorum
+		a.observedNodesLock.Unlock()
+
 		healthNodeCh <- healthNodes
 		coordNodeCh <- pingList
 
@@ -780,19 +898,20 @@ func (a *Agent) recordHealthCheckMetrics(start time.Time, nodes map[string]bool,
 
 // watchHealthChecks does a blocking query to the Consul api to get
 // all health checks on nodes marked with the external node metadata
-// identifier and sends any updates through the given updateCh.
-func (a *Agent) watchHealthChecks(nodeListCh chan map[string]bool) {
-	// Initialize a tlsConfig struct
-	tlsConfig := api.TLSConfig{
-		CAFile:   a.config.HTTPSCAFile,
-		CAPath:   a.config.HTTPSCAPath,
-		CertFile: a.config.HTTPSCertFile,
-		KeyFile:  a.config.HTTPSKeyFile,
+// identifier and sends any updates through the given updateCh. All the checks
+// of our nodes, including the ones ESM doesn't run, are sent to each of
+// nodeChecksChs.
+func (a *Agent) watchHealthChecks(nodeListCh chan map[string]bool, nodeChecksChs ...chan api.HealthChecks) {
+	currentTLS, err := a.loadChecksTLS()
+	if err != nil {
+		a.logger.Error("Could not create TLS config", "error", err)
+		return
 	}
+	a.checksTLS.Store(currentTLS)
 
-	tlsClientConfig, err := api.SetupTLSConfig(&tlsConfig)
+	proxies, err := newProxyRules(a.config)
 	if err != nil {
-		a.logger.Error("Could not create TLS config", "error", err)
+		a.logger.Error("Could not create proxy config", "error", err)
 		return
 	}
 
@@ -800,8 +919,30 @@ func (a *Agent) watchHealthChecks(nodeListCh chan map[string]bool) {
 	// UpdateChecks when we get an update from watchHealthChecks.
 	a.checkRunner = NewCheckRunner(a.logger, a.client,
 		a.config.CheckUpdateInterval, minimumInterval,
-		tlsClientConfig, a.config.PassingThreshold, a.config.CriticalThreshold)
+		currentTLS.tlsConfig, a.config.PassingThreshold, a.config.CriticalThreshold)
+	a.checkRunner.tlsRules = currentTLS.rules
+	a.checkRunner.proxies = proxies
+	a.checkRunner.secrets = newSecretResolver(a.client, a.logger, a.config, a.ConsulQueryOption())
+	a.checkRunner.oauth2 = newOAuth2Tokens(a.config.OAuth2Clients, a.checkRunner.secrets,
+		currentTLS.tlsConfig, proxies)
+	a.checkRunner.WarningThreshold = a.config.WarningThreshold
+	a.checkRunner.WarningEscalationTimeout = a.config.WarningEscalationTimeout
+	a.checkRunner.EvaluationWindows = a.config.EvaluationWindows
+	a.checkRunner.FlapHistory = a.config.FlapHistory
+	a.checkRunner.FlapHighThreshold = a.config.FlapHighThreshold
+	a.checkRunner.FlapLowThreshold = a.config.FlapLowThreshold
+	a.checkRunner.breaker = a.breaker
+	a.checkRunner.reaper = a.reaper
+	a.checkRunner.maintenance = a.maintenance
+	a.checkRunner.nodeHealth = a.nodeHealth
+	a.checkRunner.synthetics = a.synthetics
+	a.checkRunner.certExpiry = certExpiryThresholds{
+		warningDays:  a.config.CertExpiryWarningDays,
+		criticalDays: a.config.CertExpiryCriticalDays,
+	}
+	a.checkRunner.dnsResolvers = a.config.DNSResolvers
 	go a.checkRunner.reapServices(a.shutdownCh)
+	go a.checkRunner.watchNodeHealth(a.shutdownCh)
 	defer a.checkRunner.Stop()
 
 	var ourNodes map[string]bool
@@ -814,23 +955,43 @@ func (a *Agent) watchHealthChecks(nodeListCh chan map[string]bool) {
 		case ourNodes = <-nodeListCh:
 			// Re-run if there's a change to the watched node list.
 			waitIndex = 0
+		case <-a.checksTLSReloaded:
+		case <-a.syntheticsChanged:
+			// Re-run to restart the synthetic checks that changed.
+			waitIndex = 0
 		case <-time.After(retryTime):
 			// Sleep here to limit how much load we put on the Consul servers.
 		}
+		if latest := a.checksTLS.Load(); latest != currentTLS {
+			// Re-run to restart the checks with the reloaded TLS config.
+			currentTLS = latest
+			a.checkRunner.tlsConfig = currentTLS.tlsConfig
+			a.checkRunner.tlsRules = currentTLS.rules
+			a.checkRunner.oauth2.setTLSConfig(currentTLS.tlsConfig)
+			waitIndex = 0
+		}
 		if len(ourNodes) == 0 {
 			metrics.SetGauge([]string{"esm", "nodes", "monitored"}, 0)
+			for _, ch := range nodeChecksChs {
+				sendLatest(ch, nil)
+			}
 			continue
 		}
 
 		start := time.Now()
 
-		ourChecks, lastIndex := a.getHealthChecks(waitIndex, ourNodes)
+		ourChecks, extras, nodeChecks, lastIndex := a.getHealthChecks(waitIndex, ourNodes)
+		if lastIndex != 0 {
+			for _, ch := range nodeChecksChs {
+				sendLatest(ch, nodeChecks)
+			}
+		}
 		if len(ourChecks) == 0 {
 			continue
 		}
 
 		waitIndex = lastIndex
-		a.checkRunner.UpdateChecks(ourChecks)
+		a.checkRunner.updateChecks(ourChecks, extras)
 
 		a.recordHealthCheckMetrics(start, ourNodes, ourChecks)
 
@@ -842,7 +1003,11 @@ func (a *Agent) watchHealthChecks(nodeListCh chan map[string]bool) {
 	}
 }
 
-func (a *Agent) getHealthChecks(waitIndex uint64, nodes map[string]bool) (api.HealthChecks, uint64) {
+// getHealthChecks returns the checks of the given nodes ESM runs, along with
+// their extra definition fields, and all the checks of those nodes.
+func (a *Agent) getHealthChecks(waitIndex uint64, nodes map[string]bool) (
+	api.HealthChecks, map[types.CheckID]checkExtras, api.HealthChecks, uint64,
+) {
 	namespaces, err := namespacesList(a.client, a.config)
 	if err != nil {
 		a.logger.Warn("Error getting namespaces, falling back to default namespace", "error", err)
@@ -863,33 +1028,131 @@ func (a *Agent) getHealthChecks(waitIndex uint64, nodes map[string]bool) (api.He
 		select {
 		case <-a.shutdownCh:
 			cancelFunc()
+		case <-a.checksTLSReloaded:
+			// Stop waiting for changes so the checks are restarted with the
+			// reloaded TLS config.
+			select {
+			case a.checksTLSReloaded <- struct{}{}:
+			default:
+			}
+			cancelFunc()
+		case <-a.syntheticsChanged:
+			// Stop waiting for changes so the synthetic checks are restarted.
+			select {
+			case a.syntheticsChanged <- struct{}{}:
+			default:
+			}
+			cancelFunc()
 		case <-ctx.Done():
 		}
 	}()
 
 	ourChecks := make(api.HealthChecks, 0)
+	extras := make(map[types.CheckID]checkExtras)
+	var nodeChecks api.HealthChecks
 	var lastIndex uint64
 	for _, ns := range namespaces {
 		opts.Namespace = ns.Name
 		if ns.Name != "" { // ns.Name only set on enterprise version
 			a.logger.Info("checking namespaces for services", "name", ns.Name)
 		}
-		checks, meta, err := a.client.Health().State(api.HealthAny, opts)
+		checks, definitions, meta, err := a.healthState(opts)
 		if err != nil {
-			a.logger.Warn("Error querying for health check info", "error", err)
+			if ctx.Err() == nil {
+				a.logger.Warn("Error querying for health check info", "error", err)
+			}
 			continue
 		}
 		lastIndex = meta.LastIndex
 
-		for _, c := range checks {
-			if nodes[c.Node] && c.CheckID != externalCheckName {
+		var serviceChecks api.HealthChecks
+		for i, c := range checks {
+			if nodes[c.Node] {
+				nodeChecks = append(nodeChecks, c)
+			}
+			if nodes[c.Node] && c.CheckID != externalCheckName && !isMaintenanceCheck(c.CheckID) {
 				ourChecks = append(ourChecks, c)
+				extras[hashCheck(c)] = definitions[i]
 				a.logger.Info("found check", "name", c.Name)
+				if c.ServiceID != "" {
+					serviceChecks = append(serviceChecks, c)
+				}
 			}
 		}
+
+		if len(serviceChecks) > 0 && tlsRulesUseServiceMeta(a.config.TLSClientRules) {
+			a.addServiceMeta(serviceChecks, extras, opts)
+		}
 	}
 
-	return ourChecks, lastIndex
+	return ourChecks, extras, nodeChecks, lastIndex
+}
+
+// sendLatest sends the checks on the channel, replacing the ones not yet
+// received. There must be a single sender.
+func sendLatest(ch chan api.HealthChecks, checks api.HealthChecks) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- checks
+}
+
+// addServiceMeta looks up the meta of the services of the given checks, for
+// the TLS client rules matching on it.
+func (a *Agent) addServiceMeta(checks api.HealthChecks, extras map[types.CheckID]checkExtras, opts *api.QueryOptions) {
+	nodeOpts := &api.QueryOptions{
+		Namespace: opts.Namespace,
+		Partition: opts.Partition,
+	}
+	nodeOpts = nodeOpts.WithContext(opts.Context())
+
+	services := make(map[string]map[string]map[string]string)
+	for _, c := range checks {
+		if _, ok := services[c.Node]; !ok {
+			nodeServices, _, err := a.client.Catalog().NodeServiceList(c.Node, nodeOpts)
+			if err != nil {
+				a.logger.Warn("Error querying for service meta", "node", c.Node, "error", err)
+				services[c.Node] = nil
+				continue
+			}
+			services[c.Node] = make(map[string]map[string]string)
+			if nodeServices != nil {
+				for _, service := range nodeServices.Services {
+					services[c.Node][service.ID] = service.Meta
+				}
+			}
+		}
+
+		hash := hashCheck(c)
+		checkExtras := extras[hash]
+		checkExtras.ServiceMeta = services[c.Node][c.ServiceID]
+		extras[hash] = checkExtras
+	}
+}
+
+// healthState returns the checks in any state, like Health().State, along
+// with the definition fields api.HealthCheckDefinition doesn't decode.
+func (a *Agent) healthState(opts *api.QueryOptions) (api.HealthChecks, []checkExtras, *api.QueryMeta, error) {
+	var raw json.RawMessage
+	meta, err := a.client.Raw().Query("/v1/health/state/"+api.HealthAny, &raw, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var checks api.HealthChecks
+	if err := json.Unmarshal(raw, &checks); err != nil {
+		return nil, nil, nil, err
+	}
+	var entries []struct{ Definition checkExtras }
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, nil, nil, err
+	}
+	definitions := make([]checkExtras, len(checks))
+	for i := range entries {
+		definitions[i] = entries[i].Definition
+	}
+	return checks, definitions, meta, nil
 }
 
 // Check last visible node status.
@@ -1009,6 +1272,49 @@ func (a *Agent) HasPartition(callback func(partition string)) {
 // Returns:
 //   *api.QueryOptions: A new QueryOptions object with the partition set if applicable.
 
+// watchBlocking is a long running goroutine that runs the query as a blocking
+// query until shutdown, passing it the index of its last result. Errors are
+// logged as happening while doing the given action, and retried after
+// retryTime.
+func (a *Agent) watchBlocking(action string, query func(opts *api.QueryOptions) (*api.QueryMeta, error)) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	go func() {
+		select {
+		case <-a.shutdownCh:
+			cancelFunc()
+		case <-ctx.Done():
+		}
+	}()
+
+	var waitIndex uint64
+	for {
+		opts := a.ConsulQueryOption()
+		opts.WaitIndex = waitIndex
+		meta, err := query(opts.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.logger.Warn("Error "+action, "error", err)
+			select {
+			case <-a.shutdownCh:
+				return
+			case <-time.After(retryTime):
+			}
+			continue
+		}
+
+		// Reset the index if it goes backwards, as the blocking query
+		// documentation recommends.
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		} else {
+			waitIndex = meta.LastIndex
+		}
+	}
+}
+
 func (a *Agent) ConsulQueryOption() *api.QueryOptions {
 	opts := &api.QueryOptions{}
 	a.HasPartition(func(partition string) {
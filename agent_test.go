@@ -681,7 +681,7 @@ func TestAgent_getHealthChecks(t *testing.T) {
 
 		ourNodes := map[string]bool{"foo": true}
 
-		ourChecks, _ := agent.getHealthChecks(0, ourNodes)
+		ourChecks, _, _, _ := agent.getHealthChecks(0, ourNodes)
 		if len(ourChecks) != 1 {
 			t.Error("should be 1 checks, got", len(ourChecks))
 		}
@@ -728,7 +728,7 @@ func TestAgent_getHealthChecks(t *testing.T) {
 
 		ourNodes := map[string]bool{"foo": true}
 
-		ourChecks, _ := agent.getHealthChecks(0, ourNodes)
+		ourChecks, _, _, _ := agent.getHealthChecks(0, ourNodes)
 		if len(ourChecks) != 2 {
 			t.Error("should be 2 checks, got", len(ourChecks))
 		}
@@ -769,6 +769,50 @@ func TestAgent_PartitionOrEmpty(t *testing.T) {
 	}
 }
 
+func TestAgent_healthStateDefinitionExtras(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	require.NoError(t, err)
+
+	// The api package can't register these fields, so use the HTTP API.
+	registration := map[string]interface{}{
+		"Node":     "external",
+		"Address":  "service.local",
+		"NodeMeta": map[string]string{"external-node": "true"},
+		"Check": map[string]interface{}{
+			"CheckID": "ext-http",
+			"Name":    "http-test",
+			"Definition": map[string]interface{}{
+				"HTTP":             "http://service.local/health",
+				"Interval":         "10s",
+				"DisableRedirects": true,
+				"OutputMaxSize":    256,
+			},
+		},
+	}
+	_, err = client.Raw().Write("/v1/catalog/register", registration, nil, nil)
+	require.NoError(t, err)
+
+	agent := &Agent{
+		client: client,
+		config: &Config{},
+		logger: hclog.NewNullLogger(),
+	}
+	checks, definitions, _, err := agent.healthState(&api.QueryOptions{
+		NodeMeta: map[string]string{"external-node": "true"},
+	})
+	require.NoError(t, err)
+	require.Len(t, checks, 1)
+	require.Equal(t, "http://service.local/health", checks[0].Definition.HTTP)
+	require.Equal(t, []checkExtras{{DisableRedirects: true, OutputMaxSize: 256}}, definitions)
+}
+
 func TestAgent_getHealthChecksWithPartition(t *testing.T) {
 	testPartition := "test-partition"
 	notUniqueInstanceID := "not-unique-instance-id"
@@ -838,7 +882,7 @@ func TestAgent_getHealthChecksWithPartition(t *testing.T) {
 		defer agent.Shutdown()
 
 		ourNodes := map[string]bool{"foo": true}
-		ourChecks, _ := agent.getHealthChecks(0, ourNodes)
+		ourChecks, _, _, _ := agent.getHealthChecks(0, ourNodes)
 		if len(ourChecks) != 2 {
 			t.Error("should be 2 checks, got", len(ourChecks))
 		}
@@ -1284,7 +1328,8 @@ func TestAgent_getPrometheusDefs(t *testing.T) {
 		gauges, summaries := getPrometheusDefs(config)
 
 		// Verify we get the expected number of gauge definitions
-		expectedGaugeCount := len(AgentGauges) + len(MonitoredGauges) + len(LeaderGauges)
+		expectedGaugeCount := len(AgentGauges) + len(MonitoredGauges) + len(LeaderGauges) + len(BreakerGauges) + len(CoordinateGauges) + len(TLSGauges) +
+			len(CertExpiryGauges)
 		require.Len(t, gauges, expectedGaugeCount, "Should have correct number of gauge definitions")
 
 		// Verify we get the expected number of summary definitions
@@ -1302,6 +1347,8 @@ func TestAgent_getPrometheusDefs(t *testing.T) {
 			"esm.nodes.monitored",
 			"esm.services.monitored",
 			"esm.agents.healthy",
+			"esm.circuit_breaker.tripped",
+			"esm.coordinates.pending",
 		}
 
 		for _, expected := range expectedGauges {
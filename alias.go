@@ -0,0 +1,297 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-hclog"
+)
+
+// aliasDirective is the check notes directive making a check mirror the
+// health of a node or service, given as "[node=<node>] [service=<id>]".
+const aliasDirective = "esm-alias"
+
+// parseAliasDirective returns the node and service ID given in the value of
+// an alias check directive. Like Consul's alias checks, a service without a
+// node is looked up on the node of the check.
+func parseAliasDirective(value, checkNode string) (string, string, error) {
+	var node, serviceID string
+	for _, field := range strings.Fields(value) {
+		name, option, ok := strings.Cut(field, "=")
+		if !ok || option == "" {
+			return "", "", fmt.Errorf("%q isn't an <option>=<value> pair", field)
+		}
+		switch name {
+		case "node":
+			node = option
+		case "service":
+			serviceID = option
+		default:
+			return "", "", fmt.Errorf("unknown option %q", name)
+		}
+	}
+	if node == "" && serviceID == "" {
+		return "", "", fmt.Errorf("node or service must be set")
+	}
+	if node == "" {
+		node = checkNode
+	}
+	return node, serviceID, nil
+}
+
+// Update an alias check
+func (c *CheckRunner) updateCheckAlias(
+	latestCheck *api.HealthCheck, checkHash types.CheckID,
+	definition *api.HealthCheckDefinition, directive string, updated, added checkIDSet,
+) bool {
+	alias := &CheckAlias{
+		CheckID:   structs.CheckID{ID: checkHash},
+		Interval:  definition.IntervalDuration,
+		Namespace: latestCheck.Namespace,
+		Partition: latestCheck.Partition,
+		Client:    c.client,
+		Logger:    c.logger,
+		Notifier:  c,
+	}
+	alias.Node, alias.ServiceID, alias.err = parseAliasDirective(directive, latestCheck.Node)
+
+	if check, checkExists := c.checks.Load(checkHash); checkExists {
+		existing, aliasCheckExists := c.checksAlias.Load(checkHash)
+		if aliasCheckExists &&
+			existing.Node == alias.Node &&
+			existing.ServiceID == alias.ServiceID &&
+			existing.Namespace == alias.Namespace &&
+			existing.Partition == alias.Partition &&
+			fmt.Sprint(existing.err) == fmt.Sprint(alias.err) &&
+			existing.Interval == alias.Interval &&
+			check.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
+			return false
+		}
+
+		c.logger.Info("Updating alias check", "checkHash", checkHash)
+
+		if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency: updated alias check was not running", "checkHash", checkHash)
+			return false
+		}
+
+		updated[checkHash] = true
+	} else {
+		c.logger.Debug("Added alias check", "checkHash", checkHash)
+		added[checkHash] = true
+	}
+
+	alias.Start()
+	c.checksAlias.Store(checkHash, alias)
+
+	return true
+}
+
+// CheckAlias mirrors the aggregated health of a node, or of a service on a
+// node, like Consul's alias checks, which only agents run. It watches the
+// checks of the node with blocking queries, updating the status as soon as
+// they change and at least every interval. The status is the worst of the
+// node's own checks and those of the service, and is critical if the service
+// or the node doesn't exist.
+type CheckAlias struct {
+	CheckID structs.CheckID
+
+	// Node is the aliased node, and ServiceID the ID of the aliased service
+	// on it, or empty if aliasing the node.
+	Node      string
+	ServiceID string
+	Namespace string
+	Partition string
+
+	// Interval is the longest a blocking query waits for a change.
+	Interval time.Duration
+
+	Client   *api.Client
+	Logger   hclog.Logger
+	Notifier consulchecks.CheckNotifier
+
+	// err is the error of an invalid directive, reported as the output.
+	err error
+
+	periodicRunner
+}
+
+// Start is used to start the check. The check runs until stop is called.
+func (c *CheckAlias) Start() {
+	c.startLoop(c.run)
+}
+
+// run watches the aliased checks until stopCh is closed.
+func (c *CheckAlias) run(stopCh <-chan struct{}) {
+	select {
+	case <-time.After(lib.RandomStagger(c.Interval)):
+	case <-stopCh:
+		return
+	}
+	if c.err != nil {
+		c.RunOnce(c.Notifier)
+		<-stopCh
+		return
+	}
+
+	// Cancel the blocking queries once stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var waitIndex uint64
+	failures := 0
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		checks, meta, err := c.Client.Health().Node(c.Node, c.queryOptions(ctx, waitIndex))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// A single failure is likely a transient one, such as a leader
+			// election.
+			failures++
+			c.Logger.Warn("error watching aliased checks", "checkID", c.CheckID.ID, "error", err)
+			if failures > 1 {
+				c.Notifier.UpdateCheck(c.CheckID, api.HealthCritical,
+					fmt.Sprintf("Failure checking aliased node or service: %s", err))
+			}
+			select {
+			case <-time.After(retryTime):
+			case <-stopCh:
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		// Reset the index if it goes backwards, as the blocking query
+		// documentation recommends.
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		} else {
+			waitIndex = meta.LastIndex
+		}
+		c.update(ctx, c.Notifier, checks)
+	}
+}
+
+// RunOnce runs the check right away and passes its result to the notifier.
+func (c *CheckAlias) RunOnce(notifier consulchecks.CheckNotifier) {
+	if c.err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical,
+			fmt.Sprintf("Invalid %s directive: %s", aliasDirective, c.err))
+		return
+	}
+
+	ctx := context.Background()
+	checks, _, err := c.Client.Health().Node(c.Node, c.queryOptions(ctx, 0))
+	if err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical,
+			fmt.Sprintf("Failure checking aliased node or service: %s", err))
+		return
+	}
+	c.update(ctx, notifier, checks)
+}
+
+// queryOptions returns the options of the queries of the aliased node, blocking
+// until waitIndex if set.
+func (c *CheckAlias) queryOptions(ctx context.Context, waitIndex uint64) *api.QueryOptions {
+	opts := &api.QueryOptions{
+		Namespace:  c.Namespace,
+		Partition:  c.Partition,
+		AllowStale: true,
+		WaitIndex:  waitIndex,
+		WaitTime:   c.Interval,
+	}
+	return opts.WithContext(ctx)
+}
+
+// update sets the status from the checks of the aliased node.
+func (c *CheckAlias) update(ctx context.Context, notifier consulchecks.CheckNotifier, checks api.HealthChecks) {
+	status, output, found := c.evaluate(checks)
+	if !found {
+		if exists, err := c.exists(ctx); err != nil {
+			c.Logger.Warn("error looking up aliased node or service", "checkID", c.CheckID.ID, "error", err)
+		} else if !exists {
+			status = api.HealthCritical
+			if c.ServiceID != "" {
+				output = fmt.Sprintf("Service %s could not be found on node %s", c.ServiceID, c.Node)
+			} else {
+				output = fmt.Sprintf("Node %s could not be found", c.Node)
+			}
+		}
+	}
+	notifier.UpdateCheck(c.CheckID, status, output)
+}
+
+// evaluate returns the status and output mirroring the checks of the aliased
+// node, and whether any of them belongs to the aliased service, or to the
+// node if aliasing it. Checks of other services are ignored, as is the alias
+// check itself.
+func (c *CheckAlias) evaluate(checks api.HealthChecks) (string, string, bool) {
+	status := api.HealthPassing
+	output := "No checks found."
+	found := false
+	for _, check := range checks {
+		if check.ServiceID != c.ServiceID && check.ServiceID != "" {
+			continue
+		}
+		if hashCheck(check) == c.CheckID.ID {
+			continue
+		}
+		if check.ServiceID == c.ServiceID {
+			found = true
+		}
+
+		switch check.Status {
+		case api.HealthCritical:
+			return api.HealthCritical, fmt.Sprintf("Aliased check %q failing: %s", check.Name, check.Output), true
+		case api.HealthWarning:
+			if status == api.HealthPassing {
+				status = api.HealthWarning
+				output = fmt.Sprintf("Aliased check %q failing: %s", check.Name, check.Output)
+			}
+		default:
+			if status == api.HealthPassing {
+				output = "All checks passing."
+			}
+		}
+	}
+	return status, output, found
+}
+
+// exists returns whether the aliased service, or node, is in the catalog.
+func (c *CheckAlias) exists(ctx context.Context) (bool, error) {
+	opts := &api.QueryOptions{Namespace: c.Namespace, Partition: c.Partition, AllowStale: true}
+	node, _, err := c.Client.Catalog().Node(c.Node, opts.WithContext(ctx))
+	if err != nil || node == nil {
+		return false, err
+	}
+	if c.ServiceID == "" {
+		return true, nil
+	}
+	_, ok := node.Services[c.ServiceID]
+	return ok, nil
+}
@@ -0,0 +1,217 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAliasDirective(t *testing.T) {
+	node, serviceID, err := parseAliasDirective("service=db", "external")
+	require.NoError(t, err)
+	require.Equal(t, "external", node)
+	require.Equal(t, "db", serviceID)
+
+	node, serviceID, err = parseAliasDirective("node=db-node service=db", "external")
+	require.NoError(t, err)
+	require.Equal(t, "db-node", node)
+	require.Equal(t, "db", serviceID)
+
+	node, serviceID, err = parseAliasDirective("node=db-node", "external")
+	require.NoError(t, err)
+	require.Equal(t, "db-node", node)
+	require.Empty(t, serviceID)
+
+	for value, expected := range map[string]string{
+		"":                 "node or service must be set",
+		"db":               `"db" isn't an <option>=<value> pair`,
+		"service=":         `"service=" isn't an <option>=<value> pair`,
+		"check=db-healthy": `unknown option "check"`,
+	} {
+		_, _, err := parseAliasDirective(value, "external")
+		require.EqualError(t, err, expected, value)
+	}
+}
+
+func TestCheckAlias_evaluate(t *testing.T) {
+	alias := &CheckAlias{
+		CheckID:   structs.CheckID{ID: "external/frontend/db-alias"},
+		Node:      "external",
+		ServiceID: "db",
+	}
+	check := func(serviceID, checkID, status string) *api.HealthCheck {
+		return &api.HealthCheck{
+			Node:      "external",
+			ServiceID: serviceID,
+			CheckID:   checkID,
+			Name:      checkID,
+			Status:    status,
+			Output:    status + " output",
+		}
+	}
+
+	status, output, found := alias.evaluate(nil)
+	require.Equal(t, api.HealthPassing, status)
+	require.Equal(t, "No checks found.", output)
+	require.False(t, found)
+
+	// Checks of other services, and the alias check itself, are ignored.
+	status, output, found = alias.evaluate(api.HealthChecks{
+		check("db", "db-tcp", api.HealthPassing),
+		check("frontend", "frontend-http", api.HealthCritical),
+		check("frontend", "db-alias", api.HealthCritical),
+	})
+	require.Equal(t, api.HealthPassing, status)
+	require.Equal(t, "All checks passing.", output)
+	require.True(t, found)
+
+	// Node checks are included, and the worst status wins.
+	status, output, _ = alias.evaluate(api.HealthChecks{
+		check("", "node-ping", api.HealthWarning),
+		check("db", "db-tcp", api.HealthPassing),
+	})
+	require.Equal(t, api.HealthWarning, status)
+	require.Equal(t, `Aliased check "node-ping" failing: warning output`, output)
+
+	status, output, _ = alias.evaluate(api.HealthChecks{
+		check("", "node-ping", api.HealthWarning),
+		check("db", "db-tcp", api.HealthCritical),
+	})
+	require.Equal(t, api.HealthCritical, status)
+	require.Equal(t, `Aliased check "db-tcp" failing: critical output`, output)
+}
+
+func TestCheckAlias(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	require.NoError(t, err)
+
+	register := func(status string) {
+		_, err := client.Catalog().Register(&api.CatalogRegistration{
+			Node:    "db-node",
+			Address: "db.example.com",
+			Service: &api.AgentService{ID: "db", Service: "db"},
+			Check: &api.AgentCheck{
+				Node:      "db-node",
+				CheckID:   "db-tcp",
+				Name:      "db-tcp",
+				ServiceID: "db",
+				Status:    status,
+				Output:    "connection refused",
+			},
+		}, nil)
+		require.NoError(t, err)
+	}
+	register(api.HealthPassing)
+
+	notifier := &recordingNotifier{updates: make(chan [2]string, 10)}
+	next := func() [2]string {
+		select {
+		case result := <-notifier.updates:
+			return result
+		case <-time.After(10 * time.Second):
+			t.Fatal("no result from the alias check")
+			return [2]string{}
+		}
+	}
+
+	// Without an interval, there's no stagger before the first result.
+	alias := &CheckAlias{
+		CheckID:   structs.CheckID{ID: "external/frontend/db-alias"},
+		Node:      "db-node",
+		ServiceID: "db",
+		Client:    client,
+		Logger:    hclog.NewNullLogger(),
+		Notifier:  notifier,
+	}
+	alias.Start()
+	defer alias.Stop()
+	require.Equal(t, [2]string{api.HealthPassing, "All checks passing."}, next())
+
+	// Changes are picked up by the blocking query.
+	register(api.HealthCritical)
+	require.Equal(t, [2]string{api.HealthCritical, `Aliased check "db-tcp" failing: connection refused`}, next())
+
+	missing := &CheckAlias{
+		CheckID:   structs.CheckID{ID: "external/frontend/cache-alias"},
+		Node:      "db-node",
+		ServiceID: "cache",
+		Client:    client,
+		Logger:    hclog.NewNullLogger(),
+	}
+	recorder := &recordingNotifier{}
+	missing.RunOnce(recorder)
+	require.Equal(t, api.HealthCritical, recorder.status)
+	require.Equal(t, "Service cache could not be found on node db-node", recorder.output)
+
+	missing.Node, missing.ServiceID = "cache-node", ""
+	missing.RunOnce(recorder)
+	require.Equal(t, api.HealthCritical, recorder.status)
+	require.Equal(t, "Node cache-node could not be found", recorder.output)
+
+	// Services without checks are passing.
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:    "cache-node",
+		Address: "cache.example.com",
+		Service: &api.AgentService{ID: "cache", Service: "cache"},
+	}, nil)
+	require.NoError(t, err)
+	missing.ServiceID = "cache"
+	missing.RunOnce(recorder)
+	require.Equal(t, api.HealthPassing, recorder.status)
+	require.Equal(t, "No checks found.", recorder.output)
+}
+
+func TestCheck_Alias(t *testing.T) {
+	runner := NewCheckRunner(hclog.NewNullLogger(), nil, 0, 0, &tls.Config{}, 0, 0)
+	defer runner.Stop()
+
+	checks := api.HealthChecks{
+		{
+			Node:       "external",
+			ServiceID:  "frontend",
+			CheckID:    "db-alias",
+			Notes:      "esm-alias: node=db-node service=db",
+			Definition: api.HealthCheckDefinition{IntervalDuration: time.Hour},
+		},
+	}
+	hash := hashCheck(checks[0])
+
+	runner.UpdateChecks(checks)
+	aliasCheck, ok := runner.checksAlias.Load(hash)
+	require.True(t, ok)
+	require.Equal(t, "db-node", aliasCheck.Node)
+	require.Equal(t, "db", aliasCheck.ServiceID)
+
+	// Unchanged checks are left running.
+	runner.UpdateChecks(checks)
+	unchanged, ok := runner.checksAlias.Load(hash)
+	require.True(t, ok)
+	require.Same(t, aliasCheck, unchanged)
+
+	checks[0].Notes = "esm-alias: service=db"
+	runner.UpdateChecks(checks)
+	aliasCheck, ok = runner.checksAlias.Load(hash)
+	require.True(t, ok)
+	require.Equal(t, "external", aliasCheck.Node)
+
+	// Without the directive, it isn't a valid check anymore.
+	checks[0].Notes = ""
+	runner.UpdateChecks(checks)
+	_, ok = runner.checksAlias.Load(hash)
+	require.False(t, ok)
+}
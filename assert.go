@@ -0,0 +1,333 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// assertDirective is the check notes directive holding the CEL expression
+	// an HTTP check's response is evaluated with.
+	assertDirective = "esm-assert"
+
+	// maxAssertBodySize is the size of the response body an assertion is
+	// evaluated over. Longer bodies are truncated.
+	maxAssertBodySize = 1 << 20
+)
+
+// assertEnv is the CEL environment of the assertions. Headers are keyed by
+// their canonical name, with multiple values joined by a comma. json is null
+// if the body isn't valid JSON.
+var assertEnv = mustNewEnv(
+	cel.Variable("status", cel.IntType),
+	cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+	cel.Variable("body", cel.StringType),
+	cel.Variable("json", cel.DynType),
+)
+
+// mustNewEnv returns the CEL environment with the given options, and panics if
+// they are invalid.
+func mustNewEnv(opts ...cel.EnvOption) *cel.Env {
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		panic(fmt.Sprintf("invalid CEL environment: %s", err))
+	}
+	return env
+}
+
+// compileAssertion compiles an assertion, which must evaluate to a bool, true
+// meaning passing, or to one of the "passing", "warning" or "critical"
+// statuses.
+func compileAssertion(expr string) (cel.Program, error) {
+	ast, issues := assertEnv.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	switch ast.OutputType() {
+	case cel.BoolType, cel.StringType, cel.DynType:
+	default:
+		return nil, fmt.Errorf("assertion must return a bool or a status, not %s", ast.OutputType())
+	}
+	return assertEnv.Program(ast)
+}
+
+// checkDirective returns the value of an ESM directive in a check's notes,
+// given on its own line as "<name>: <value>", or as "<name>" alone for an
+// empty value.
+func checkDirective(check *api.HealthCheck, name string) (string, bool) {
+	for _, line := range strings.Split(check.Notes, "\n") {
+		line = strings.TrimSpace(line)
+		if line == name {
+			return "", true
+		}
+		if value, ok := strings.CutPrefix(line, name+":"); ok {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// CheckHTTPESM is an HTTP check run by ESM in place of Consul's CheckHTTP, for
+// the checks with options CheckHTTP doesn't support, see esmHTTPOptions: an
+// assertion setting the status from the response, a proxy, secret references
+// in the headers or an OAuth2 client. Without them, it sets the status and
+// output the same way as CheckHTTP.
+type CheckHTTPESM struct {
+	CheckID          structs.CheckID
+	HTTP             string
+	Header           map[string][]string
+	Method           string
+	Body             string
+	Interval         time.Duration
+	Timeout          time.Duration
+	Logger           hclog.Logger
+	TLSClientConfig  *tls.Config
+	OutputMaxSize    int
+	DisableRedirects bool
+	Notifier         consulchecks.CheckNotifier
+
+	// Proxy is the proxy the requests are sent through, shown in the output
+	// of failed checks. If nil, the proxy environment variables are used like
+	// Consul's CheckHTTP does, unless NoProxyEnv is set.
+	Proxy *url.URL
+
+	// NoProxyEnv connects directly when Proxy is nil, so the hosts excluded by
+	// the configured proxy options don't fall back to the environment.
+	NoProxyEnv bool
+
+	// Secrets resolves the secret references in Header before each request.
+	// The secrets are redacted from the output.
+	Secrets *secretResolver
+
+	// OAuth2Client is the name of the OAuth2 client whose access token, from
+	// OAuth2, is sent in the Authorization header.
+	OAuth2Client string
+	OAuth2       *oauth2Tokens
+
+	// Assertion is the CEL expression. If it doesn't compile, the check is
+	// critical with the compilation error as its output. If empty, the status
+	// is set from the status code like Consul's CheckHTTP does.
+	Assertion string
+
+	program    cel.Program
+	programErr error
+	httpClient *http.Client
+	initOnce   sync.Once
+
+	periodicRunner
+}
+
+// Start is used to start the check. The check runs until stop is called.
+func (c *CheckHTTPESM) Start() {
+	c.initOnce.Do(c.init)
+	c.start(c.Interval, c.Notifier, c.check)
+}
+
+// init compiles the assertion and creates the HTTP client, the same way
+// Consul's CheckHTTP does.
+func (c *CheckHTTPESM) init() {
+	if c.Assertion != "" {
+		c.program, c.programErr = compileAssertion(c.Assertion)
+		if c.programErr != nil {
+			c.Logger.Warn("Invalid check assertion", "check", c.CheckID.String(), "error", c.programErr)
+		}
+	}
+
+	// Keep-alives are disabled to prevent failing checks due to the
+	// keepalive interval.
+	trans := cleanhttp.DefaultTransport()
+	trans.DisableKeepAlives = true
+	trans.TLSClientConfig = c.TLSClientConfig
+	if c.Proxy != nil {
+		trans.Proxy = http.ProxyURL(c.Proxy)
+	} else if c.NoProxyEnv {
+		trans.Proxy = nil
+	}
+	c.httpClient = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: trans,
+	}
+	if c.DisableRedirects {
+		c.httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	if c.Timeout > 0 {
+		c.httpClient.Timeout = c.Timeout
+	}
+	if c.OutputMaxSize < 1 {
+		c.OutputMaxSize = consulchecks.DefaultBufSize
+	}
+}
+
+// RunOnce runs the check right away and passes its result to the notifier.
+func (c *CheckHTTPESM) RunOnce(notifier consulchecks.CheckNotifier) {
+	c.initOnce.Do(c.init)
+	c.check(notifier)
+}
+
+// check performs the request and sets the status from the response.
+func (c *CheckHTTPESM) check(notifier consulchecks.CheckNotifier) {
+	if c.programErr != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, "Invalid assertion: "+c.programErr.Error())
+		return
+	}
+
+	method := c.Method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, c.HTTP, strings.NewReader(c.Body))
+	if err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, err.Error())
+		return
+	}
+	header := c.Header
+	var secrets []string
+	if hasSecretRefs(header) {
+		if header, secrets, err = c.Secrets.ResolveHeader(header); err != nil {
+			notifier.UpdateCheck(c.CheckID, api.HealthCritical, "Invalid header: "+err.Error())
+			return
+		}
+	}
+	req.Header = http.Header(header).Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", consulchecks.UserAgent)
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json, text/plain, text/*, */*")
+	}
+	var token oauth2Token
+	if c.OAuth2Client != "" {
+		if token, err = c.OAuth2.Token(c.OAuth2Client); err != nil {
+			notifier.UpdateCheck(c.CheckID, api.HealthCritical, err.Error())
+			return
+		}
+		req.Header.Set("Authorization", token.authorization())
+		secrets = append(secrets, token.accessToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, redactSecrets(err.Error(), secrets)+c.viaProxy())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && c.OAuth2Client != "" {
+		// The token may have been revoked, get a new one next time.
+		c.OAuth2.Invalidate(c.OAuth2Client, token.accessToken)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAssertBodySize))
+	if err != nil {
+		c.Logger.Warn("Check error while reading body", "check", c.CheckID.String(), "error", err)
+	}
+
+	output := fmt.Sprintf("HTTP %s %s: %s", method, c.HTTP, resp.Status)
+	var status string
+	if c.program == nil {
+		status = statusFromCode(resp.StatusCode)
+	} else if status, err = evaluateAssertion(c.program, resp, body); err != nil {
+		output += fmt.Sprintf(", assertion failed: %s", err)
+	} else {
+		output += fmt.Sprintf(", assertion returned %s", status)
+	}
+	if status != api.HealthPassing {
+		output += c.viaProxy()
+	}
+	if len(body) > c.OutputMaxSize {
+		body = body[:c.OutputMaxSize]
+	}
+	notifier.UpdateCheck(c.CheckID, status, redactSecrets(output+" Output: "+string(body), secrets))
+}
+
+// viaProxy returns the note added to the output of failed checks sent through
+// a proxy, so it's clear whether the proxy or the target failed.
+func (c *CheckHTTPESM) viaProxy() string {
+	if c.Proxy == nil {
+		return ""
+	}
+	return ", via proxy " + c.Proxy.Redacted()
+}
+
+// statusFromCode returns the status of a response without an assertion, the
+// same as Consul's CheckHTTP: 2xx is passing and 429 Too Many Requests is
+// warning.
+func statusFromCode(code int) string {
+	switch {
+	case code >= 200 && code <= 299:
+		return api.HealthPassing
+	case code == http.StatusTooManyRequests:
+		return api.HealthWarning
+	default:
+		return api.HealthCritical
+	}
+}
+
+// evaluateAssertion returns the status the assertion sets for the response.
+// Errors make the check critical.
+func evaluateAssertion(program cel.Program, resp *http.Response, body []byte) (string, error) {
+	result, _, err := program.Eval(responseVars(resp, body))
+	if err != nil {
+		return api.HealthCritical, err
+	}
+
+	switch value := result.Value().(type) {
+	case bool:
+		if value {
+			return api.HealthPassing, nil
+		}
+		return api.HealthCritical, nil
+	case string:
+		switch value {
+		case api.HealthPassing, api.HealthWarning, api.HealthCritical:
+			return value, nil
+		}
+		return api.HealthCritical, fmt.Errorf("unknown status %q", value)
+	default:
+		return api.HealthCritical, fmt.Errorf("assertion returned %v, not a bool or a status", value)
+	}
+}
+
+// responseVars returns the variables of assertEnv for the response.
+func responseVars(resp *http.Response, body []byte) map[string]any {
+	headers := make(map[string]string, len(resp.Header))
+	for name, values := range resp.Header {
+		headers[name] = strings.Join(values, ",")
+	}
+	var parsed any
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		parsed = nil
+	}
+
+	return map[string]any{
+		"status":  resp.StatusCode,
+		"headers": headers,
+		"body":    string(body),
+		"json":    parsed,
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingNotifier records the last result of a check. If updates is set,
+// each result is also sent to it, for the tests of checks running in the
+// background.
+type recordingNotifier struct {
+	status, output string
+	updates        chan [2]string
+}
+
+func (n *recordingNotifier) UpdateCheck(checkID structs.CheckID, status, output string) {
+	n.status, n.output = status, output
+	if n.updates != nil {
+		n.updates <- [2]string{status, output}
+	}
+}
+
+func (n *recordingNotifier) ServiceExists(serviceID structs.ServiceID) bool {
+	return false
+}
+
+func TestCompileAssertion(t *testing.T) {
+	_, err := compileAssertion(`status == 200 &&`)
+	require.Error(t, err)
+
+	_, err = compileAssertion(`status + 1`)
+	require.ErrorContains(t, err, "must return a bool or a status")
+
+	_, err = compileAssertion(`json.status == "ok" ? "passing" : "warning"`)
+	require.NoError(t, err)
+}
+
+func TestCheckDirective(t *testing.T) {
+	check := &api.HealthCheck{Notes: "Partner API health\n  esm-assert: status == 200 \n"}
+	value, ok := checkDirective(check, assertDirective)
+	require.True(t, ok)
+	require.Equal(t, "status == 200", value)
+
+	_, ok = checkDirective(&api.HealthCheck{Notes: "Partner API health"}, assertDirective)
+	require.False(t, ok)
+
+	// A directive without a value can be given without the colon.
+	value, ok = checkDirective(&api.HealthCheck{Notes: "Partner API\nesm-cert-expiry "}, certExpiryDirective)
+	require.True(t, ok)
+	require.Empty(t, value)
+
+	_, ok = checkDirective(&api.HealthCheck{Notes: "esm-cert-expiry-days: 3"}, certExpiryDirective)
+	require.False(t, ok)
+}
+
+func TestCheckHTTPESM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", "2")
+		if r.URL.Path == "/text" {
+			w.Write([]byte("all good"))
+			return
+		}
+		w.Write([]byte(`{"status":"degraded","replicas":2}`))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		path      string
+		assertion string
+		status    string
+		output    string
+	}{
+		{"/", `status == 200`, api.HealthPassing, "assertion returned passing"},
+		{"/", `json.status == "ok"`, api.HealthCritical, "assertion returned critical"},
+		{"/", `json.status == "ok" ? "passing" : "warning"`, api.HealthWarning, "assertion returned warning"},
+		{"/", `json.replicas >= 2.0 && headers["X-Version"] == "2"`, api.HealthPassing, `{"status":"degraded"`},
+		{"/text", `body.contains("good") && json == null`, api.HealthPassing, "Output: all good"},
+		{"/", `json.status`, api.HealthCritical, `unknown status "degraded"`},
+		{"/", `json.missing == 1`, api.HealthCritical, "assertion failed"},
+		{"/", `status ==`, api.HealthCritical, "Invalid assertion"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.assertion, func(t *testing.T) {
+			notifier := &recordingNotifier{}
+			check := &CheckHTTPESM{
+				CheckID:         structs.CheckID{ID: "assert"},
+				HTTP:            server.URL + tc.path,
+				Interval:        time.Hour,
+				Logger:          hclog.NewNullLogger(),
+				TLSClientConfig: &tls.Config{},
+				Assertion:       tc.assertion,
+			}
+			check.RunOnce(notifier)
+			require.Equal(t, tc.status, notifier.status)
+			require.Contains(t, notifier.output, tc.output)
+		})
+	}
+}
+
+func TestCheck_Assert(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	registration := &api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Notes:   "esm-assert: status == 200 && body.size() > 0",
+			Status:  api.HealthCritical,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://" + s.HTTPAddr + "/v1/status/leader",
+				IntervalDuration: 50 * time.Millisecond,
+			},
+		},
+	}
+	_, err = client.Catalog().Register(registration, nil)
+	require.NoError(t, err)
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+	hash := hashCheck(checks[0])
+
+	_, ok := runner.checksHTTPESM.Load(hash)
+	require.True(t, ok)
+	_, ok = runner.checksHTTP.Load(hash)
+	require.False(t, ok)
+
+	waitForPassing := func(output string) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			checks, _, err := client.Health().Node("external", nil)
+			return err == nil && len(checks) == 1 &&
+				checks[0].Status == api.HealthPassing && strings.Contains(checks[0].Output, output)
+		}, 10*time.Second, 50*time.Millisecond)
+	}
+	waitForPassing("assertion returned passing")
+
+	// Removing the assertion switches back to Consul's HTTP check.
+	registration.Check.Notes = ""
+	registration.Check.Status = api.HealthCritical
+	_, err = client.Catalog().Register(registration, nil)
+	require.NoError(t, err)
+	checks, _, err = client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+
+	_, ok = runner.checksHTTPESM.Load(hash)
+	require.False(t, ok)
+	_, ok = runner.checksHTTP.Load(hash)
+	require.True(t, ok)
+}
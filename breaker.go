@@ -0,0 +1,133 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+	"github.com/hashicorp/go-hclog"
+)
+
+// breakerBuckets is the number of buckets the circuit breaker window is split
+// into. Results age out of the window one bucket at a time.
+const breakerBuckets = 10
+
+var BreakerGauges = []prometheus.GaugeDefinition{
+	{
+		Name: []string{"esm", "circuit_breaker", "tripped"},
+		Help: "Indicates if this ESM instance's mass-failure circuit breaker is tripped (1 for tripped, 0 otherwise)",
+	},
+}
+
+type breakerBucket struct {
+	start  time.Time
+	total  int
+	failed int
+}
+
+// circuitBreaker tracks the results of the node probes and checks run by this
+// instance. When more than threshold of them fail within window, the failures
+// are more likely caused by the ESM host losing connectivity than by the
+// external nodes, so the breaker trips and critical writes and reaping are
+// suspended until the failure rate drops again.
+//
+// A nil circuitBreaker is valid and never trips.
+type circuitBreaker struct {
+	logger     hclog.Logger
+	threshold  float64
+	window     time.Duration
+	minSamples int
+
+	lock    sync.Mutex
+	buckets [breakerBuckets]breakerBucket
+	tripped bool
+	total   int
+	failed  int
+}
+
+// newCircuitBreaker returns a circuit breaker for the given config, or nil if
+// the breaker is disabled.
+func newCircuitBreaker(logger hclog.Logger, config *Config) *circuitBreaker {
+	if config.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		logger:     logger,
+		threshold:  config.CircuitBreakerThreshold,
+		window:     config.CircuitBreakerWindow,
+		minSamples: config.CircuitBreakerMinSamples,
+	}
+}
+
+// Record adds the result of a probe or check run and re-evaluates the state
+// of the breaker.
+func (b *circuitBreaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	width := b.window / breakerBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+
+	b.total, b.failed = 0, 0
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.window {
+			b.total += bucket.total
+			b.failed += bucket.failed
+		}
+	}
+
+	over := b.total >= b.minSamples && float64(b.failed) > b.threshold*float64(b.total)
+	switch {
+	case over && !b.tripped:
+		b.tripped = true
+		b.logger.Error("Circuit breaker tripped, suspending critical updates and reaping",
+			"failed", b.failed, "total", b.total, "window", b.window.String())
+		metrics.SetGauge([]string{"esm", "circuit_breaker", "tripped"}, 1)
+	case !over && b.tripped:
+		b.tripped = false
+		b.logger.Info("Circuit breaker recovered, resuming critical updates and reaping",
+			"failed", b.failed, "total", b.total, "window", b.window.String())
+		metrics.SetGauge([]string{"esm", "circuit_breaker", "tripped"}, 0)
+	}
+}
+
+// Tripped returns true if critical writes and reaping should be suspended.
+func (b *circuitBreaker) Tripped() bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.tripped
+}
+
+// Status returns a description of the breaker's state for the ESM TTL check.
+func (b *circuitBreaker) Status() string {
+	if b == nil {
+		return ""
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.tripped {
+		return ""
+	}
+	return fmt.Sprintf("Circuit breaker tripped: %d of %d probes and checks failed in the last %s, "+
+		"critical updates and reaping are suspended", b.failed, b.total, b.window)
+}
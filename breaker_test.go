@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func testBreaker(t *testing.T, threshold float64, window time.Duration, minSamples int) *circuitBreaker {
+	conf, err := DefaultConfig()
+	require.NoError(t, err)
+	conf.CircuitBreakerThreshold = threshold
+	conf.CircuitBreakerWindow = window
+	conf.CircuitBreakerMinSamples = minSamples
+	return newCircuitBreaker(hclog.NewNullLogger(), conf)
+}
+
+func TestBreaker_disabled(t *testing.T) {
+	b := testBreaker(t, 0, time.Minute, 0)
+	require.Nil(t, b)
+
+	// A nil breaker is safe to use and never trips.
+	for i := 0; i < 10; i++ {
+		b.Record(true)
+	}
+	require.False(t, b.Tripped())
+	require.Empty(t, b.Status())
+}
+
+func TestBreaker_tripAndRecover(t *testing.T) {
+	b := testBreaker(t, 0.5, time.Minute, 4)
+
+	// Not enough samples to trip.
+	for i := 0; i < 3; i++ {
+		b.Record(true)
+	}
+	require.False(t, b.Tripped())
+
+	b.Record(true)
+	require.True(t, b.Tripped())
+	require.Contains(t, b.Status(), "4 of 4 probes and checks failed")
+
+	// Successes bring the failure rate back to the threshold.
+	for i := 0; i < 4; i++ {
+		b.Record(false)
+	}
+	require.False(t, b.Tripped())
+	require.Empty(t, b.Status())
+}
+
+func TestBreaker_window(t *testing.T) {
+	b := testBreaker(t, 0.5, time.Second, 2)
+
+	b.Record(true)
+	b.Record(true)
+	require.True(t, b.Tripped())
+
+	// Once the failures age out of the window the breaker recovers.
+	time.Sleep(1100 * time.Millisecond)
+	b.Record(false)
+	require.False(t, b.Tripped())
+}
@@ -0,0 +1,273 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-hclog"
+)
+
+// certExpiryDirective is the check notes directive turning an HTTP or TCP
+// check into a certificate expiry check, optionally followed by its
+// thresholds as "warning=<days> critical=<days>".
+const certExpiryDirective = "esm-cert-expiry"
+
+var CertExpiryGauges = []prometheus.GaugeDefinition{
+	{
+		Name: []string{"esm", "tls", "certificate", "days_remaining"},
+		Help: "Days until the first certificate of the peer chain of a certificate expiry check expires, by check",
+	},
+}
+
+// certExpiryThresholds are the days before expiry at which a certificate
+// expiry check goes warning and critical.
+type certExpiryThresholds struct {
+	warningDays  int
+	criticalDays int
+}
+
+// parseCertExpiryDirective returns the thresholds given in the directive's
+// value, defaulting to the configured ones.
+func parseCertExpiryDirective(value string, defaults certExpiryThresholds) (certExpiryThresholds, error) {
+	thresholds := defaults
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name, days, ok := strings.Cut(field, "=")
+		if !ok {
+			return thresholds, fmt.Errorf("%q isn't a <threshold>=<days> pair", field)
+		}
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return thresholds, fmt.Errorf("%s must be a number of days", name)
+		}
+		switch name {
+		case "warning":
+			thresholds.warningDays = n
+		case "critical":
+			thresholds.criticalDays = n
+		default:
+			return thresholds, fmt.Errorf("unknown threshold %q", name)
+		}
+	}
+	if thresholds.warningDays < thresholds.criticalDays {
+		return thresholds, fmt.Errorf("warning must be at least critical")
+	}
+	return thresholds, nil
+}
+
+// certExpiryAddress returns the address a certificate expiry check connects
+// to: the TCP address, or the host and port of the HTTP URL, defaulting to
+// 443.
+func certExpiryAddress(definition *api.HealthCheckDefinition) (string, error) {
+	if definition.HTTP == "" {
+		return definition.TCP, nil
+	}
+	u, err := url.Parse(definition.HTTP)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// Update a certificate expiry check
+func (c *CheckRunner) updateCheckCertExpiry(
+	latestCheck *api.HealthCheck, checkHash types.CheckID,
+	definition *api.HealthCheckDefinition, extras checkExtras, directive string,
+	updated, added checkIDSet,
+) bool {
+	certCheck := &CheckCertExpiry{
+		CheckID:         structs.CheckID{ID: checkHash},
+		Interval:        definition.IntervalDuration,
+		Timeout:         definition.TimeoutDuration,
+		Logger:          c.logger,
+		TLSClientConfig: c.checkTLSConfig(definition, extras),
+		Notifier:        c,
+	}
+	certCheck.Address, certCheck.err = certExpiryAddress(definition)
+	if certCheck.err == nil {
+		certCheck.Thresholds, certCheck.err = parseCertExpiryDirective(directive, c.certExpiry)
+	}
+
+	if check, checkExists := c.checks.Load(checkHash); checkExists {
+		existing, certCheckExists := c.checksCertExpiry.Load(checkHash)
+		if certCheckExists &&
+			existing.Address == certCheck.Address &&
+			existing.Thresholds == certCheck.Thresholds &&
+			fmt.Sprint(existing.err) == fmt.Sprint(certCheck.err) &&
+			tlsConfigsEqual(existing.TLSClientConfig, certCheck.TLSClientConfig) &&
+			existing.Interval == certCheck.Interval &&
+			existing.Timeout == certCheck.Timeout &&
+			check.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
+			return false
+		}
+
+		c.logger.Info("Updating certificate expiry check", "checkHash", checkHash)
+
+		if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency: updated certificate expiry check was not running", "checkHash", checkHash)
+			return false
+		}
+
+		updated[checkHash] = true
+	} else {
+		c.logger.Debug("Added certificate expiry check", "checkHash", checkHash)
+		added[checkHash] = true
+	}
+
+	certCheck.Start()
+	c.checksCertExpiry.Store(checkHash, certCheck)
+
+	return true
+}
+
+// CheckCertExpiry connects with TLS to the target of an HTTP or TCP check and
+// sets the status from the peer chain: warning once a certificate expires
+// within the warning threshold, critical within the critical threshold or if
+// the chain doesn't validate. The days until the first certificate expires
+// are exported as a gauge.
+type CheckCertExpiry struct {
+	CheckID         structs.CheckID
+	Address         string
+	Thresholds      certExpiryThresholds
+	Interval        time.Duration
+	Timeout         time.Duration
+	Logger          hclog.Logger
+	TLSClientConfig *tls.Config
+	Notifier        consulchecks.CheckNotifier
+
+	// err is the error of an invalid directive, reported as the output.
+	err error
+
+	periodicRunner
+}
+
+// Start is used to start the check. The check runs until stop is called.
+func (c *CheckCertExpiry) Start() {
+	c.start(c.Interval, c.Notifier, c.check)
+}
+
+// RunOnce runs the check right away and passes its result to the notifier.
+func (c *CheckCertExpiry) RunOnce(notifier consulchecks.CheckNotifier) {
+	c.check(notifier)
+}
+
+// check fetches the peer chain and sets the status from it.
+func (c *CheckCertExpiry) check(notifier consulchecks.CheckNotifier) {
+	if c.err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical,
+			fmt.Sprintf("Invalid %s directive: %s", certExpiryDirective, c.err))
+		return
+	}
+
+	certs, err := c.peerCertificates()
+	if err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("TLS connection to %s failed: %s", c.Address, err))
+		return
+	}
+	verifyErr := c.verifyChain(certs)
+
+	// The chain is as good as its first certificate to expire.
+	expiring := certs[0]
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(expiring.NotAfter) {
+			expiring = cert
+		}
+	}
+	remaining := time.Until(expiring.NotAfter)
+	days := remaining.Hours() / 24
+	metrics.SetGaugeWithLabels([]string{"esm", "tls", "certificate", "days_remaining"}, float32(days),
+		[]metrics.Label{{Name: "check", Value: string(c.CheckID.ID)}})
+
+	status := api.HealthPassing
+	switch {
+	case verifyErr != nil || days < float64(c.Thresholds.criticalDays):
+		status = api.HealthCritical
+	case days < float64(c.Thresholds.warningDays):
+		status = api.HealthWarning
+	}
+
+	var output string
+	if remaining < 0 {
+		output = fmt.Sprintf("Certificate of %s expired %d days ago", c.Address, int(-days))
+	} else {
+		output = fmt.Sprintf("Certificate of %s expires in %d days", c.Address, int(days))
+	}
+	output += fmt.Sprintf(": subject %s, issuer %s, expiry %s",
+		expiring.Subject, expiring.Issuer, expiring.NotAfter.UTC().Format(time.RFC3339))
+	if expiring != certs[0] {
+		output += fmt.Sprintf(", in the chain of %s", certs[0].Subject)
+	}
+	if verifyErr != nil {
+		output += fmt.Sprintf(", chain validation failed: %s", verifyErr)
+	}
+	notifier.UpdateCheck(c.CheckID, status, output)
+}
+
+// serverName returns the name the peer chain is validated against.
+func (c *CheckCertExpiry) serverName() string {
+	if c.TLSClientConfig.ServerName != "" {
+		return c.TLSClientConfig.ServerName
+	}
+	host, _, _ := net.SplitHostPort(c.Address)
+	return host
+}
+
+// peerCertificates connects to the target and returns its peer chain, without
+// validating it so its details can be reported either way.
+func (c *CheckCertExpiry) peerCertificates() ([]*x509.Certificate, error) {
+	tlsConfig := c.TLSClientConfig.Clone()
+	tlsConfig.ServerName = c.serverName()
+	tlsConfig.InsecureSkipVerify = true
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", c.Address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no peer certificates")
+	}
+	return certs, nil
+}
+
+// verifyChain validates the peer chain, unless the check skips TLS
+// verification.
+func (c *CheckCertExpiry) verifyChain(certs []*x509.Certificate) error {
+	if c.TLSClientConfig.InsecureSkipVerify {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       c.serverName(),
+		Roots:         c.TLSClientConfig.RootCAs,
+		Intermediates: intermediates,
+	})
+	return err
+}
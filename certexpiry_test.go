@@ -0,0 +1,215 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate returns a certificate for localhost valid for the given
+// lifetime, signed by the CA if set, with the CA in its chain.
+func testCertificate(t *testing.T, name string, lifetime time.Duration, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, any(key)
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent = ca.Leaf
+		signer = ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	if ca != nil {
+		cert.Certificate = append(cert.Certificate, ca.Certificate...)
+	}
+	return cert
+}
+
+func TestParseCertExpiryDirective(t *testing.T) {
+	defaults := certExpiryThresholds{warningDays: 30, criticalDays: 7}
+
+	thresholds, err := parseCertExpiryDirective("", defaults)
+	require.NoError(t, err)
+	require.Equal(t, defaults, thresholds)
+
+	thresholds, err = parseCertExpiryDirective("warning=14, critical=2", defaults)
+	require.NoError(t, err)
+	require.Equal(t, certExpiryThresholds{warningDays: 14, criticalDays: 2}, thresholds)
+
+	for value, expected := range map[string]string{
+		"14":          `"14" isn't a <threshold>=<days> pair`,
+		"warning=-1":  "warning must be a number of days",
+		"expired=1":   `unknown threshold "expired"`,
+		"critical=40": "warning must be at least critical",
+	} {
+		_, err := parseCertExpiryDirective(value, defaults)
+		require.EqualError(t, err, expected, value)
+	}
+}
+
+func TestCertExpiryAddress(t *testing.T) {
+	cases := []struct {
+		definition api.HealthCheckDefinition
+		expected   string
+	}{
+		{api.HealthCheckDefinition{HTTP: "https://api.example.com/health"}, "api.example.com:443"},
+		{api.HealthCheckDefinition{HTTP: "https://api.example.com:8443/health"}, "api.example.com:8443"},
+		{api.HealthCheckDefinition{TCP: "smtp.example.com:465"}, "smtp.example.com:465"},
+	}
+	for _, c := range cases {
+		address, err := certExpiryAddress(&c.definition)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, address)
+	}
+}
+
+func TestCheckCertExpiry(t *testing.T) {
+	sink := setupMetricsSink()
+	day := 24 * time.Hour
+
+	run := func(cert tls.Certificate, roots *x509.CertPool, skipVerify bool) *recordingNotifier {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.StartTLS()
+		defer server.Close()
+
+		notifier := &recordingNotifier{}
+		check := &CheckCertExpiry{
+			CheckID:         structs.CheckID{ID: "external/partner-api/cert"},
+			Address:         server.Listener.Addr().String(),
+			Thresholds:      certExpiryThresholds{warningDays: 30, criticalDays: 7},
+			Interval:        time.Hour,
+			Logger:          hclog.NewNullLogger(),
+			TLSClientConfig: &tls.Config{RootCAs: roots, InsecureSkipVerify: skipVerify},
+		}
+		check.RunOnce(notifier)
+		return notifier
+	}
+
+	ca := testCertificate(t, "ca", 365*day, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	notifier := run(testCertificate(t, "server", 60*day+time.Hour, &ca), roots, false)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Contains(t, notifier.output, "expires in 60 days: subject CN=server, issuer CN=ca, expiry ")
+
+	notifier = run(testCertificate(t, "server", 20*day+time.Hour, &ca), roots, false)
+	require.Equal(t, api.HealthWarning, notifier.status)
+	require.Contains(t, notifier.output, "expires in 20 days")
+
+	notifier = run(testCertificate(t, "server", 3*day+time.Hour, &ca), roots, false)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "expires in 3 days")
+
+	retry.Run(t, func(r *retry.R) {
+		intervals := sink.Data()
+		require.NotEmpty(r, intervals)
+		gauge, ok := intervals[len(intervals)-1].Gauges["consul-esm.esm.tls.certificate.days_remaining;check=external/partner-api/cert"]
+		require.True(r, ok)
+		require.InDelta(r, 3.04, gauge.Value, 0.01)
+	})
+
+	// Certificates expiring earlier in the chain are reported.
+	shortCA := testCertificate(t, "short-ca", 5*day+time.Hour, nil)
+	shortRoots := x509.NewCertPool()
+	shortRoots.AddCert(shortCA.Leaf)
+	notifier = run(testCertificate(t, "server", 60*day, &shortCA), shortRoots, false)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "expires in 5 days: subject CN=short-ca, issuer CN=short-ca")
+	require.Contains(t, notifier.output, ", in the chain of CN=server")
+
+	// Chains that don't validate are critical, unless verification is
+	// skipped.
+	notifier = run(testCertificate(t, "server", 60*day+time.Hour, &ca), x509.NewCertPool(), false)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "expires in 60 days")
+	require.Contains(t, notifier.output, "chain validation failed: x509: certificate signed by unknown authority")
+
+	notifier = run(testCertificate(t, "server", 60*day+time.Hour, &ca), x509.NewCertPool(), true)
+	require.Equal(t, api.HealthPassing, notifier.status)
+
+	notifier = run(testCertificate(t, "server", -day, &ca), roots, true)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "expired 1 days ago")
+
+	notifier = &recordingNotifier{}
+	(&CheckCertExpiry{
+		CheckID:         structs.CheckID{ID: "closed"},
+		Address:         "127.0.0.1:1",
+		TLSClientConfig: &tls.Config{},
+	}).RunOnce(notifier)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "TLS connection to 127.0.0.1:1 failed")
+}
+
+func TestCheck_CertExpiry(t *testing.T) {
+	runner := NewCheckRunner(hclog.NewNullLogger(), nil, 0, 0, &tls.Config{}, 0, 0)
+	defer runner.Stop()
+	runner.certExpiry = certExpiryThresholds{warningDays: 30, criticalDays: 7}
+
+	checks := api.HealthChecks{
+		{
+			Node:    "external",
+			CheckID: "partner-cert",
+			Notes:   "esm-cert-expiry: warning=14",
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "https://api.partner.example.com/health",
+				IntervalDuration: time.Hour,
+			},
+		},
+	}
+	hash := hashCheck(checks[0])
+
+	runner.UpdateChecks(checks)
+	certCheck, ok := runner.checksCertExpiry.Load(hash)
+	require.True(t, ok)
+	require.Equal(t, "api.partner.example.com:443", certCheck.Address)
+	require.Equal(t, certExpiryThresholds{warningDays: 14, criticalDays: 7}, certCheck.Thresholds)
+	_, ok = runner.checksHTTP.Load(hash)
+	require.False(t, ok)
+
+	// Removing the directive turns it back into an HTTP check.
+	checks[0].Notes = ""
+	runner.UpdateChecks(checks)
+	_, ok = runner.checksCertExpiry.Load(hash)
+	require.False(t, ok)
+	_, ok = runner.checksHTTP.Load(hash)
+	require.True(t, ok)
+}
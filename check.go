@@ -7,6 +7,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
 	"strings"
 	"sync"
@@ -64,6 +65,35 @@ type CheckRunner struct {
 	checksHTTP stopMap[types.CheckID, *consulchecks.CheckHTTP]
 	checksTCP  stopMap[types.CheckID, *consulchecks.CheckTCP]
 
+	// checksHTTPESM are HTTP checks with an assertion, a proxy, secrets in
+	// their headers or an OAuth2 client, run by ESM's own evaluator instead of
+	// Consul's CheckHTTP.
+	checksHTTPESM stopMap[types.CheckID, *CheckHTTPESM]
+
+	// checksSynthetic are the synthetic checks, whose steps are looked up in
+	// synthetics by name.
+	checksSynthetic stopMap[types.CheckID, *CheckSynthetic]
+	synthetics      *syntheticChecks
+
+	// checksCertExpiry are the checks with an esm-cert-expiry directive,
+	// inspecting the certificates of their target instead. certExpiry are
+	// the default thresholds of their directive.
+	checksCertExpiry stopMap[types.CheckID, *CheckCertExpiry]
+	certExpiry       certExpiryThresholds
+
+	// checksDNS are the checks with an esm-dns directive, resolving a name
+	// against dnsResolvers.
+	checksDNS    stopMap[types.CheckID, *CheckDNS]
+	dnsResolvers []string
+
+	// checksTCPExpect are TCP checks with a payload or an expected response,
+	// run by ESM instead of Consul's CheckTCP.
+	checksTCPExpect stopMap[types.CheckID, *CheckTCPExpect]
+
+	// checksAlias are the alias checks, mirroring the health of another node
+	// or service.
+	checksAlias stopMap[types.CheckID, *CheckAlias]
+
 	checksCritical checkMap[types.CheckID, time.Time]
 
 	// Used to track checks that are being deferred
@@ -74,14 +104,101 @@ type CheckRunner struct {
 
 	tlsConfig *tls.Config
 
+	// tlsRules select the client certificates of checks, falling back to
+	// tlsConfig.
+	tlsRules []tlsClientRule
+
+	// proxies select the proxy of HTTP checks. Nil if no proxy is configured.
+	proxies *proxyRules
+
+	// secrets resolves the secret references in HTTP check headers.
+	secrets *secretResolver
+
+	// oauth2 holds the tokens of the OAuth2 clients. Nil if there are none.
+	oauth2 *oauth2Tokens
+
 	PassingThreshold  int
 	CriticalThreshold int
+
+	// WarningThreshold is the number of additional warning results needed to
+	// update a check to warning.
+	WarningThreshold int
+
+	// WarningEscalationTimeout escalates checks that have been warning for
+	// longer to critical. Zero if warnings are never escalated.
+	WarningEscalationTimeout time.Duration
+
+	// EvaluationWindows are the sliding-window policies. Checks that don't
+	// match any use the threshold counters.
+	EvaluationWindows []EvaluationWindow
+
+	// FlapHistory is the number of recent results flap detection looks at.
+	// Zero if flap detection is disabled.
+	FlapHistory int
+
+	// FlapHighThreshold and FlapLowThreshold are the percentages of state
+	// changes at which checks start and stop flapping.
+	FlapHighThreshold float64
+	FlapLowThreshold  float64
+
+	// breaker suspends critical updates and reaping while tripped. Nil if
+	// disabled.
+	breaker *circuitBreaker
+
+	// reaper applies the reaping safeguards. Nil if every reap is allowed.
+	reaper *reapGuard
+
+	// maintenance pauses the checks of nodes and services in maintenance.
+	// Nil if maintenance mode isn't tracked.
+	maintenance *maintenanceTracker
+
+	// nodeHealth suppresses the checks of nodes whose externalNodeHealth
+	// check is critical. Nil if checks are never suppressed.
+	nodeHealth *nodeHealthTracker
+}
+
+// checkExtras are the details of a check that api.HealthCheck doesn't hold:
+// the fields of its definition stored in the catalog that
+// api.HealthCheckDefinition doesn't decode, and its service's meta.
+type checkExtras struct {
+	DisableRedirects bool
+	OutputMaxSize    int
+
+	// ServiceMeta is only looked up when a TLS client rule matches on it.
+	ServiceMeta map[string]string `json:"-"`
+}
+
+// outputMaxSize returns the maximum output size, defaulting to Consul's.
+func (e checkExtras) outputMaxSize() int {
+	if e.OutputMaxSize < 1 {
+		return consulchecks.DefaultBufSize
+	}
+	return e.OutputMaxSize
 }
 
 type esmHealthCheck struct {
 	api.HealthCheck
 	failureCounter int
+	warningCounter int
 	successCounter int
+
+	// warningSince is when the check started warning, for escalation.
+	warningSince time.Time
+
+	// window holds the recent results of checks with a sliding-window
+	// policy. Nil for checks using the counters.
+	window *resultWindow
+
+	// flap detects flapping checks, which keep their status until they
+	// settle. Nil if flap detection is disabled.
+	flap *flapDetector
+
+	// reevaluate writes the next result right away, after the node recovered.
+	reevaluate bool
+
+	// paused is set while the check's node or service is in maintenance, and
+	// the check isn't running.
+	paused bool
 }
 
 // checkMap is sync.Map with type safety
@@ -143,28 +260,78 @@ func NewCheckRunner(logger hclog.Logger, client *api.Client, updateInterval,
 func (c *CheckRunner) Stop() {
 	c.checksHTTP.StopAll()
 	c.checksTCP.StopAll()
+	c.checksHTTPESM.StopAll()
+	c.checksSynthetic.StopAll()
+	c.checksCertExpiry.StopAll()
+	c.checksDNS.StopAll()
+	c.checksTCPExpect.StopAll()
+	c.checksAlias.StopAll()
+}
+
+// stopCheck stops and forgets the running check with the given hash, whatever
+// its type. Returns false if there was none.
+func (c *CheckRunner) stopCheck(checkHash types.CheckID) bool {
+	found := false
+	if httpCheck, ok := c.checksHTTP.LoadAndDelete(checkHash); ok {
+		httpCheck.Stop()
+		found = true
+	}
+	if tcpCheck, ok := c.checksTCP.LoadAndDelete(checkHash); ok {
+		tcpCheck.Stop()
+		found = true
+	}
+	if esmCheck, ok := c.checksHTTPESM.LoadAndDelete(checkHash); ok {
+		esmCheck.Stop()
+		found = true
+	}
+	if syntheticCheck, ok := c.checksSynthetic.LoadAndDelete(checkHash); ok {
+		syntheticCheck.Stop()
+		found = true
+	}
+	if certCheck, ok := c.checksCertExpiry.LoadAndDelete(checkHash); ok {
+		certCheck.Stop()
+		found = true
+	}
+	if dnsCheck, ok := c.checksDNS.LoadAndDelete(checkHash); ok {
+		dnsCheck.Stop()
+		found = true
+	}
+	if expectCheck, ok := c.checksTCPExpect.LoadAndDelete(checkHash); ok {
+		expectCheck.Stop()
+		found = true
+	}
+	if aliasCheck, ok := c.checksAlias.LoadAndDelete(checkHash); ok {
+		aliasCheck.Stop()
+		found = true
+	}
+	return found
+}
+
+// statusHandler returns the StatusHandler of the Consul checks the runner
+// starts. It passes every result through, so UpdateCheck does all the
+// threshold counting, the same as for the checks ESM runs itself.
+func (c *CheckRunner) statusHandler() *consulchecks.StatusHandler {
+	return consulchecks.NewStatusHandler(c, c.logger, 0, 0, 0)
 }
 
 // Update an HTTP check
 func (c *CheckRunner) updateCheckHTTP(
 	latestCheck *api.HealthCheck, checkHash types.CheckID,
-	definition *api.HealthCheckDefinition, updated, added checkIDSet,
+	definition *api.HealthCheckDefinition, extras checkExtras, updated, added checkIDSet,
 ) bool {
-	tlsConfig := c.tlsConfig.Clone()
-	tlsConfig.InsecureSkipVerify = definition.TLSSkipVerify
-	tlsConfig.ServerName = definition.TLSServerName
-
 	http := &consulchecks.CheckHTTP{
-		CheckID:         structs.CheckID{ID: checkHash},
-		HTTP:            definition.HTTP,
-		Header:          definition.Header,
-		Method:          definition.Method,
-		Interval:        definition.IntervalDuration,
-		Timeout:         definition.TimeoutDuration,
-		Logger:          c.logger,
-		TLSClientConfig: tlsConfig,
-		StatusHandler: consulchecks.NewStatusHandler(c, c.logger,
-			c.PassingThreshold, c.CriticalThreshold, c.CriticalThreshold),
+		CheckID:          structs.CheckID{ID: checkHash},
+		HTTP:             definition.HTTP,
+		Header:           definition.Header,
+		Method:           definition.Method,
+		Body:             definition.Body,
+		Interval:         definition.IntervalDuration,
+		Timeout:          definition.TimeoutDuration,
+		Logger:           c.logger,
+		TLSClientConfig:  c.checkTLSConfig(definition, extras),
+		OutputMaxSize:    extras.outputMaxSize(),
+		DisableRedirects: extras.DisableRedirects,
+		StatusHandler:    c.statusHandler(),
 	}
 
 	if check, checkExists := c.checks.Load(checkHash); checkExists {
@@ -173,8 +340,10 @@ func (c *CheckRunner) updateCheckHTTP(
 			httpCheck.HTTP == http.HTTP &&
 			headersAlmostEqual(httpCheck.Header, http.Header) &&
 			httpCheck.Method == http.Method &&
-			httpCheck.TLSClientConfig.InsecureSkipVerify == http.TLSClientConfig.InsecureSkipVerify &&
-			httpCheck.TLSClientConfig.ServerName == http.TLSClientConfig.ServerName &&
+			httpCheck.Body == http.Body &&
+			tlsConfigsEqual(httpCheck.TLSClientConfig, http.TLSClientConfig) &&
+			httpCheck.OutputMaxSize == http.OutputMaxSize &&
+			httpCheck.DisableRedirects == http.DisableRedirects &&
 			httpCheck.Interval == http.Interval &&
 			httpCheck.Timeout == http.Timeout &&
 			check.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
@@ -185,14 +354,9 @@ func (c *CheckRunner) updateCheckHTTP(
 
 		if httpCheckExists {
 			httpCheck.Stop()
-		} else {
-			tcpCheck, tcpCheckExists := c.checksTCP.Load(checkHash)
-			if !tcpCheckExists {
-				c.logger.Warn("Inconsistency check is not TCP and HTTP", "checkHash", checkHash)
-				return false
-			}
-			tcpCheck.Stop()
-			c.checksTCP.Delete(checkHash)
+		} else if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency check is not TCP and HTTP", "checkHash", checkHash)
+			return false
 		}
 
 		updated[checkHash] = true
@@ -207,6 +371,17 @@ func (c *CheckRunner) updateCheckHTTP(
 	return true
 }
 
+// Compares the per-check TLS options, where a nil config means TLS isn't used
+func tlsConfigsEqual(c1, c2 *tls.Config) bool {
+	if c1 == nil || c2 == nil {
+		return c1 == c2
+	}
+	return c1.InsecureSkipVerify == c2.InsecureSkipVerify &&
+		c1.ServerName == c2.ServerName &&
+		reflect.DeepEqual(c1.Certificates, c2.Certificates) &&
+		c1.RootCAs.Equal(c2.RootCAs)
+}
+
 // Compares headers, skipping ones automatically added by Consul
 // in consul/agent/checks/check.go
 func headersAlmostEqual(h1, h2 map[string][]string) bool {
@@ -223,24 +398,120 @@ func headersAlmostEqual(h1, h2 map[string][]string) bool {
 	return true
 }
 
+// esmHTTPOptions are the options of an HTTP check that Consul's CheckHTTP
+// doesn't support.
+type esmHTTPOptions struct {
+	assertion    string
+	proxy        *url.URL
+	noProxyEnv   bool
+	oauth2Client string
+}
+
+// esmHTTPOptions returns the options of an HTTP check, and true if any is set
+// so the check has to be run by ESM. Once a proxy is configured, every HTTP
+// check is run by ESM so the proxy options alone decide how it connects.
+func (c *CheckRunner) esmHTTPOptions(check *api.HealthCheck, definition *api.HealthCheckDefinition) (esmHTTPOptions, bool) {
+	if definition.HTTP == "" {
+		return esmHTTPOptions{}, false
+	}
+	assertion, hasAssertion := checkDirective(check, assertDirective)
+	oauth2Client, hasOAuth2 := checkDirective(check, oauth2Directive)
+	options := esmHTTPOptions{
+		assertion:    assertion,
+		proxy:        c.proxies.proxyFor(checkHost(definition)),
+		noProxyEnv:   c.proxies != nil,
+		oauth2Client: oauth2Client,
+	}
+	return options, hasAssertion || hasOAuth2 || options.noProxyEnv || hasSecretRefs(definition.Header)
+}
+
+// Update an HTTP check run by ESM
+func (c *CheckRunner) updateCheckHTTPESM(
+	latestCheck *api.HealthCheck, checkHash types.CheckID,
+	definition *api.HealthCheckDefinition, extras checkExtras, options esmHTTPOptions,
+	updated, added checkIDSet,
+) bool {
+	httpCheck := &CheckHTTPESM{
+		CheckID:          structs.CheckID{ID: checkHash},
+		HTTP:             definition.HTTP,
+		Header:           definition.Header,
+		Method:           definition.Method,
+		Body:             definition.Body,
+		Interval:         definition.IntervalDuration,
+		Timeout:          definition.TimeoutDuration,
+		Logger:           c.logger,
+		TLSClientConfig:  c.checkTLSConfig(definition, extras),
+		OutputMaxSize:    extras.outputMaxSize(),
+		DisableRedirects: extras.DisableRedirects,
+		Notifier:         c,
+		Proxy:            options.proxy,
+		NoProxyEnv:       options.noProxyEnv,
+		Secrets:          c.secrets,
+		OAuth2Client:     options.oauth2Client,
+		OAuth2:           c.oauth2,
+		Assertion:        options.assertion,
+	}
+
+	if check, checkExists := c.checks.Load(checkHash); checkExists {
+		esmCheck, esmCheckExists := c.checksHTTPESM.Load(checkHash)
+		if esmCheckExists &&
+			esmCheck.HTTP == httpCheck.HTTP &&
+			headersAlmostEqual(esmCheck.Header, httpCheck.Header) &&
+			esmCheck.Method == httpCheck.Method &&
+			esmCheck.Body == httpCheck.Body &&
+			tlsConfigsEqual(esmCheck.TLSClientConfig, httpCheck.TLSClientConfig) &&
+			esmCheck.OutputMaxSize == httpCheck.OutputMaxSize &&
+			esmCheck.DisableRedirects == httpCheck.DisableRedirects &&
+			esmCheck.Interval == httpCheck.Interval &&
+			esmCheck.Timeout == httpCheck.Timeout &&
+			esmCheck.Assertion == httpCheck.Assertion &&
+			proxiesEqual(esmCheck.Proxy, httpCheck.Proxy) &&
+			esmCheck.NoProxyEnv == httpCheck.NoProxyEnv &&
+			esmCheck.OAuth2Client == httpCheck.OAuth2Client &&
+			check.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
+			return false
+		}
+
+		c.logger.Info("Updating ESM HTTP check", "checkHash", checkHash)
+
+		if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency: updated ESM HTTP check was not running", "checkHash", checkHash)
+			return false
+		}
+
+		updated[checkHash] = true
+	} else {
+		c.logger.Debug("Added ESM HTTP check", "checkHash", checkHash)
+		added[checkHash] = true
+	}
+
+	httpCheck.Start()
+	c.checksHTTPESM.Store(checkHash, httpCheck)
+
+	return true
+}
+
 func (c *CheckRunner) updateCheckTCP(
 	latestCheck *api.HealthCheck, checkHash types.CheckID,
-	definition *api.HealthCheckDefinition, updated, added checkIDSet,
+	definition *api.HealthCheckDefinition, extras checkExtras, updated, added checkIDSet,
 ) bool {
 	tcp := &consulchecks.CheckTCP{
-		CheckID:  structs.CheckID{ID: checkHash},
-		TCP:      definition.TCP,
-		Interval: definition.IntervalDuration,
-		Timeout:  definition.TimeoutDuration,
-		Logger:   c.logger,
-		StatusHandler: consulchecks.NewStatusHandler(c, c.logger,
-			c.PassingThreshold, c.CriticalThreshold, c.CriticalThreshold),
+		CheckID:       structs.CheckID{ID: checkHash},
+		TCP:           definition.TCP,
+		Interval:      definition.IntervalDuration,
+		Timeout:       definition.TimeoutDuration,
+		Logger:        c.logger,
+		StatusHandler: c.statusHandler(),
+	}
+	if definition.TCPUseTLS {
+		tcp.TLSClientConfig = c.checkTLSConfig(definition, extras)
 	}
 
 	if check, checkExists := c.checks.Load(checkHash); checkExists {
 		tcpCheck, tcpCheckExists := c.checksTCP.Load(checkHash)
 		if tcpCheckExists &&
 			tcpCheck.TCP == tcp.TCP &&
+			tlsConfigsEqual(tcpCheck.TLSClientConfig, tcp.TLSClientConfig) &&
 			tcpCheck.Interval == tcp.Interval &&
 			tcpCheck.Timeout == tcp.Timeout &&
 			check.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
@@ -251,14 +522,9 @@ func (c *CheckRunner) updateCheckTCP(
 
 		if tcpCheckExists {
 			tcpCheck.Stop()
-		} else {
-			httpCheck, httpCheckExists := c.checksHTTP.Load(checkHash)
-			if !httpCheckExists {
-				c.logger.Warn("Inconsistency check is not TCP and HTTP", "checkHash", checkHash)
-				return false
-			}
-			httpCheck.Stop()
-			c.checksHTTP.Delete(checkHash)
+		} else if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency check is not TCP and HTTP", "checkHash", checkHash)
+			return false
 		}
 
 		updated[checkHash] = true
@@ -274,9 +540,81 @@ func (c *CheckRunner) updateCheckTCP(
 	return true
 }
 
+// updateCheck starts or updates the check matching the definition, and
+// returns whether it changed and false if the check can't be run.
+func (c *CheckRunner) updateCheck(
+	check *api.HealthCheck, checkHash types.CheckID,
+	definition *api.HealthCheckDefinition, extras checkExtras, updated, added checkIDSet,
+) (bool, bool) {
+	if isSyntheticCheck(check.CheckID) {
+		synthetic, ok := c.synthetics.get(strings.TrimPrefix(check.CheckID, syntheticCheckPrefix))
+		if !ok {
+			c.logger.Warn("synthetic check is not defined", "checkHash", checkHash)
+			return false, false
+		}
+		return c.updateCheckSynthetic(check, checkHash, definition, extras, synthetic, updated, added), true
+	} else if directive, ok := checkDirective(check, certExpiryDirective); ok &&
+		(definition.HTTP != "" || definition.TCP != "") {
+		return c.updateCheckCertExpiry(check, checkHash, definition, extras, directive, updated, added), true
+	} else if options, ok := c.esmHTTPOptions(check, definition); ok {
+		return c.updateCheckHTTPESM(check, checkHash, definition, extras, options, updated, added), true
+	} else if definition.HTTP != "" {
+		return c.updateCheckHTTP(check, checkHash, definition, extras, updated, added), true
+	} else if options, ok, err := parseTCPExpect(check); ok && definition.TCP != "" {
+		return c.updateCheckTCPExpect(check, checkHash, definition, extras, options, err, updated, added), true
+	} else if definition.TCP != "" {
+		return c.updateCheckTCP(check, checkHash, definition, extras, updated, added), true
+	} else if directive, ok := checkDirective(check, dnsDirective); ok {
+		return c.updateCheckDNS(check, checkHash, definition, directive, updated, added), true
+	} else if directive, ok := checkDirective(check, aliasDirective); ok {
+		return c.updateCheckAlias(check, checkHash, definition, directive, updated, added), true
+	}
+	c.logger.Warn("check is not a valid HTTP, TCP, DNS or alias check", "checkHash", checkHash)
+	return false, false
+}
+
+// pauseInMaintenance stops the check if its node or service is in
+// maintenance, and returns true while it is. Once the maintenance is over, a
+// paused check is removed from the running checks so it's started again like
+// a new one. The reap timer of the check is frozen in the meantime.
+func (c *CheckRunner) pauseInMaintenance(checkHash types.CheckID, check *api.HealthCheck, previous *esmHealthCheck) bool {
+	now := time.Now()
+	if _, ok := c.maintenance.Reason(check.Node, check.ServiceID, now); ok {
+		if c.stopCheck(checkHash) {
+			c.logger.Info("Pausing check during maintenance", "checkHash", checkHash)
+		}
+		c.freezeReapTimer(checkHash, now)
+		return true
+	}
+
+	if previous != nil && previous.paused {
+		c.logger.Info("Resuming check after maintenance", "checkHash", checkHash)
+		c.checks.Delete(checkHash)
+		c.freezeReapTimer(checkHash, now)
+		c.maintenance.Thaw(string(checkHash))
+	}
+	return false
+}
+
+// freezeReapTimer pushes the critical start time of a check in maintenance
+// forward by the time spent in maintenance since the last call, so the
+// maintenance doesn't count towards DeregisterCriticalServiceAfter.
+func (c *CheckRunner) freezeReapTimer(checkHash types.CheckID, now time.Time) {
+	frozen := c.maintenance.Freeze(string(checkHash), now)
+	if criticalTime, ok := c.checksCritical.Load(checkHash); ok && frozen > 0 {
+		c.checksCritical.Store(checkHash, criticalTime.Add(frozen))
+	}
+}
+
 // UpdateChecks takes a list of checks from the catalog and updates
 // our list of running checks to match.
 func (c *CheckRunner) UpdateChecks(checks api.HealthChecks) {
+	c.updateChecks(checks, nil)
+}
+
+// updateChecks is UpdateChecks with the definition fields api.HealthChecks
+// doesn't hold, keyed by check hash.
+func (c *CheckRunner) updateChecks(checks api.HealthChecks, extras map[types.CheckID]checkExtras) {
 	defer metrics.MeasureSince([]string{"checks", "update"}, time.Now())
 
 	found := make(checkIDSet)
@@ -285,8 +623,9 @@ func (c *CheckRunner) UpdateChecks(checks api.HealthChecks) {
 	removed := make(checkIDSet)
 
 	for _, check := range checks {
-		// Skip the ping-based node check since we're managing that separately
-		if check.CheckID == externalCheckName {
+		// Skip the ping-based node check and the maintenance checks since
+		// we're managing those separately
+		if check.CheckID == externalCheckName || isMaintenanceCheck(check.CheckID) {
 			continue
 		}
 
@@ -303,15 +642,18 @@ func (c *CheckRunner) UpdateChecks(checks api.HealthChecks) {
 			definition.IntervalDuration = c.MinimumInterval
 		}
 
-		anyUpdates := false
+		// Checks of nodes and services in maintenance are paused until it's
+		// over. Setting and clearing the maintenance checks updates the
+		// catalog, so the checks are updated when it starts and ends.
+		previousCheck, _ := c.checks.Load(checkHash)
+		paused := c.pauseInMaintenance(checkHash, check, previousCheck)
 
-		if definition.HTTP != "" {
-			anyUpdates = c.updateCheckHTTP(check, checkHash, &definition, updated, added)
-		} else if definition.TCP != "" {
-			anyUpdates = c.updateCheckTCP(check, checkHash, &definition, updated, added)
-		} else {
-			c.logger.Warn("check is not a valid HTTP or TCP check", "checkHash", checkHash)
-			continue
+		anyUpdates := false
+		if !paused {
+			var ok bool
+			if anyUpdates, ok = c.updateCheck(check, checkHash, &definition, extras[checkHash], updated, added); !ok {
+				continue
+			}
 		}
 
 		// if we had to fix the interval and we had to update the service, put some trace out
@@ -322,14 +664,25 @@ func (c *CheckRunner) UpdateChecks(checks api.HealthChecks) {
 
 		found[checkHash] = true
 		updatedCheck := &esmHealthCheck{
-			*check,
-			0,
-			0,
+			HealthCheck: *check,
+			paused:      paused,
+		}
+		var previousWindow *resultWindow
+		var previousFlap *flapDetector
+		if latest, ok := c.checks.LoadAndDelete(checkHash); ok {
+			previousCheck = latest
 		}
-		if previousCheck, ok := c.checks.LoadAndDelete(checkHash); ok {
+		if previousCheck != nil {
 			updatedCheck.failureCounter = previousCheck.failureCounter
+			updatedCheck.warningCounter = previousCheck.warningCounter
 			updatedCheck.successCounter = previousCheck.successCounter
+			updatedCheck.warningSince = previousCheck.warningSince
+			updatedCheck.reevaluate = previousCheck.reevaluate
+			previousWindow = previousCheck.window
+			previousFlap = previousCheck.flap
 		}
+		updatedCheck.window = resultWindowFor(findEvaluationWindow(c.EvaluationWindows, check), previousWindow)
+		updatedCheck.flap = c.flapDetectorFor(previousFlap)
 		c.checks.Store(checkHash, updatedCheck)
 	}
 
@@ -342,14 +695,7 @@ func (c *CheckRunner) UpdateChecks(checks api.HealthChecks) {
 			c.checks.Delete(checkHash)
 			c.checksCritical.Delete(checkHash)
 
-			if httpCheck, httpCheckExists := c.checksHTTP.Load(checkHash); httpCheckExists {
-				httpCheck.Stop()
-				c.checksHTTP.Delete(checkHash)
-			}
-			if tcpCheck, tcpCheckExists := c.checksTCP.Load(checkHash); tcpCheckExists {
-				tcpCheck.Stop()
-				c.checksTCP.Delete(checkHash)
-			}
+			c.stopCheck(checkHash)
 
 			removed[checkHash] = true
 		}
@@ -363,9 +709,9 @@ func (c *CheckRunner) UpdateChecks(checks api.HealthChecks) {
 }
 
 // ServiceExists is part of the consulchecks.CheckNotifier interface.
-// It is currently used as part of Consul's alias service feature.
-// This function is used to check for localality of service.
-// Unsuppported at this time, so hardcoded false return.
+// It is used by Consul's alias checks to look up services local to the agent.
+// No service is local to ESM, whose alias checks look up the aliased service
+// in the catalog instead, so it always returns false.
 func (c *CheckRunner) ServiceExists(serviceID structs.ServiceID) bool {
 	return false
 }
@@ -380,25 +726,108 @@ func (c *CheckRunner) UpdateCheck(checkID structs.CheckID, status, output string
 	}
 	defer func() { c.checks.Store(checkHash, check) }()
 
-	// Do nothing if update is idempotent
-	if check.Status == status && check.Output == output {
-		if status == api.HealthCritical {
-			if _, ok := c.checksCritical.Load(checkHash); !ok {
-				c.checksCritical.Store(checkHash, time.Now())
+	// Ignore the results of checks in maintenance, which can still come in
+	// until the check is paused.
+	if _, ok := c.maintenance.Reason(check.Node, check.ServiceID, time.Now()); ok {
+		return
+	}
+
+	// Ignore the results of checks on a critical node, they are re-evaluated
+	// once it recovers.
+	if c.nodeHealth.Critical(check.Node) {
+		return
+	}
+
+	c.breaker.Record(status == api.HealthCritical)
+	if status == api.HealthCritical && c.breaker.Tripped() {
+		c.logger.Debug("circuit breaker tripped, skipping critical check update", "checkHash", checkHash)
+		return
+	}
+
+	// Write the first result after the node recovered right away.
+	if check.reevaluate {
+		check.reevaluate = false
+		check.failureCounter = 0
+		check.warningCounter = 0
+		check.successCounter = 0
+		check.window.Reset()
+		check.window.Add(status)
+		check.flap.Reset()
+		c.trackStatus(checkHash, check, status)
+		c.handleCheckUpdate(&check.HealthCheck, status, output)
+		return
+	}
+
+	check.window.Add(status)
+
+	// Hold the status of flapping checks, and write the latest result right
+	// away once they settle.
+	if flapping, changed := check.flap.Record(status); flapping {
+		if changed {
+			c.logger.Warn("Check is flapping, holding its status", "checkHash", checkHash,
+				"status", check.Status, "percent", check.flap.Percent())
+			// Pending output syncs would overwrite the flapping output.
+			if timer, ok := c.deferCheck.LoadAndDelete(checkHash); ok {
+				timer.Stop()
 			}
+			c.handleCheckUpdate(&check.HealthCheck, check.Status,
+				flappingOutput(check.flap.Percent(), c.FlapHistory, status, output))
+		}
+		return
+	} else if changed {
+		c.logger.Info("Check stopped flapping", "checkHash", checkHash, "status", status)
+		check.failureCounter = 0
+		check.warningCounter = 0
+		check.successCounter = 0
+		c.trackStatus(checkHash, check, status)
+		c.handleCheckUpdate(&check.HealthCheck, status, output)
+		return
+	}
+
+	// Escalate checks that have been warning for too long to critical, without
+	// waiting for the critical threshold.
+	escalated := false
+	if status == api.HealthWarning && c.WarningEscalationTimeout > 0 &&
+		!check.warningSince.IsZero() && time.Since(check.warningSince) >= c.WarningEscalationTimeout {
+		// Like critical results, escalations wait for the circuit breaker
+		// to reset.
+		if c.breaker.Tripped() {
+			c.logger.Debug("circuit breaker tripped, skipping warning escalation", "checkHash", checkHash)
+			return
 		}
+		status = api.HealthCritical
+		output = escalatedOutput(c.WarningEscalationTimeout, output)
+		escalated = true
+	}
+
+	// Do nothing if update is idempotent
+	if check.Status == status && check.Output == output {
+		c.trackStatus(checkHash, check, status)
 		check.failureCounter = decrementCounter(check.failureCounter)
+		check.warningCounter = decrementCounter(check.warningCounter)
 		check.successCounter = decrementCounter(check.successCounter)
 		return
 	}
 
-	if status == api.HealthCritical {
+	switch {
+	case escalated:
+	case check.window != nil && status != api.HealthWarning:
+		if !check.window.Reached(status) {
+			return
+		}
+	case status == api.HealthCritical:
 		if check.failureCounter < c.CriticalThreshold {
 			check.failureCounter++
 			return
 		}
 		check.failureCounter = 0
-	} else {
+	case status == api.HealthWarning:
+		if check.warningCounter < c.WarningThreshold {
+			check.warningCounter++
+			return
+		}
+		check.warningCounter = 0
+	default:
 		if check.successCounter < c.PassingThreshold {
 			check.successCounter++
 			return
@@ -406,14 +835,7 @@ func (c *CheckRunner) UpdateCheck(checkID structs.CheckID, status, output string
 		check.successCounter = 0
 	}
 
-	// Update the critical time tracking
-	if status == api.HealthCritical {
-		if _, ok := c.checksCritical.Load(checkHash); !ok {
-			c.checksCritical.Store(checkHash, time.Now())
-		}
-	} else {
-		c.checksCritical.Delete(checkHash)
-	}
+	c.trackStatus(checkHash, check, status)
 
 	// Defer a sync if the output has changed. This is an optimization around
 	// frequent updates of output. Instead, we update the output internally,
@@ -435,6 +857,32 @@ func (c *CheckRunner) UpdateCheck(checkID structs.CheckID, status, output string
 	c.handleCheckUpdate(&check.HealthCheck, status, output)
 }
 
+// trackStatus updates the critical time tracking, used for reaping, and the
+// warning time tracking, used for escalation, of a check with the given status.
+func (c *CheckRunner) trackStatus(checkHash types.CheckID, check *esmHealthCheck, status string) {
+	if status == api.HealthCritical {
+		if _, ok := c.checksCritical.Load(checkHash); !ok {
+			c.checksCritical.Store(checkHash, time.Now())
+		}
+	} else {
+		c.checksCritical.Delete(checkHash)
+	}
+
+	// The warning time is kept until the check passes, so escalated checks
+	// stay critical while they keep warning.
+	switch {
+	case status == api.HealthWarning && check.warningSince.IsZero():
+		check.warningSince = time.Now()
+	case status == api.HealthPassing:
+		check.warningSince = time.Time{}
+	}
+}
+
+// escalatedOutput is the output of a check escalated from warning to critical.
+func escalatedOutput(timeout time.Duration, output string) string {
+	return fmt.Sprintf("Check has been warning for more than %s, escalated to critical: %s", timeout, output)
+}
+
 // handleCheckUpdate writes a check's status to the catalog and updates the local check state.
 // Should only be called when the lock is held.
 func (c *CheckRunner) handleCheckUpdate(check *api.HealthCheck, status, output string) {
@@ -515,6 +963,11 @@ func (c *CheckRunner) reapServices(shutdownCh <-chan struct{}) {
 
 // reapServicesInternal does a single pass, looking for services to reap.
 func (c *CheckRunner) reapServicesInternal() {
+	if c.breaker.Tripped() {
+		c.logger.Warn("circuit breaker tripped, skipping service reaping")
+		return
+	}
+
 	type uniqueID struct {
 		node, service string
 	}
@@ -534,6 +987,12 @@ func (c *CheckRunner) reapServicesInternal() {
 		if ID.service == "" {
 			return true
 		}
+		// Services in maintenance are never reaped, and the reap timers of
+		// their checks are frozen.
+		if _, ok := c.maintenance.Reason(ID.node, ID.service, time.Now()); ok {
+			c.freezeReapTimer(checkID, time.Now())
+			return true
+		}
 		// There might be multiple checks for one service, so
 		// we don't need to reap multiple times.
 		if reaped[ID] {
@@ -542,21 +1001,54 @@ func (c *CheckRunner) reapServicesInternal() {
 
 		timeout := check.Definition.DeregisterCriticalServiceAfterDuration
 		if timeout > 0 && timeout < time.Since(criticalTime) {
-			c.client.Catalog().Deregister(&api.CatalogDeregistration{
+			reaped[ID] = true
+			if !c.allowServiceReap(ID.node, ID.service) {
+				return true
+			}
+			_, err := c.client.Catalog().Deregister(&api.CatalogDeregistration{
 				Node:      ID.node,
 				ServiceID: ID.service,
 			}, nil)
+			if err != nil {
+				c.logger.Warn("error deregistering service", "nodeID", ID.node,
+					"serviceID", ID.service, "error", err)
+				return true
+			}
+			c.reaper.Reaped(reapKindService)
 			c.logger.Info("agent has been critical for too long, deregistered service", "checkID", checkID,
 				"nodeID", ID.node,
 				"serviceID", ID.service,
 				"duration", time.Since(criticalTime),
 				"timeout", timeout)
-			reaped[ID] = true
 		}
 		return true
 	})
 }
 
+// allowServiceReap looks up the service's node and service meta and asks the
+// reap guard whether the service may be deregistered.
+func (c *CheckRunner) allowServiceReap(node, serviceID string) bool {
+	if c.reaper == nil {
+		return true
+	}
+
+	catalogNode, _, err := c.client.Catalog().Node(node, nil)
+	if err != nil {
+		c.logger.Warn("error retrieving node entry, not reaping service", "nodeID", node,
+			"serviceID", serviceID, "error", err)
+		return false
+	}
+	if catalogNode == nil || catalogNode.Node == nil {
+		return false
+	}
+
+	var serviceMeta map[string]string
+	if service, ok := catalogNode.Services[serviceID]; ok {
+		serviceMeta = service.Meta
+	}
+	return c.reaper.Allow(reapKindService, serviceID, catalogNode.Node.Meta, serviceMeta)
+}
+
 func hashCheck(check *api.HealthCheck) types.CheckID {
 	if check.ServiceID != "" {
 		return types.CheckID(fmt.Sprintf("%s/%s/%s", check.Node, check.ServiceID, check.CheckID))
@@ -5,6 +5,9 @@ package main
 
 import (
 	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,6 +16,7 @@ import (
 	"github.com/hashicorp/consul/agent/structs"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/consul/types"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -123,6 +127,70 @@ func TestCheck_HTTP(t *testing.T) {
 	})
 }
 
+func TestCheck_HTTPWarning(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoint fails once, then rate limits the check.
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	// Warnings after a failure are only held back by the warning threshold,
+	// not by the passing threshold of Consul's StatusHandler as well.
+	runner := NewCheckRunner(hclog.NewNullLogger(), client, 0, 0, &tls.Config{}, 1000, 0)
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Status:  api.HealthPassing,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             server.URL,
+				IntervalDuration: 50 * time.Millisecond,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.UpdateChecks(checks)
+
+	retry.Run(t, func(r *retry.R) {
+		checks, _, err = client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+		if len(checks) != 1 || checks[0].Status != api.HealthWarning {
+			r.Fatalf("expected: %v, got: %v", api.HealthWarning, checks[0].Status)
+		}
+	})
+}
+
 func TestCheck_TCP(t *testing.T) {
 	t.Parallel()
 	s, err := NewTestServer(t)
@@ -427,6 +495,207 @@ func TestCheck_NoFlapping(t *testing.T) {
 	assert.Equal(t, api.HealthCritical, currentCheck.Status)
 }
 
+func TestCheck_Warning(t *testing.T) {
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	runner.WarningThreshold = 1
+	runner.WarningEscalationTimeout = 100 * time.Millisecond
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Status:  api.HealthPassing,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://service.local/health",
+				IntervalDuration: time.Hour,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.UpdateChecks(checks)
+
+	hash := hashCheck(checks[0])
+	id := structs.CheckID{ID: hash}
+	check, ok := runner.checks.Load(hash)
+	if !ok {
+		t.Fatalf("Check was not stored on runner.checks as expected. Checks: %v", &runner.checks)
+	}
+
+	// Warnings have their own counter and threshold.
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	assert.Equal(t, 1, check.warningCounter)
+	assert.Equal(t, 0, check.failureCounter)
+	assert.Equal(t, api.HealthPassing, check.Status)
+
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	assert.Equal(t, 0, check.warningCounter)
+	assert.Equal(t, api.HealthWarning, check.Status)
+	_, critical := runner.checksCritical.Load(hash)
+	assert.False(t, critical)
+
+	// A check warning for too long is escalated to critical, and stays
+	// critical while it keeps warning.
+	time.Sleep(runner.WarningEscalationTimeout)
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	assert.Equal(t, api.HealthCritical, check.Status)
+	assert.Equal(t, escalatedOutput(runner.WarningEscalationTimeout, "slow down"), check.Output)
+	_, critical = runner.checksCritical.Load(hash)
+	assert.True(t, critical)
+
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	assert.Equal(t, api.HealthCritical, check.Status)
+
+	// Passing clears the escalation.
+	runner.UpdateCheck(id, api.HealthPassing, "ok")
+	assert.Equal(t, api.HealthPassing, check.Status)
+	assert.True(t, check.warningSince.IsZero())
+	_, critical = runner.checksCritical.Load(hash)
+	assert.False(t, critical)
+
+	// Escalations wait for a tripped circuit breaker to reset.
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	assert.Equal(t, api.HealthWarning, check.Status)
+	runner.breaker = testBreaker(t, 0.5, time.Minute, 1)
+	for i := 0; i < 10; i++ {
+		runner.breaker.Record(true)
+	}
+	time.Sleep(runner.WarningEscalationTimeout)
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	assert.Equal(t, api.HealthWarning, check.Status)
+	_, critical = runner.checksCritical.Load(hash)
+	assert.False(t, critical)
+
+	for i := 0; i < 10; i++ {
+		runner.breaker.Record(false)
+	}
+	runner.UpdateCheck(id, api.HealthWarning, "slow down")
+	assert.Equal(t, api.HealthCritical, check.Status)
+	_, critical = runner.checksCritical.Load(hash)
+	assert.True(t, critical)
+}
+
+func TestCheck_DefinitionFields(t *testing.T) {
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	defer runner.Stop()
+
+	checks := api.HealthChecks{
+		{
+			Node:    "external",
+			CheckID: "ext-http",
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://service.local/health",
+				Method:           "POST",
+				Body:             `{"ping":true}`,
+				IntervalDuration: time.Hour,
+			},
+		},
+		{
+			Node:    "external",
+			CheckID: "ext-tcp",
+			Definition: api.HealthCheckDefinition{
+				TCP:              "service.local:443",
+				TCPUseTLS:        true,
+				TLSServerName:    "service.local",
+				IntervalDuration: time.Hour,
+			},
+		},
+	}
+	httpHash, tcpHash := hashCheck(checks[0]), hashCheck(checks[1])
+	extras := map[types.CheckID]checkExtras{
+		httpHash: {DisableRedirects: true, OutputMaxSize: 128},
+	}
+	runner.updateChecks(checks, extras)
+
+	httpCheck, ok := runner.checksHTTP.Load(httpHash)
+	if !ok {
+		t.Fatal("HTTP check was not started")
+	}
+	assert.Equal(t, `{"ping":true}`, httpCheck.Body)
+	assert.True(t, httpCheck.DisableRedirects)
+	assert.Equal(t, 128, httpCheck.OutputMaxSize)
+
+	tcpCheck, ok := runner.checksTCP.Load(tcpHash)
+	if !ok {
+		t.Fatal("TCP check was not started")
+	}
+	if assert.NotNil(t, tcpCheck.TLSClientConfig) {
+		assert.Equal(t, "service.local", tcpCheck.TLSClientConfig.ServerName)
+	}
+
+	// Unchanged definitions don't restart the checks, including the default
+	// output size set by Consul when starting the check.
+	runner.updateChecks(checks, extras)
+	current, _ := runner.checksHTTP.Load(httpHash)
+	assert.Same(t, httpCheck, current)
+	runner.UpdateChecks(checks)
+	current, _ = runner.checksHTTP.Load(httpHash)
+	assert.NotSame(t, httpCheck, current)
+	httpCheck = current
+	runner.UpdateChecks(checks)
+	current, _ = runner.checksHTTP.Load(httpHash)
+	assert.Same(t, httpCheck, current)
+
+	// Changes to the new fields restart the checks.
+	checks[0].Definition.Body = `{"ping":false}`
+	checks[1].Definition.TCPUseTLS = false
+	runner.UpdateChecks(checks)
+	current, _ = runner.checksHTTP.Load(httpHash)
+	assert.NotSame(t, httpCheck, current)
+	assert.Equal(t, `{"ping":false}`, current.Body)
+	currentTCP, _ := runner.checksTCP.Load(tcpHash)
+	assert.NotSame(t, tcpCheck, currentTCP)
+	assert.Nil(t, currentTCP.TLSClientConfig)
+}
+
 func TestHeadersAlmostEqual(t *testing.T) {
 	type headers map[string][]string
 	type testCase struct {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"time"
@@ -51,6 +52,11 @@ type Config struct {
 	CoordinateUpdateInterval  time.Duration
 	NodeHealthRefreshInterval time.Duration
 	NodeReconnectTimeout      time.Duration
+	NodeProbeObservers        int
+	NodeProbeQuorum           int
+	NodeProbeRetryInterval    time.Duration
+	NodeProbeMaxInterval      time.Duration
+	NodeProbeRateLimit        float64
 
 	HTTPAddr      string
 	Token         string
@@ -66,16 +72,62 @@ type Config struct {
 	HTTPSCertFile string
 	HTTPSKeyFile  string
 
+	TLSClientRules []TLSClientRule
+
+	TLSReloadInterval time.Duration
+
+	Proxy      string
+	NoProxy    []string
+	ProxyRules []ProxyRule
+
+	SecretKVPath          string
+	SecretDirs            []string
+	SecretEnvPrefix       string
+	SecretRefreshInterval time.Duration
+
+	OAuth2Clients []OAuth2Client
+
+	SyntheticChecks []SyntheticCheck
+
+	CertExpiryWarningDays  int
+	CertExpiryCriticalDays int
+
+	DNSResolvers []string
+
 	ClientAddress string
 
 	PingType string
 
-	DisableCoordinateUpdates bool
+	DisableCoordinateUpdates  bool
+	CoordinateSource          string
+	CoordinateAnchorNode      string
+	CoordinateUpdateRateLimit float64
 
 	Telemetry lib.TelemetryConfig
 
-	PassingThreshold  int
-	CriticalThreshold int
+	PassingThreshold         int
+	CriticalThreshold        int
+	WarningThreshold         int
+	WarningEscalationTimeout time.Duration
+
+	// warningThresholdSet is whether WarningThreshold was configured. If not,
+	// it defaults to PassingThreshold.
+	warningThresholdSet bool
+
+	EvaluationWindows []EvaluationWindow
+
+	FlapHistory       int
+	FlapHighThreshold float64
+	FlapLowThreshold  float64
+
+	CircuitBreakerThreshold  float64
+	CircuitBreakerWindow     time.Duration
+	CircuitBreakerMinSamples int
+
+	ReapDryRun      bool
+	ReapLimit       int
+	ReapLimitWindow time.Duration
+	NodeReapPolicy  string
 }
 
 func (c *Config) ClientConfig() *api.Config {
@@ -136,6 +188,8 @@ func DefaultConfig() (*Config, error) {
 		CoordinateUpdateInterval:  10 * time.Second,
 		NodeHealthRefreshInterval: 1 * time.Hour,
 		NodeReconnectTimeout:      72 * time.Hour,
+		NodeProbeObservers:        1,
+		NodeProbeQuorum:           1,
 		PingType:                  PingTypeUDP,
 		DisableCoordinateUpdates:  false,
 		Partition:                 "",
@@ -143,6 +197,16 @@ func DefaultConfig() (*Config, error) {
 		LogRotateBytes:            0,
 		LogRotateMaxFiles:         0,
 		LogRotateDuration:         0,
+		CircuitBreakerWindow:      1 * time.Minute,
+		CircuitBreakerMinSamples:  10,
+		ReapLimitWindow:           1 * time.Hour,
+		NodeReapPolicy:            ReapPolicyDelete,
+		FlapHighThreshold:         20,
+		FlapLowThreshold:          5,
+		TLSReloadInterval:         30 * time.Second,
+		SecretRefreshInterval:     5 * time.Minute,
+		CertExpiryWarningDays:     30,
+		CertExpiryCriticalDays:    7,
 
 		EnableAgentless: false,
 	}, nil
@@ -196,6 +260,12 @@ type HumanConfig struct {
 
 	NodeReconnectTimeout flags.DurationValue `mapstructure:"node_reconnect_timeout"`
 	NodeProbeInterval    flags.DurationValue `mapstructure:"node_probe_interval"`
+	NodeProbeObservers   intValue            `mapstructure:"node_probe_observers"`
+	NodeProbeQuorum      intValue            `mapstructure:"node_probe_quorum"`
+
+	NodeProbeRetryInterval flags.DurationValue `mapstructure:"node_probe_retry_interval"`
+	NodeProbeMaxInterval   flags.DurationValue `mapstructure:"node_probe_max_interval"`
+	NodeProbeRateLimit     floatValue          `mapstructure:"node_probe_rate_limit"`
 
 	HTTPAddr      flags.StringValue `mapstructure:"http_addr"`
 	Token         flags.StringValue `mapstructure:"token"`
@@ -211,16 +281,59 @@ type HumanConfig struct {
 	HTTPSCertFile flags.StringValue `mapstructure:"https_cert_file"`
 	HTTPSKeyFile  flags.StringValue `mapstructure:"https_key_file"`
 
+	TLSClientRules []TLSClientRule `mapstructure:"tls_client_rule"`
+
+	TLSReloadInterval flags.DurationValue `mapstructure:"tls_reload_interval"`
+
+	Proxy      flags.StringValue `mapstructure:"proxy"`
+	NoProxy    []string          `mapstructure:"no_proxy"`
+	ProxyRules []ProxyRule       `mapstructure:"proxy_rule"`
+
+	SecretKVPath          flags.StringValue   `mapstructure:"secret_kv_path"`
+	SecretDirs            []string            `mapstructure:"secret_dirs"`
+	SecretEnvPrefix       flags.StringValue   `mapstructure:"secret_env_prefix"`
+	SecretRefreshInterval flags.DurationValue `mapstructure:"secret_refresh_interval"`
+
+	OAuth2Clients []OAuth2Client `mapstructure:"oauth2_client"`
+
+	SyntheticChecks []SyntheticCheck `mapstructure:"synthetic_check"`
+
+	CertExpiryWarningDays  intValue `mapstructure:"cert_expiry_warning_days"`
+	CertExpiryCriticalDays intValue `mapstructure:"cert_expiry_critical_days"`
+
+	DNSResolvers []string `mapstructure:"dns_resolvers"`
+
 	ClientAddress flags.StringValue `mapstructure:"client_address"`
 
 	PingType flags.StringValue `mapstructure:"ping_type"`
 
-	DisableCoordinateUpdates flags.BoolValue `mapstructure:"disable_coordinate_updates"`
+	DisableCoordinateUpdates flags.BoolValue   `mapstructure:"disable_coordinate_updates"`
+	CoordinateSource         flags.StringValue `mapstructure:"coordinate_source"`
+	CoordinateAnchorNode     flags.StringValue `mapstructure:"coordinate_anchor_node"`
+
+	CoordinateUpdateRateLimit floatValue `mapstructure:"coordinate_update_rate_limit"`
 
 	Telemetry []Telemetry `mapstructure:"telemetry"`
 
-	PassingThreshold  intValue `mapstructure:"passing_threshold"`
-	CriticalThreshold intValue `mapstructure:"critical_threshold"`
+	PassingThreshold         intValue            `mapstructure:"passing_threshold"`
+	CriticalThreshold        intValue            `mapstructure:"critical_threshold"`
+	WarningThreshold         intValue            `mapstructure:"warning_threshold"`
+	WarningEscalationTimeout flags.DurationValue `mapstructure:"warning_escalation_timeout"`
+
+	EvaluationWindows []EvaluationWindow `mapstructure:"evaluation_window"`
+
+	FlapHistory       intValue   `mapstructure:"flap_history"`
+	FlapHighThreshold floatValue `mapstructure:"flap_high_threshold"`
+	FlapLowThreshold  floatValue `mapstructure:"flap_low_threshold"`
+
+	CircuitBreakerThreshold  floatValue          `mapstructure:"circuit_breaker_threshold"`
+	CircuitBreakerWindow     flags.DurationValue `mapstructure:"circuit_breaker_window"`
+	CircuitBreakerMinSamples intValue            `mapstructure:"circuit_breaker_min_samples"`
+
+	ReapDryRun      flags.BoolValue     `mapstructure:"reap_dry_run"`
+	ReapLimit       intValue            `mapstructure:"reap_limit"`
+	ReapLimitWindow flags.DurationValue `mapstructure:"reap_limit_window"`
+	NodeReapPolicy  flags.StringValue   `mapstructure:"node_reap_policy"`
 }
 
 // intValue provides a flag value that's aware if it has been set.
@@ -255,13 +368,88 @@ func intTointValueFunc() mapstructure.DecodeHookFunc {
 	}
 }
 
+// floatValue provides a flag value that's aware if it has been set.
+type floatValue struct {
+	v *float64
+}
+
+// Merge will overlay this value if it has been set.
+func (f *floatValue) Merge(onto *float64) {
+	if f.v != nil {
+		*onto = *(f.v)
+	}
+}
+
+func floatToFloatValueFunc() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		val := floatValue{}
+		if t != reflect.TypeOf(val) {
+			return data, nil
+		}
+
+		val.v = new(float64)
+		switch f.Kind() {
+		case reflect.Float64:
+			*(val.v) = data.(float64)
+		case reflect.Int:
+			*(val.v) = float64(data.(int))
+		default:
+			return data, nil
+		}
+		return val, nil
+	}
+}
+
+// blockToMapFunc decodes the given fields of the target struct, blocks that
+// HCL parses as a list of maps, into their map field.
+func blockToMapFunc(target reflect.Type, fields ...string) mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if t != target {
+			return data, nil
+		}
+		raw, ok := data.(map[string]interface{})
+		if !ok {
+			return data, nil
+		}
+
+		decoded := make(map[string]interface{}, len(raw))
+		for k, v := range raw {
+			decoded[k] = v
+		}
+		for _, field := range fields {
+			blocks, ok := raw[field].([]map[string]interface{})
+			if !ok {
+				continue
+			}
+			merged := make(map[string]interface{})
+			for _, block := range blocks {
+				for k, v := range block {
+					merged[k] = v
+				}
+			}
+			decoded[field] = merged
+		}
+		return decoded, nil
+	}
+}
+
 // configDecodeHook should be passed to mapstructure in order to decode into
 // the *Value objects here.
 var configDecodeHook = mapstructure.ComposeDecodeHookFunc(
 	flags.BoolToBoolValueFunc(),
 	flags.StringToDurationValueFunc(),
 	flags.StringToStringValueFunc(),
+	mapstructure.StringToTimeDurationHookFunc(),
 	intTointValueFunc(),
+	floatToFloatValueFunc(),
+	blockToMapFunc(reflect.TypeOf(TLSClientRule{}), "service_meta"),
+	blockToMapFunc(reflect.TypeOf(SyntheticStep{}), "header", "extract"),
 )
 
 // DecodeConfig takes a reader containing config file and returns
@@ -329,6 +517,12 @@ func BuildConfig(configFiles []string) (*Config, error) {
 	if !strings.HasSuffix(config.KVPath, "/") {
 		config.KVPath = config.KVPath + "/"
 	}
+	if config.SecretKVPath != "" && !strings.HasSuffix(config.SecretKVPath, "/") {
+		config.SecretKVPath = config.SecretKVPath + "/"
+	}
+	if !config.warningThresholdSet {
+		config.WarningThreshold = config.PassingThreshold
+	}
 
 	if err := ValidateConfig(config); err != nil {
 		return nil, fmt.Errorf("Error parsing config: %v", err)
@@ -350,6 +544,45 @@ func ValidateConfig(conf *Config) error {
 		return fmt.Errorf("node_probe_interval cannot be lower than 1 second")
 	}
 
+	switch conf.CoordinateSource {
+	case "", CoordinateSourceServers:
+		break
+	case CoordinateSourceAgent:
+		if conf.EnableAgentless {
+			return fmt.Errorf("coordinate_source cannot be \"agent\" when enable_agentless is set")
+		}
+	case CoordinateSourceAnchor:
+		if conf.CoordinateAnchorNode == "" {
+			return fmt.Errorf("coordinate_anchor_node must be set when coordinate_source is \"anchor\"")
+		}
+	default:
+		return fmt.Errorf("coordinate_source must be one of either \"agent\", \"servers\" or \"anchor\"")
+	}
+
+	if conf.CoordinateUpdateRateLimit < 0 {
+		return fmt.Errorf("coordinate_update_rate_limit cannot be negative")
+	}
+
+	if conf.NodeProbeObservers < 1 {
+		return fmt.Errorf("node_probe_observers must be at least 1")
+	}
+
+	if conf.NodeProbeQuorum < 1 || conf.NodeProbeQuorum > conf.NodeProbeObservers {
+		return fmt.Errorf("node_probe_quorum must be between 1 and node_probe_observers")
+	}
+
+	if conf.NodeProbeRetryInterval < 0 {
+		return fmt.Errorf("node_probe_retry_interval cannot be negative")
+	}
+
+	if conf.NodeProbeMaxInterval != 0 && conf.NodeProbeMaxInterval < conf.CoordinateUpdateInterval {
+		return fmt.Errorf("node_probe_max_interval cannot be lower than node_probe_interval")
+	}
+
+	if conf.NodeProbeRateLimit < 0 {
+		return fmt.Errorf("node_probe_rate_limit cannot be negative")
+	}
+
 	if conf.PassingThreshold < 0 {
 		return fmt.Errorf("passing_threshold cannot be negative")
 	}
@@ -358,6 +591,141 @@ func ValidateConfig(conf *Config) error {
 		return fmt.Errorf("critical_threshold cannot be negative")
 	}
 
+	if conf.WarningThreshold < 0 {
+		return fmt.Errorf("warning_threshold cannot be negative")
+	}
+
+	if conf.WarningEscalationTimeout < 0 {
+		return fmt.Errorf("warning_escalation_timeout cannot be negative")
+	}
+
+	if conf.TLSReloadInterval < 0 {
+		return fmt.Errorf("tls_reload_interval cannot be negative")
+	}
+
+	if conf.Proxy != "" {
+		if _, err := parseProxyURL(conf.Proxy); err != nil {
+			return fmt.Errorf("proxy %s", err)
+		}
+	}
+
+	if err := validateNoProxy(conf.NoProxy); err != nil {
+		return err
+	}
+
+	for _, rule := range conf.ProxyRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range conf.SecretDirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("secret_dirs must be absolute paths: %q", dir)
+		}
+	}
+
+	if conf.SecretRefreshInterval < 0 {
+		return fmt.Errorf("secret_refresh_interval cannot be negative")
+	}
+
+	oauth2Clients := make(map[string]bool)
+	for _, client := range conf.OAuth2Clients {
+		if err := client.validate(); err != nil {
+			return err
+		}
+		if oauth2Clients[client.Name] {
+			return fmt.Errorf("oauth2_client %q is defined more than once", client.Name)
+		}
+		oauth2Clients[client.Name] = true
+	}
+
+	syntheticChecks := make(map[string]bool)
+	for _, check := range conf.SyntheticChecks {
+		if err := check.validate(); err != nil {
+			return err
+		}
+		if syntheticChecks[check.Name] {
+			return fmt.Errorf("synthetic_check %q is defined more than once", check.Name)
+		}
+		syntheticChecks[check.Name] = true
+	}
+
+	if conf.CertExpiryCriticalDays < 0 {
+		return fmt.Errorf("cert_expiry_critical_days cannot be negative")
+	}
+	if conf.CertExpiryWarningDays < conf.CertExpiryCriticalDays {
+		return fmt.Errorf("cert_expiry_warning_days must be at least cert_expiry_critical_days")
+	}
+
+	for _, resolver := range conf.DNSResolvers {
+		if _, err := dnsResolverAddress(resolver); err != nil {
+			return fmt.Errorf("dns_resolvers entry %q is not a valid address: %s", resolver, err)
+		}
+	}
+
+	for _, rule := range conf.TLSClientRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, window := range conf.EvaluationWindows {
+		if window.Size < 1 {
+			return fmt.Errorf("evaluation_window size must be at least 1")
+		}
+		if window.Failures < 1 || window.Failures > window.Size {
+			return fmt.Errorf("evaluation_window failures must be between 1 and size")
+		}
+		if window.Successes < 0 || window.Successes > window.Size {
+			return fmt.Errorf("evaluation_window successes must be between 0 and size")
+		}
+	}
+
+	if conf.FlapHistory < 0 {
+		return fmt.Errorf("flap_history cannot be negative")
+	}
+
+	if conf.FlapHistory > 0 {
+		if conf.FlapHistory < 3 {
+			return fmt.Errorf("flap_history must be at least 3")
+		}
+		if conf.FlapHighThreshold <= 0 || conf.FlapHighThreshold > 100 {
+			return fmt.Errorf("flap_high_threshold must be between 0 and 100")
+		}
+		if conf.FlapLowThreshold <= 0 || conf.FlapLowThreshold > conf.FlapHighThreshold {
+			// Checks would never stop flapping below a threshold of 0.
+			return fmt.Errorf("flap_low_threshold must be between 0 and flap_high_threshold")
+		}
+	}
+
+	if conf.CircuitBreakerThreshold < 0 || conf.CircuitBreakerThreshold > 1 {
+		return fmt.Errorf("circuit_breaker_threshold must be between 0 and 1")
+	}
+
+	if conf.CircuitBreakerThreshold > 0 && conf.CircuitBreakerWindow < time.Second {
+		return fmt.Errorf("circuit_breaker_window cannot be lower than 1 second")
+	}
+
+	if conf.CircuitBreakerMinSamples < 0 {
+		return fmt.Errorf("circuit_breaker_min_samples cannot be negative")
+	}
+
+	if conf.ReapLimit < 0 {
+		return fmt.Errorf("reap_limit cannot be negative")
+	}
+
+	if conf.ReapLimit > 0 && conf.ReapLimitWindow <= 0 {
+		return fmt.Errorf("reap_limit_window must be positive")
+	}
+
+	switch conf.NodeReapPolicy {
+	case ReapPolicyDelete, ReapPolicyQuarantine:
+		break
+	default:
+		return fmt.Errorf("node_reap_policy must be one of either \"delete\" or \"quarantine\"")
+	}
+
 	return nil
 }
 
@@ -496,6 +864,11 @@ func MergeConfig(dst *Config, src *HumanConfig) error {
 	}
 	src.NodeReconnectTimeout.Merge(&dst.NodeReconnectTimeout)
 	src.NodeProbeInterval.Merge(&dst.CoordinateUpdateInterval)
+	src.NodeProbeObservers.Merge(&dst.NodeProbeObservers)
+	src.NodeProbeQuorum.Merge(&dst.NodeProbeQuorum)
+	src.NodeProbeRetryInterval.Merge(&dst.NodeProbeRetryInterval)
+	src.NodeProbeMaxInterval.Merge(&dst.NodeProbeMaxInterval)
+	src.NodeProbeRateLimit.Merge(&dst.NodeProbeRateLimit)
 	src.HTTPAddr.Merge(&dst.HTTPAddr)
 	src.Token.Merge(&dst.Token)
 	src.Datacenter.Merge(&dst.Datacenter)
@@ -508,9 +881,26 @@ func MergeConfig(dst *Config, src *HumanConfig) error {
 	src.HTTPSCAPath.Merge(&dst.HTTPSCAPath)
 	src.HTTPSCertFile.Merge(&dst.HTTPSCertFile)
 	src.HTTPSKeyFile.Merge(&dst.HTTPSKeyFile)
+	dst.TLSClientRules = append(dst.TLSClientRules, src.TLSClientRules...)
+	src.TLSReloadInterval.Merge(&dst.TLSReloadInterval)
+	src.Proxy.Merge(&dst.Proxy)
+	dst.NoProxy = append(dst.NoProxy, src.NoProxy...)
+	dst.ProxyRules = append(dst.ProxyRules, src.ProxyRules...)
+	src.SecretKVPath.Merge(&dst.SecretKVPath)
+	dst.SecretDirs = append(dst.SecretDirs, src.SecretDirs...)
+	src.SecretEnvPrefix.Merge(&dst.SecretEnvPrefix)
+	src.SecretRefreshInterval.Merge(&dst.SecretRefreshInterval)
+	dst.OAuth2Clients = append(dst.OAuth2Clients, src.OAuth2Clients...)
+	dst.SyntheticChecks = append(dst.SyntheticChecks, src.SyntheticChecks...)
+	src.CertExpiryWarningDays.Merge(&dst.CertExpiryWarningDays)
+	src.CertExpiryCriticalDays.Merge(&dst.CertExpiryCriticalDays)
+	dst.DNSResolvers = append(dst.DNSResolvers, src.DNSResolvers...)
 	src.ClientAddress.Merge(&dst.ClientAddress)
 	src.PingType.Merge(&dst.PingType)
 	src.DisableCoordinateUpdates.Merge(&dst.DisableCoordinateUpdates)
+	src.CoordinateSource.Merge(&dst.CoordinateSource)
+	src.CoordinateAnchorNode.Merge(&dst.CoordinateAnchorNode)
+	src.CoordinateUpdateRateLimit.Merge(&dst.CoordinateUpdateRateLimit)
 	if len(src.Telemetry) == 1 {
 		t, err := convertTelemetry(src.Telemetry[0])
 		if err != nil {
@@ -521,6 +911,24 @@ func MergeConfig(dst *Config, src *HumanConfig) error {
 
 	src.PassingThreshold.Merge(&dst.PassingThreshold)
 	src.CriticalThreshold.Merge(&dst.CriticalThreshold)
+	src.WarningThreshold.Merge(&dst.WarningThreshold)
+	if src.WarningThreshold.v != nil {
+		dst.warningThresholdSet = true
+	}
+	src.WarningEscalationTimeout.Merge(&dst.WarningEscalationTimeout)
+	dst.EvaluationWindows = append(dst.EvaluationWindows, src.EvaluationWindows...)
+	src.FlapHistory.Merge(&dst.FlapHistory)
+	src.FlapHighThreshold.Merge(&dst.FlapHighThreshold)
+	src.FlapLowThreshold.Merge(&dst.FlapLowThreshold)
+
+	src.CircuitBreakerThreshold.Merge(&dst.CircuitBreakerThreshold)
+	src.CircuitBreakerWindow.Merge(&dst.CircuitBreakerWindow)
+	src.CircuitBreakerMinSamples.Merge(&dst.CircuitBreakerMinSamples)
+
+	src.ReapDryRun.Merge(&dst.ReapDryRun)
+	src.ReapLimit.Merge(&dst.ReapLimit)
+	src.ReapLimitWindow.Merge(&dst.ReapLimitWindow)
+	src.NodeReapPolicy.Merge(&dst.NodeReapPolicy)
 
 	src.LogFile.Merge(&dst.LogFile)
 	src.LogRotateBytes.Merge(&dst.LogRotateBytes)
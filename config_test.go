@@ -5,6 +5,9 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -26,6 +29,11 @@ consul_service_tag = "asdf"
 consul_kv_path = "custom-esm/"
 node_reconnect_timeout = "22s"
 node_probe_interval = "12s"
+node_probe_observers = 3
+node_probe_quorum = 2
+node_probe_retry_interval = "2s"
+node_probe_max_interval = "1m"
+node_probe_rate_limit = 20.5
 external_node_meta {
 	a = "1"
 	b = "2"
@@ -42,7 +50,70 @@ https_ca_file = "CA-cert.pem"
 https_ca_path = "CAPath/"
 https_cert_file = "server-cert.pem"
 https_key_file = "server-key.pem"
+tls_reload_interval = "1m"
+proxy = "http://egress.example.com:3128"
+no_proxy = ["localhost", "*.internal"]
+proxy_rule {
+	host = "*.partner.example.com"
+	proxy = "socks5://socks.example.com:1080"
+	no_proxy = ["status.partner.example.com"]
+}
+proxy_rule {
+	host = "*.corp.example.com"
+}
+secret_kv_path = "esm-secrets/"
+secret_dirs = ["/etc/consul-esm/secrets"]
+secret_env_prefix = "ESM_SECRET_"
+secret_refresh_interval = "10m"
+oauth2_client {
+	name = "partner"
+	token_url = "https://auth.partner.example.com/oauth2/token"
+	client_id = "esm"
+	client_secret = "${file:/etc/consul-esm/secrets/partner-client-secret}"
+	scopes = ["health:read"]
+}
+synthetic_check {
+	name = "partner-login"
+	service_id = "partner-api"
+	interval = "1m"
+	step {
+		name = "login"
+		method = "POST"
+		url = "https://api.partner.example.com/login"
+		extract {
+			token = "json.token"
+		}
+	}
+	step {
+		name = "orders"
+		url = "https://api.partner.example.com/orders"
+		header {
+			Authorization = ["Bearer ${token}"]
+		}
+		assert = "status == 200"
+	}
+}
+cert_expiry_warning_days = 21
+cert_expiry_critical_days = 3
+dns_resolvers = ["10.0.0.2", "10.0.0.3:5353"]
+tls_client_rule {
+	host = "*.partner.example.com"
+	cert_file = "partner-cert.pem"
+	key_file = "partner-key.pem"
+}
+tls_client_rule {
+	server_name = "payments.internal"
+	service_meta {
+		mtls = "payments"
+	}
+	ca_file = "payments-ca.pem"
+	cert_file = "payments-cert.pem"
+	key_file = "payments-key.pem"
+}
 disable_coordinate_updates = true
+coordinate_source = "anchor"
+coordinate_anchor_node = "esm-host"
+coordinate_update_rate_limit = 5
 client_address = "127.0.0.1:8080"
 ping_type = "socket"
 telemetry {
@@ -71,6 +142,30 @@ telemetry {
 }
 passing_threshold = 3
 critical_threshold = 2
+warning_threshold = 1
+warning_escalation_timeout = "10m"
+evaluation_window {
+	size = 5
+	failures = 3
+}
+evaluation_window {
+	check_id = "web-http"
+	service_name = "web"
+	node = "external"
+	size = 10
+	failures = 2
+	successes = 8
+}
+flap_history = 21
+flap_high_threshold = 30
+flap_low_threshold = 10
+circuit_breaker_threshold = 0.8
+circuit_breaker_window = "2m"
+circuit_breaker_min_samples = 20
+reap_dry_run = true
+reap_limit = 5
+reap_limit_window = "30m"
+node_reap_policy = "quarantine"
 log_json = true
 `)
 
@@ -83,25 +178,33 @@ log_json = true
 		KVPath:                   "custom-esm/",
 		NodeReconnectTimeout:     22 * time.Second,
 		CoordinateUpdateInterval: 12 * time.Second,
+		NodeProbeObservers:       3,
+		NodeProbeQuorum:          2,
+		NodeProbeRetryInterval:   2 * time.Second,
+		NodeProbeMaxInterval:     time.Minute,
+		NodeProbeRateLimit:       20.5,
 		NodeMeta: map[string]string{
 			"a": "1",
 			"b": "2",
 		},
-		HTTPAddr:                 "localhost:4949",
-		Token:                    "qwerasdf",
-		Datacenter:               "dc3",
-		CAFile:                   "ca.pem",
-		CAPath:                   "ca/",
-		CertFile:                 "cert.pem",
-		KeyFile:                  "key.pem",
-		TLSServerName:            "example.io",
-		HTTPSCAFile:              "CA-cert.pem",
-		HTTPSCAPath:              "CAPath/",
-		HTTPSCertFile:            "server-cert.pem",
-		HTTPSKeyFile:             "server-key.pem",
-		DisableCoordinateUpdates: true,
-		ClientAddress:            "127.0.0.1:8080",
-		PingType:                 PingTypeSocket,
+		HTTPAddr:                  "localhost:4949",
+		Token:                     "qwerasdf",
+		Datacenter:                "dc3",
+		CAFile:                    "ca.pem",
+		CAPath:                    "ca/",
+		CertFile:                  "cert.pem",
+		KeyFile:                   "key.pem",
+		TLSServerName:             "example.io",
+		HTTPSCAFile:               "CA-cert.pem",
+		HTTPSCAPath:               "CAPath/",
+		HTTPSCertFile:             "server-cert.pem",
+		HTTPSKeyFile:              "server-key.pem",
+		DisableCoordinateUpdates:  true,
+		CoordinateSource:          "anchor",
+		CoordinateAnchorNode:      "esm-host",
+		CoordinateUpdateRateLimit: 5,
+		ClientAddress:             "127.0.0.1:8080",
+		PingType:                  PingTypeSocket,
 		Telemetry: lib.TelemetryConfig{
 			CirconusAPIApp:                     "circonus_api_app",
 			CirconusAPIToken:                   "circonus_api_token",
@@ -137,6 +240,101 @@ log_json = true
 		CriticalThreshold: 2,
 		LogJSON:           true,
 		EnableSyslog:      true,
+
+		TLSReloadInterval: time.Minute,
+		Proxy:             "http://egress.example.com:3128",
+		NoProxy:           []string{"localhost", "*.internal"},
+		ProxyRules: []ProxyRule{
+			{
+				Host:    "*.partner.example.com",
+				Proxy:   "socks5://socks.example.com:1080",
+				NoProxy: []string{"status.partner.example.com"},
+			},
+			{Host: "*.corp.example.com"},
+		},
+		SecretKVPath:          "esm-secrets/",
+		SecretDirs:            []string{"/etc/consul-esm/secrets"},
+		SecretEnvPrefix:       "ESM_SECRET_",
+		SecretRefreshInterval: 10 * time.Minute,
+
+		OAuth2Clients: []OAuth2Client{
+			{
+				Name:         "partner",
+				TokenURL:     "https://auth.partner.example.com/oauth2/token",
+				ClientID:     "esm",
+				ClientSecret: "${file:/etc/consul-esm/secrets/partner-client-secret}",
+				Scopes:       []string{"health:read"},
+			},
+		},
+
+		SyntheticChecks: []SyntheticCheck{
+			{
+				Name:      "partner-login",
+				ServiceID: "partner-api",
+				Interval:  time.Minute,
+				Steps: []SyntheticStep{
+					{
+						Name:    "login",
+						Method:  "POST",
+						URL:     "https://api.partner.example.com/login",
+						Extract: map[string]string{"token": "json.token"},
+					},
+					{
+						Name:   "orders",
+						URL:    "https://api.partner.example.com/orders",
+						Header: map[string][]string{"Authorization": {"Bearer ${token}"}},
+						Assert: "status == 200",
+					},
+				},
+			},
+		},
+
+		CertExpiryWarningDays:  21,
+		CertExpiryCriticalDays: 3,
+
+		DNSResolvers: []string{"10.0.0.2", "10.0.0.3:5353"},
+
+		TLSClientRules: []TLSClientRule{
+			{
+				Host:     "*.partner.example.com",
+				CertFile: "partner-cert.pem",
+				KeyFile:  "partner-key.pem",
+			},
+			{
+				ServerName:  "payments.internal",
+				ServiceMeta: map[string]string{"mtls": "payments"},
+				CAFile:      "payments-ca.pem",
+				CertFile:    "payments-cert.pem",
+				KeyFile:     "payments-key.pem",
+			},
+		},
+
+		WarningThreshold:         1,
+		WarningEscalationTimeout: 10 * time.Minute,
+		warningThresholdSet:      true,
+		EvaluationWindows: []EvaluationWindow{
+			{Size: 5, Failures: 3},
+			{
+				CheckID:     "web-http",
+				ServiceName: "web",
+				Node:        "external",
+				Size:        10,
+				Failures:    2,
+				Successes:   8,
+			},
+		},
+		FlapHistory:       21,
+		FlapHighThreshold: 30,
+		FlapLowThreshold:  10,
+
+		CircuitBreakerThreshold:  0.8,
+		CircuitBreakerWindow:     2 * time.Minute,
+		CircuitBreakerMinSamples: 20,
+
+		ReapDryRun:      true,
+		ReapLimit:       5,
+		ReapLimitWindow: 30 * time.Minute,
+		NodeReapPolicy:  ReapPolicyQuarantine,
 	}
 
 	result := &Config{}
@@ -169,6 +367,182 @@ func TestValidateConfig(t *testing.T) {
 			raw: `node_probe_interval = "500ms"`,
 			err: "node_probe_interval cannot be lower than 1 second",
 		},
+		{
+			raw: `node_probe_observers = 0`,
+			err: "node_probe_observers must be at least 1",
+		},
+		{
+			raw: `node_probe_quorum = 2`,
+			err: "node_probe_quorum must be between 1 and node_probe_observers",
+		},
+		{
+			raw: "node_probe_observers = 3\nnode_probe_quorum = 2",
+			err: "",
+		},
+		{
+			raw: `coordinate_source = "peers"`,
+			err: `coordinate_source must be one of either "agent", "servers" or "anchor"`,
+		},
+		{
+			raw: `coordinate_source = "anchor"`,
+			err: `coordinate_anchor_node must be set when coordinate_source is "anchor"`,
+		},
+		{
+			raw: "coordinate_source = \"agent\"\nenable_agentless = true",
+			err: `coordinate_source cannot be "agent" when enable_agentless is set`,
+		},
+		{
+			raw: `coordinate_update_rate_limit = -1`,
+			err: "coordinate_update_rate_limit cannot be negative",
+		},
+		{
+			raw: `node_probe_retry_interval = "-1s"`,
+			err: "node_probe_retry_interval cannot be negative",
+		},
+		{
+			raw: `node_probe_max_interval = "5s"`,
+			err: "node_probe_max_interval cannot be lower than node_probe_interval",
+		},
+		{
+			raw: `node_probe_rate_limit = -1`,
+			err: "node_probe_rate_limit cannot be negative",
+		},
+		{
+			raw: `warning_threshold = -1`,
+			err: "warning_threshold cannot be negative",
+		},
+		{
+			raw: `warning_escalation_timeout = "-1m"`,
+			err: "warning_escalation_timeout cannot be negative",
+		},
+		{
+			raw: `tls_reload_interval = "-1s"`,
+			err: "tls_reload_interval cannot be negative",
+		},
+		{
+			raw: `proxy = "ftp://proxy.example.com"`,
+			err: "proxy must be an http, https or socks5 URL",
+		},
+		{
+			raw: `no_proxy = ["[a"]`,
+			err: "no_proxy entry is not a valid pattern",
+		},
+		{
+			raw: "proxy_rule {\n  proxy = \"http://proxy.example.com\"\n}",
+			err: "proxy_rule host must be set",
+		},
+		{
+			raw: "proxy_rule {\n  host = \"*.example.com\"\n  proxy = \"proxy.example.com:3128\"\n}",
+			err: "proxy_rule proxy",
+		},
+		{
+			raw: `secret_dirs = ["secrets"]`,
+			err: "secret_dirs must be absolute paths",
+		},
+		{
+			raw: `secret_refresh_interval = "-1m"`,
+			err: "secret_refresh_interval cannot be negative",
+		},
+		{
+			raw: "oauth2_client {\n  token_url = \"https://auth.example.com/token\"\n  client_id = \"esm\"\n}",
+			err: "oauth2_client name must be set",
+		},
+		{
+			raw: "oauth2_client {\n  name = \"partner\"\n  token_url = \"auth.example.com/token\"\n  client_id = \"esm\"\n}",
+			err: `oauth2_client "partner" token_url must be an http or https URL`,
+		},
+		{
+			raw: "oauth2_client {\n  name = \"partner\"\n  token_url = \"https://auth.example.com/token\"\n}",
+			err: `oauth2_client "partner" client_id must be set`,
+		},
+		{
+			raw: "oauth2_client {\n  name = \"partner\"\n  token_url = \"https://auth.example.com/token\"\n  client_id = \"esm\"\n  auth_style = \"jwt\"\n}",
+			err: `oauth2_client "partner" auth_style must be "header" or "params"`,
+		},
+		{
+			raw: strings.Repeat("oauth2_client {\n  name = \"partner\"\n  token_url = \"https://auth.example.com/token\"\n  client_id = \"esm\"\n}\n", 2),
+			err: `oauth2_client "partner" is defined more than once`,
+		},
+		{
+			raw: "synthetic_check {\n  name = \"login\"\n  step {\n    name = \"home\"\n    url = \"https://example.com\"\n  }\n}",
+			err: `synthetic_check "login" service_id must be set`,
+		},
+		{
+			raw: strings.Repeat("synthetic_check {\n  name = \"login\"\n  service_id = \"web\"\n  step {\n    name = \"home\"\n    url = \"https://example.com\"\n  }\n}\n", 2),
+			err: `synthetic_check "login" is defined more than once`,
+		},
+		{
+			raw: `cert_expiry_critical_days = -1`,
+			err: "cert_expiry_critical_days cannot be negative",
+		},
+		{
+			raw: `cert_expiry_warning_days = 5`,
+			err: "cert_expiry_warning_days must be at least cert_expiry_critical_days",
+		},
+		{
+			raw: `dns_resolvers = ["10.0.0.2:dns"]`,
+			err: `dns_resolvers entry "10.0.0.2:dns" is not a valid address: invalid port "dns"`,
+		},
+		{
+			raw: "tls_client_rule {\n  cert_file = \"cert.pem\"\n  key_file = \"key.pem\"\n}",
+			err: "tls_client_rule must set at least one of host, server_name or service_meta",
+		},
+		{
+			raw: "tls_client_rule {\n  host = \"[a\"\n}",
+			err: "tls_client_rule host is not a valid pattern",
+		},
+		{
+			raw: "tls_client_rule {\n  host = \"*.example.com\"\n  cert_file = \"cert.pem\"\n}",
+			err: "tls_client_rule cert_file and key_file must be set together",
+		},
+		{
+			raw: "evaluation_window {\n  failures = 1\n}",
+			err: "evaluation_window size must be at least 1",
+		},
+		{
+			raw: "evaluation_window {\n  size = 5\n  failures = 6\n}",
+			err: "evaluation_window failures must be between 1 and size",
+		},
+		{
+			raw: "evaluation_window {\n  size = 5\n  failures = 3\n  successes = 6\n}",
+			err: "evaluation_window successes must be between 0 and size",
+		},
+		{
+			raw: `flap_history = 2`,
+			err: "flap_history must be at least 3",
+		},
+		{
+			raw: "flap_history = 21\nflap_high_threshold = 120",
+			err: "flap_high_threshold must be between 0 and 100",
+		},
+		{
+			raw: "flap_history = 21\nflap_low_threshold = 30",
+			err: "flap_low_threshold must be between 0 and flap_high_threshold",
+		},
+		{
+			raw: "flap_history = 21\nflap_low_threshold = 0",
+			err: "flap_low_threshold must be between 0 and flap_high_threshold",
+		},
+		{
+			raw: `circuit_breaker_threshold = 2`,
+			err: "circuit_breaker_threshold must be between 0 and 1",
+		},
+		{
+			raw: "circuit_breaker_threshold = 0.5\ncircuit_breaker_window = \"500ms\"",
+			err: "circuit_breaker_window cannot be lower than 1 second",
+		},
+		{
+			raw: `reap_limit = -1`,
+			err: "reap_limit cannot be negative",
+		},
+		{
+			raw: "reap_limit = 5\nreap_limit_window = \"0s\"",
+			err: "reap_limit_window must be positive",
+		},
+		{
+			raw: `node_reap_policy = "archive"`,
+			err: `node_reap_policy must be one of either "delete" or "quarantine"`,
+		},
 	}
 
 	for _, tc := range cases {
@@ -201,6 +575,25 @@ func TestValidateConfig(t *testing.T) {
 	}
 }
 
+func TestBuildConfig_warningThreshold(t *testing.T) {
+	build := func(configs ...string) *Config {
+		var paths []string
+		for i, config := range configs {
+			path := filepath.Join(t.TempDir(), fmt.Sprintf("%d.hcl", i))
+			assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+			paths = append(paths, path)
+		}
+		conf, err := BuildConfig(paths)
+		assert.NoError(t, err)
+		return conf
+	}
+
+	// The warning threshold defaults to the passing threshold.
+	assert.Equal(t, 3, build(`passing_threshold = 3`).WarningThreshold)
+	assert.Equal(t, 0, build(`passing_threshold = 3`, `warning_threshold = 0`).WarningThreshold)
+	assert.Equal(t, 1, build(`warning_threshold = 1`, `passing_threshold = 3`).WarningThreshold)
+}
+
 func TestDecodeConfig(t *testing.T) {
 	cases := []struct {
 		name        string
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -15,7 +16,6 @@ import (
 	"github.com/hashicorp/consul/api"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/serf/coordinate"
-	"github.com/mitchellh/mapstructure"
 )
 
 const (
@@ -23,62 +23,82 @@ const (
 	NodeCriticalStatus = "Node not live or unreachable"
 	// needs to match consul/agent/structs' MetaSegmentKey value
 	MetaSegmentKey = "consul-network-segment"
+
+	// NodeProbeIntervalMetaKey overrides node_probe_interval for a node.
+	NodeProbeIntervalMetaKey = "external-probe-interval"
+	// NodeReconnectTimeoutMetaKey overrides node_reconnect_timeout for a node.
+	NodeReconnectTimeoutMetaKey = "external-reconnect-timeout"
 )
 
 type nodeChannel <-chan []*api.Node
 
+// probeResult is the outcome of a single ping, reported back to the probe
+// schedule.
+type probeResult struct {
+	node    string
+	healthy bool
+}
+
 // The maximum time to wait for a ping to complete.
 var MaxRTT = 5 * time.Second
 
 // updateCoords is a long running goroutine that attempts to ping all external nodes
-// once per CoordinateUpdateInterval and update their statuses in Consul.
+// once per CoordinateUpdateInterval, or the interval set in their node meta, and
+// update their statuses in Consul. Nodes that fail a ping are retried sooner and
+// stable nodes back off, within the configured probe rate limit.
 func (a *Agent) updateCoords(nodeCh nodeChannel) {
 	// Wait for the first node ordering
 	nodeCh = a.checkNodeTracking(nodeCh)
-	nodes := <-nodeCh
-	shuffleNodes(nodes)
-
-	// Start a ticker to help time the pings based on the watched node count.
-	ticker := a.nodeTicker(len(nodes))
-	defer ticker.Stop()
+	schedule := newProbeSchedule(a.nodeProbeInterval)
+	schedule.retryInterval = a.config.NodeProbeRetryInterval
+	schedule.maxInterval = a.config.NodeProbeMaxInterval
+	schedule.Update(<-nodeCh, time.Now())
 
-	index := 0
+	results := make(chan probeResult, 16)
+	var lastProbe time.Time
 	for {
-		// Shuffle the new slice of nodes and update the ticker if there's a node update.
-		select {
-		case newNodes := <-nodeCh:
-			if len(newNodes) != len(nodes) {
-				ticker.Stop()
-				ticker = a.nodeTicker(len(newNodes))
-				a.logger.Info("Now running probes for external nodes", "count", len(newNodes))
+		// Wait for the next node to be due before performing another ping. New
+		// nodes are spread out over their interval, which keeps the pings evenly
+		// spaced.
+		wait := retryTime
+		if next, ok := schedule.Next(); ok {
+			if spacing := a.probeSpacing(); next.Before(lastProbe.Add(spacing)) {
+				next = lastProbe.Add(spacing)
 			}
-			nodes = newNodes
-			shuffleNodes(nodes)
-			index = 0
-		default:
+			wait = time.Until(next)
 		}
 
-		// Wait for the next tick before performing another ping. Using the ticker this way
-		// ensures that we evenly space out the pings over the CoordinateUpdateInterval.
 		select {
-		case <-ticker.C:
-			// Cycle through the nodes in shuffled order.
-			index += 1
-			if index >= len(nodes) {
-				index = 0
+		case newNodes := <-nodeCh:
+			if len(newNodes) != schedule.Len() {
+				a.logger.Info("Now running probes for external nodes", "count", len(newNodes))
 			}
+			removed := schedule.Update(newNodes, time.Now())
+			a.removeProbeObservations(removed)
+			a.coordUpdates.Retain(newNodes)
+			a.nodeHealth.Retain(newNodes)
+			continue
+		case result := <-results:
+			schedule.Report(result.node, result.healthy, time.Now())
+			continue
+		case <-time.After(wait):
 		case <-a.shutdownCh:
 			return
 		}
 
-		if len(nodes) == 0 {
+		if schedule.Len() == 0 {
 			a.logger.Debug("No nodes to probe, will retry", "time", retryTime.String())
-			time.Sleep(retryTime)
 			continue
 		}
 
+		node := schedule.Pop(time.Now())
+		if node == nil {
+			continue
+		}
+		lastProbe = time.Now()
+		interval := schedule.Interval(node.Node)
+
 		// Start a new ping for the node if there isn't one already in-flight.
-		node := nodes[index]
 		a.inflightLock.Lock()
 		if _, ok := a.inflightPings[node.Node]; ok {
 			a.logger.Warn("Error pinging node, last request still outstanding", "node", node.Node, "nodeId", node.ID)
@@ -86,42 +106,236 @@ func (a *Agent) updateCoords(nodeCh nodeChannel) {
 		} else {
 			a.inflightPings[node.Node] = struct{}{}
 			a.inflightLock.Unlock()
-			go a.runNodePing(node)
+			go func() {
+				result := probeResult{node: node.Node, healthy: a.runNodePing(node, interval)}
+				select {
+				case results <- result:
+				case <-a.shutdownCh:
+				}
+			}()
 		}
 	}
 }
 
-// runNodePing pings a node and updates its status in Consul accordingly.
-func (a *Agent) runNodePing(node *api.Node) {
+// probeSpacing returns the minimum time between two pings needed to stay
+// within node_probe_rate_limit, or zero if there is no limit.
+func (a *Agent) probeSpacing() time.Duration {
+	if a.config.NodeProbeRateLimit <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / a.config.NodeProbeRateLimit)
+}
+
+// runNodePing pings a node and updates its status in Consul accordingly. It
+// returns whether the ping succeeded.
+func (a *Agent) runNodePing(node *api.Node, interval time.Duration) bool {
+	defer func() {
+		a.inflightLock.Lock()
+		delete(a.inflightPings, node.Node)
+		a.inflightLock.Unlock()
+	}()
+
+	key := fmt.Sprintf("%sprobes/%s", a.config.KVPath, node.Node)
+
+	// Nodes in maintenance aren't probed, and their reap timer is frozen
+	// until the maintenance is over.
+	if _, ok := a.maintenance.Reason(node.Node, "", time.Now()); ok {
+		if a.isObservedNode(node.Node) {
+			return true
+		}
+		kvClient := a.client.KV()
+		kvPair, _, err := kvClient.Get(key, nil)
+		if err == nil {
+			err = a.freezeNodeReapTimer(node.Node, kvClient, key, kvPair)
+		}
+		if err != nil {
+			a.logger.Warn("could not freeze reap timer for node in maintenance", "node", node.Node, "error", err)
+		}
+		return true
+	}
+	a.maintenance.Thaw(key)
+
+	// Nodes we only observe for another agent just get our result recorded.
+	if a.isObservedNode(node.Node) {
+		_, err := pingNode(node.Address, a.config.PingType)
+		a.breaker.Record(err != nil)
+		if err != nil {
+			a.logger.Debug("could not ping observed node", "node", node.Node, "error", err)
+		}
+		if err := a.recordProbeObservation(node, err == nil, interval); err != nil {
+			a.logger.Warn("error recording probe observation", "node", node.Node, "error", err)
+		}
+		return err == nil
+	}
+
 	// Get the critical status of the node.
 	kvClient := a.client.KV()
-	key := fmt.Sprintf("%sprobes/%s", a.config.KVPath, node.Node)
 	kvPair, _, err := kvClient.Get(key, nil)
 	if err != nil {
 		a.logger.Error("could not get critical status for node", "node", node.Node, "error", err)
 	}
 
 	// Run an ICMP ping to the node.
-	rtt, err := pingNode(node.Address, a.config.PingType)
+	rtt, pingErr := pingNode(node.Address, a.config.PingType)
+	a.breaker.Record(pingErr != nil)
+	if pingErr != nil {
+		a.logger.Warn("could not ping node", "node", node.Node, "error", pingErr)
+	}
+
+	// With multiple observers, the node is only failed once enough of them agree.
+	healthy := pingErr == nil
+	if a.quorumProbing() {
+		healthy = !a.probeQuorumFailed(node, healthy)
+	}
 
 	// Update the node's health based on the results of the ping.
-	if err == nil {
+	if healthy {
 		if err := a.updateHealthyNode(node, kvClient, key, kvPair); err != nil {
 			a.logger.Warn("error updating node", "error", err)
+		} else {
+			a.nodeHealth.Set(node.Node, false)
 		}
-		if err := a.updateNodeCoordinate(node, rtt); err != nil {
-			a.logger.Warn("could not update coordinate for node", "node", node.Node, "error", err)
+		if pingErr == nil {
+			if err := a.updateNodeCoordinate(node, rtt); err != nil {
+				a.logger.Warn("could not update coordinate for node", "node", node.Node, "error", err)
+			}
 		}
+	} else if a.breaker.Tripped() {
+		a.logger.Debug("circuit breaker tripped, skipping failed node update", "node", node.Node)
 	} else {
-		a.logger.Warn("could not ping node", "node", node.Node, "error", err)
 		if err := a.updateFailedNode(node, kvClient, key, kvPair); err != nil {
 			a.logger.Warn("error updating node", "error", err)
+		} else {
+			a.nodeHealth.Set(node.Node, true)
 		}
 	}
+	return pingErr == nil
+}
+
+// probeObservation is the result of a single agent's ping of a probe node,
+// stored under probes/<node>/<agent> when quorum probing is enabled. Interval
+// is how often the agent was pinging the node at the time, which can be longer
+// than the node's probe interval when the agent has backed off.
+type probeObservation struct {
+	Status   string
+	Time     time.Time
+	Interval time.Duration
+}
+
+// quorumProbing returns true if probe nodes are pinged by several agents.
+func (a *Agent) quorumProbing() bool {
+	return a.config.NodeProbeObservers > 1
+}
 
-	a.inflightLock.Lock()
-	delete(a.inflightPings, node.Node)
-	a.inflightLock.Unlock()
+// isObservedNode returns true if this agent only pings the node on behalf of
+// the agent owning its probe.
+func (a *Agent) isObservedNode(node string) bool {
+	a.observedNodesLock.Lock()
+	defer a.observedNodesLock.Unlock()
+	return a.observedNodes[node]
+}
+
+// probeObservationsPath returns the KV prefix under which the observers of a
+// node record their results.
+func (a *Agent) probeObservationsPath(node string) string {
+	return fmt.Sprintf("%sprobes/%s/", a.config.KVPath, node)
+}
+
+// probeObservationTTL is the age after which an observation no longer counts
+// towards a node's quorum. Observers ping each node once per the interval they
+// recorded, so this allows for one missed round. Observations without an
+// interval fall back to the node's probe interval.
+func (a *Agent) probeObservationTTL(node *api.Node, obs probeObservation) time.Duration {
+	interval := obs.Interval
+	if interval <= 0 {
+		interval = a.nodeProbeInterval(node)
+	}
+	return 2*interval + MaxRTT
+}
+
+// recordProbeObservation writes this agent's latest ping result for the node,
+// along with the interval at which it is currently pinging it.
+func (a *Agent) recordProbeObservation(node *api.Node, healthy bool, interval time.Duration) error {
+	status := api.HealthPassing
+	if !healthy {
+		status = api.HealthCritical
+	}
+	bytes, err := json.Marshal(probeObservation{Status: status, Time: time.Now().UTC(), Interval: interval})
+	if err != nil {
+		return err
+	}
+	_, err = a.client.KV().Put(&api.KVPair{
+		Key:   a.probeObservationsPath(node.Node) + a.serviceID(),
+		Value: bytes,
+	}, a.ConsulWriteOption())
+	return err
+}
+
+// removeProbeObservations deletes this agent's observations of nodes it no
+// longer pings, so they don't linger in the KV store.
+func (a *Agent) removeProbeObservations(nodes []string) {
+	if !a.quorumProbing() {
+		return
+	}
+	for _, node := range nodes {
+		_, err := a.client.KV().Delete(a.probeObservationsPath(node)+a.serviceID(), a.ConsulWriteOption())
+		if err != nil {
+			a.logger.Warn("could not remove probe observation", "node", node, "error", err)
+		}
+	}
+}
+
+// nodeProbeQuorum returns the quorum set by the leader, or NodeProbeQuorum if
+// it didn't set one.
+func (a *Agent) nodeProbeQuorum() int {
+	a.observedNodesLock.Lock()
+	defer a.observedNodesLock.Unlock()
+	if a.probeQuorum > 0 {
+		return a.probeQuorum
+	}
+	return a.config.NodeProbeQuorum
+}
+
+// probeQuorumFailed combines our own ping result with the fresh observations
+// of the other agents and returns true if at least the quorum of them saw the
+// node as failed. If the observations can't be read we fall back to our own
+// result.
+func (a *Agent) probeQuorumFailed(node *api.Node, healthy bool) bool {
+	failed := 0
+	if !healthy {
+		failed++
+	}
+
+	prefix := a.probeObservationsPath(node.Node)
+	pairs, _, err := a.client.KV().List(prefix, a.ConsulQueryOption())
+	if err != nil {
+		a.logger.Warn("could not get probe observations for node", "node", node.Node, "error", err)
+		return !healthy
+	}
+
+	for _, pair := range pairs {
+		if strings.TrimPrefix(pair.Key, prefix) == a.serviceID() {
+			continue
+		}
+		var obs probeObservation
+		if err := json.Unmarshal(pair.Value, &obs); err != nil {
+			a.logger.Warn("could not decode probe observation", "key", pair.Key, "error", err)
+			continue
+		}
+		if time.Since(obs.Time) > a.probeObservationTTL(node, obs) {
+			continue
+		}
+		if obs.Status == api.HealthCritical {
+			failed++
+		}
+	}
+
+	quorum := a.nodeProbeQuorum()
+	if failed > 0 {
+		a.logger.Debug("probe observers reporting node failed", "node", node.Node,
+			"failed", failed, "quorum", quorum)
+	}
+	return failed >= quorum
 }
 
 // shuffleNodes randomizes the ordering of a slice of nodes.
@@ -132,15 +346,56 @@ func shuffleNodes(nodes []*api.Node) {
 	}
 }
 
-// nodeTicker returns a time.Ticker to cycle through all nodes once
-// every CoordinateUpdateInterval.
-func (a *Agent) nodeTicker(numNodes int) *time.Ticker {
-	waitTime := a.config.CoordinateUpdateInterval
-	if numNodes > 0 {
-		waitTime = a.config.CoordinateUpdateInterval / time.Duration(numNodes)
+// nodeProbeInterval returns how often the node should be pinged, which can be
+// overridden per node with the NodeProbeIntervalMetaKey node meta.
+func (a *Agent) nodeProbeInterval(node *api.Node) time.Duration {
+	interval, err := metaDuration(node.Meta, NodeProbeIntervalMetaKey, a.config.CoordinateUpdateInterval)
+	if err != nil && a.warnInvalidNodeMeta(node, NodeProbeIntervalMetaKey) {
+		a.logger.Warn("invalid probe interval in node meta, using default", "node", node.Node,
+			"interval", a.config.CoordinateUpdateInterval.String(), "error", err)
 	}
-	a.logger.Debug("Now waiting between node pings", "time", waitTime.String())
-	return time.NewTicker(waitTime)
+	if _, ok := node.Meta[NodeProbeIntervalMetaKey]; ok && interval < minimumInterval {
+		interval = minimumInterval
+	}
+	return interval
+}
+
+// nodeReconnectTimeout returns how long the node may fail its pings before it
+// is reaped, which can be overridden per node with the
+// NodeReconnectTimeoutMetaKey node meta.
+func (a *Agent) nodeReconnectTimeout(node *api.Node) time.Duration {
+	timeout, err := metaDuration(node.Meta, NodeReconnectTimeoutMetaKey, a.config.NodeReconnectTimeout)
+	if err != nil && a.warnInvalidNodeMeta(node, NodeReconnectTimeoutMetaKey) {
+		a.logger.Warn("invalid reconnect timeout in node meta, using default", "node", node.Node,
+			"timeout", a.config.NodeReconnectTimeout.String(), "error", err)
+	}
+	return timeout
+}
+
+// warnInvalidNodeMeta returns true the first time the node's value of the
+// meta key is found invalid, so it is warned about once rather than on every
+// probe. A changed value is warned about again.
+func (a *Agent) warnInvalidNodeMeta(node *api.Node, key string) bool {
+	value := node.Meta[key]
+	previous, loaded := a.invalidNodeMeta.Swap(node.Node+"/"+key, value)
+	return !loaded || previous.(string) != value
+}
+
+// metaDuration parses the duration stored under key in the given meta,
+// returning fallback if it is unset or invalid.
+func metaDuration(meta map[string]string, key string, fallback time.Duration) (time.Duration, error) {
+	v, ok := meta[key]
+	if !ok {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback, err
+	}
+	if d <= 0 {
+		return fallback, fmt.Errorf("%s must be positive, got %q", key, v)
+	}
+	return d, nil
 }
 
 // updateHealthyNode updates the node's health check, additionally it debounces repeated updates
@@ -236,9 +491,11 @@ func (a *Agent) updateFailedNodeTxn(node *api.Node, kvClient *api.KV, key string
 		}
 
 		// Check if the node has been critical for too long and needs to be reaped.
-		if time.Since(criticalStart) > a.config.NodeReconnectTimeout {
+		timeout := a.nodeReconnectTimeout(node)
+		if time.Since(criticalStart) > timeout &&
+			a.reaper.Allow(reapKindNode, node.Node, node.Meta) {
 			a.logger.Info("reaping node has been failed for too long", "node",
-				node.Node, "failureTimeout", a.config.NodeReconnectTimeout.String())
+				node.Node, "failureTimeout", timeout.String())
 
 			// Clear the KV entry.
 			kvOps := &api.KVTxnOp{
@@ -253,13 +510,37 @@ func (a *Agent) updateFailedNodeTxn(node *api.Node, kvClient *api.KV, key string
 				KV: kvOps,
 			})
 
+			// Drop the observations other agents recorded for the node.
+			if a.quorumProbing() {
+				treeOps := &api.KVTxnOp{
+					Verb: api.KVDeleteTree,
+					Key:  a.probeObservationsPath(node.Node),
+				}
+				a.HasPartition(func(partition string) {
+					treeOps.Partition = partition
+				})
+				ops = append(ops, &api.TxnOp{
+					KV: treeOps,
+				})
+			}
+
 			// If the node still exists in the catalog, add an atomic delete on the node to
-			// the list of operations to run.
+			// the list of operations to run. Only deregistrations count towards the
+			// reap limit.
 			existing, _, err := a.client.Catalog().Node(node.Node, a.ConsulQueryOption())
 			if err != nil {
 				return fmt.Errorf("could not fetch existing node %q: %v", node.Node, err)
 			}
 			if existing != nil && existing.Node != nil {
+				// Keep a snapshot of the registration if the node is quarantined.
+				if a.config.NodeReapPolicy == ReapPolicyQuarantine {
+					snapshotOps, err := a.quarantineNodeOps(existing)
+					if err != nil {
+						return err
+					}
+					ops = append(ops, snapshotOps...)
+					a.logger.Info("Quarantining node", "node", node.Node)
+				}
 				ops = append(ops, &api.TxnOp{
 					Node: &api.NodeTxnOp{
 						Verb: api.NodeDeleteCAS,
@@ -273,7 +554,13 @@ func (a *Agent) updateFailedNodeTxn(node *api.Node, kvClient *api.KV, key string
 			}
 
 			// Run the transaction as-is to deregister the node and delete the KV entry.
-			return a.runClientTxn(ops)
+			if err := a.runClientTxn(ops); err != nil {
+				return err
+			}
+			if existing != nil && existing.Node != nil {
+				a.reaper.Reaped(reapKindNode)
+			}
+			return nil
 		}
 	}
 
@@ -328,48 +615,42 @@ func (a *Agent) runClientTxn(ops api.TxnOps) error {
 	return nil
 }
 
-// updateNodeCoordinate updates the node's coordinate entry based on the
-// given RTT from a ping
+// updateNodeCoordinate computes the node's new coordinate entry based on the
+// given RTT from a ping and queues it to be written to Consul.
 func (a *Agent) updateNodeCoordinate(node *api.Node, rtt time.Duration) error {
 	if a.config.DisableCoordinateUpdates {
 		a.logger.Trace("Debounce: skipping coordinate update for node", "node", node.Node)
 		return nil
 	}
 
-	// Get coordinate info for the node.
-	coords, _, err := a.client.Coordinate().Node(node.Node, nil)
-	if err != nil && !strings.Contains(err.Error(), "Unexpected response code: 404") {
-		return fmt.Errorf("error getting coordinate for node %q: %v, skipping update", node.Node, err)
-	}
+	// Get coordinate info for the node, reading it from the catalog if we
+	// don't know it yet.
+	coord, exists := a.coordUpdates.Known(node.Node)
+	if !exists {
+		coords, _, err := a.client.Coordinate().Node(node.Node, nil)
+		if err != nil && !strings.Contains(err.Error(), "Unexpected response code: 404") {
+			return fmt.Errorf("error getting coordinate for node %q: %v, skipping update", node.Node, err)
+		}
 
-	// Take the first coordinate in the list if there are pre-existing
-	// coordinates, we don't have to worry about picking the right one
-	// because segments don't apply to external nodes.
-	var coord *api.CoordinateEntry
-	if len(coords) != 0 {
-		coord = coords[0]
-	} else {
-		coord = &api.CoordinateEntry{
-			Node:    node.Node,
-			Segment: node.Meta[MetaSegmentKey],
-			Coord:   coordinate.NewCoordinate(coordinate.DefaultConfig()),
+		// Take the first coordinate in the list if there are pre-existing
+		// coordinates, we don't have to worry about picking the right one
+		// because segments don't apply to external nodes.
+		if len(coords) != 0 {
+			coord, exists = coords[0], true
+			a.coordUpdates.Remember(coord)
+		} else {
+			coord = &api.CoordinateEntry{
+				Node:    node.Node,
+				Segment: node.Meta[MetaSegmentKey],
+				Coord:   coordinate.NewCoordinate(coordinate.DefaultConfig()),
+			}
 		}
 	}
 
-	// Get the local agent's coordinate info.
-	self, err := a.client.Agent().Self()
+	// Get our own coordinate, which is cached between pings.
+	localCoord, err := a.localCoordinate()
 	if err != nil {
-		return fmt.Errorf("could not retrieve local agent's coordinate info: %v", err)
-	}
-
-	coordInfo, ok := self["Coord"]
-	if !ok {
-		return fmt.Errorf("could not decode local agent's coordinate info: %v", err)
-	}
-
-	var localCoord coordinate.Coordinate
-	if err := mapstructure.Decode(coordInfo, &localCoord); err != nil {
-		return fmt.Errorf("could not decode local agent's coordinate info: %v", err)
+		return fmt.Errorf("could not get local coordinate: %v", err)
 	}
 
 	// Perform the coordinate update calculations.
@@ -377,28 +658,25 @@ func (a *Agent) updateNodeCoordinate(node *api.Node, rtt time.Duration) error {
 	if err := client.SetCoordinate(coord.Coord); err != nil {
 		return fmt.Errorf("invalid coordinate for node %q: %v", node.Node, err)
 	}
-	newCoord, err := client.Update("local", &localCoord, rtt)
+	newCoord, err := client.Update("local", localCoord, rtt)
 	if err != nil {
 		return fmt.Errorf("error updating coordinate for node %q: %v", node.Node, err)
 	}
 
 	// Don't update the coordinate in the catalog if the coordinate already
 	// exists and the change is insignificant
-	if len(coords) > 0 && coord.Coord.DistanceTo(newCoord) <= time.Millisecond {
+	if exists && coord.Coord.DistanceTo(newCoord) <= time.Millisecond {
 		a.logger.Trace("Skipped update for coordinates", "node", node.Node, "distanceFromPreviousCoord", coord.Coord.DistanceTo(newCoord))
+		coordinateDropped("insignificant")
 		return nil
 	}
 
-	_, err = a.client.Coordinate().Update(&api.CoordinateEntry{
+	a.coordUpdates.Enqueue(&api.CoordinateEntry{
 		Node:    coord.Node,
 		Segment: coord.Segment,
 		Coord:   newCoord,
-	}, nil)
-
-	if err != nil {
-		return fmt.Errorf("error applying coordinate update for node %q: %v", node.Node, err)
-	}
-	a.logger.Info("Updated coordinates", "node", node.Node, "distanceFromPreviousCoord", coord.Coord.DistanceTo(newCoord))
+	})
+	a.logger.Debug("Queued coordinate update", "node", node.Node, "distanceFromPreviousCoord", coord.Coord.DistanceTo(newCoord))
 	return nil
 }
 
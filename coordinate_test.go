@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -52,7 +53,11 @@ func TestCoordinate_updateNodeCoordinate(t *testing.T) {
 			Output:          LOGOUT,
 		}),
 		knownNodeStatuses: make(map[string]lastKnownStatus),
+		shutdownCh:        make(chan struct{}),
 	}
+	agent.coordUpdates = newCoordinateUpdater(client, agent.logger, conf)
+	go agent.coordUpdates.Run(agent.shutdownCh)
+	defer agent.Shutdown()
 	agent.updateNodeCoordinate(&api.Node{Node: "external"}, 1*time.Second)
 
 	var coords []*api.CoordinateEntry
@@ -362,3 +367,186 @@ func TestCheckNodeTracking(t *testing.T) {
 		t.Errorf("bar?")
 	}
 }
+
+func TestCoordinate_probeQuorumFailed(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := DefaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.NodeProbeObservers = 3
+	conf.NodeProbeQuorum = 2
+
+	agent := &Agent{
+		client: client,
+		config: conf,
+		id:     "self",
+		logger: hclog.New(&hclog.LoggerOptions{
+			Name:            "consul-esm",
+			Level:           hclog.LevelFromString("INFO"),
+			IncludeLocation: true,
+			Output:          LOGOUT,
+		}),
+		knownNodeStatuses: make(map[string]lastKnownStatus),
+	}
+	node := &api.Node{Node: "external"}
+
+	// Only our own failure, no quorum.
+	if agent.probeQuorumFailed(node, false) {
+		t.Fatal("expected no quorum without other observers")
+	}
+
+	// Another observer agrees, quorum reached.
+	other := &Agent{client: client, config: conf, id: "other"}
+	if err := other.recordProbeObservation(node, false, conf.CoordinateUpdateInterval); err != nil {
+		t.Fatal(err)
+	}
+	if !agent.probeQuorumFailed(node, false) {
+		t.Fatal("expected quorum with two failed observations")
+	}
+
+	// Our ping succeeded, so only one observer sees the node as failed.
+	if agent.probeQuorumFailed(node, true) {
+		t.Fatal("expected no quorum with one failed observation")
+	}
+
+	// Stale observations don't count.
+	bytes, _ := json.Marshal(probeObservation{
+		Status: api.HealthCritical,
+		Time:   time.Now().Add(-2 * agent.probeObservationTTL(node, probeObservation{})),
+	})
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   agent.probeObservationsPath(node.Node) + other.serviceID(),
+		Value: bytes,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.probeQuorumFailed(node, false) {
+		t.Fatal("expected stale observation to be ignored")
+	}
+
+	// Observers that backed off keep their observations fresh for longer.
+	bytes, _ = json.Marshal(probeObservation{
+		Status:   api.HealthCritical,
+		Time:     time.Now().Add(-4 * conf.CoordinateUpdateInterval),
+		Interval: 3 * conf.CoordinateUpdateInterval,
+	})
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   agent.probeObservationsPath(node.Node) + other.serviceID(),
+		Value: bytes,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !agent.probeQuorumFailed(node, false) {
+		t.Fatal("expected observation within the observer's interval to count")
+	}
+
+	// Observations are removed once the observer stops pinging the node.
+	other.logger = agent.logger
+	other.removeProbeObservations([]string{node.Node})
+	if agent.probeQuorumFailed(node, false) {
+		t.Fatal("expected removed observation to be ignored")
+	}
+
+	// The quorum lowered by the leader applies.
+	agent.probeQuorum = 1
+	if !agent.probeQuorumFailed(node, false) {
+		t.Fatal("expected quorum lowered by the leader to be reached")
+	}
+}
+
+func TestCoordinate_nodeMetaOverrides(t *testing.T) {
+	conf, err := DefaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &Agent{
+		config: conf,
+		logger: hclog.NewNullLogger(),
+	}
+
+	cases := []struct {
+		name     string
+		meta     map[string]string
+		interval time.Duration
+		timeout  time.Duration
+	}{
+		{
+			"defaults",
+			nil,
+			conf.CoordinateUpdateInterval,
+			conf.NodeReconnectTimeout,
+		},
+		{
+			"overrides",
+			map[string]string{
+				NodeProbeIntervalMetaKey:    "1m",
+				NodeReconnectTimeoutMetaKey: "2h",
+			},
+			time.Minute,
+			2 * time.Hour,
+		},
+		{
+			"invalid values fall back to defaults",
+			map[string]string{
+				NodeProbeIntervalMetaKey:    "often",
+				NodeReconnectTimeoutMetaKey: "-1h",
+			},
+			conf.CoordinateUpdateInterval,
+			conf.NodeReconnectTimeout,
+		},
+		{
+			"probe interval below the minimum",
+			map[string]string{
+				NodeProbeIntervalMetaKey: "10ms",
+			},
+			minimumInterval,
+			conf.NodeReconnectTimeout,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			node := &api.Node{Node: "external", Meta: tc.meta}
+			if got := agent.nodeProbeInterval(node); got != tc.interval {
+				t.Fatalf("bad probe interval: want %v, got %v", tc.interval, got)
+			}
+			if got := agent.nodeReconnectTimeout(node); got != tc.timeout {
+				t.Fatalf("bad reconnect timeout: want %v, got %v", tc.timeout, got)
+			}
+		})
+	}
+}
+
+func TestCoordinate_warnInvalidNodeMeta(t *testing.T) {
+	agent := &Agent{}
+	node := &api.Node{Node: "external", Meta: map[string]string{NodeProbeIntervalMetaKey: "often"}}
+
+	if !agent.warnInvalidNodeMeta(node, NodeProbeIntervalMetaKey) {
+		t.Fatal("expected the first invalid value to be warned about")
+	}
+	if agent.warnInvalidNodeMeta(node, NodeProbeIntervalMetaKey) {
+		t.Fatal("expected the same invalid value not to be warned about again")
+	}
+	if !agent.warnInvalidNodeMeta(node, NodeReconnectTimeoutMetaKey) {
+		t.Fatal("expected another meta key to be warned about")
+	}
+
+	node.Meta[NodeProbeIntervalMetaKey] = "sometimes"
+	if !agent.warnInvalidNodeMeta(node, NodeProbeIntervalMetaKey) {
+		t.Fatal("expected a changed invalid value to be warned about")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+var CoordinateGauges = []prometheus.GaugeDefinition{
+	{
+		Name: []string{"esm", "coordinates", "pending"},
+		Help: "Number of node coordinate updates waiting to be written to Consul",
+	},
+}
+
+// coordinateUpdater queues the coordinate updates computed from pings and
+// writes them to Consul one at a time, at no more than the configured rate.
+// A node has at most one pending update: a newer update replaces the queued
+// one, which is counted as dropped.
+//
+// It also remembers the last coordinate known for each node, so the catalog
+// doesn't need to be read on every ping.
+type coordinateUpdater struct {
+	client  *api.Client
+	logger  hclog.Logger
+	spacing time.Duration
+
+	lock     sync.Mutex
+	known    map[string]*api.CoordinateEntry
+	pending  map[string]*api.CoordinateEntry
+	queue    []string
+	notifyCh chan struct{}
+}
+
+func newCoordinateUpdater(client *api.Client, logger hclog.Logger, config *Config) *coordinateUpdater {
+	u := &coordinateUpdater{
+		client:   client,
+		logger:   logger,
+		known:    make(map[string]*api.CoordinateEntry),
+		pending:  make(map[string]*api.CoordinateEntry),
+		notifyCh: make(chan struct{}, 1),
+	}
+	if config.CoordinateUpdateRateLimit > 0 {
+		u.spacing = time.Duration(float64(time.Second) / config.CoordinateUpdateRateLimit)
+	}
+	return u
+}
+
+// Known returns the last coordinate queued or fetched for the node.
+func (u *coordinateUpdater) Known(node string) (*api.CoordinateEntry, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	entry, ok := u.known[node]
+	return entry, ok
+}
+
+// Remember records the coordinate of a node as read from the catalog, unless
+// a newer one is already known.
+func (u *coordinateUpdater) Remember(entry *api.CoordinateEntry) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if _, ok := u.known[entry.Node]; !ok {
+		u.known[entry.Node] = entry
+	}
+}
+
+// Enqueue queues a coordinate update, replacing any pending update for the
+// same node.
+func (u *coordinateUpdater) Enqueue(entry *api.CoordinateEntry) {
+	u.lock.Lock()
+	u.known[entry.Node] = entry
+	if _, ok := u.pending[entry.Node]; ok {
+		coordinateDropped("merged")
+	} else {
+		u.queue = append(u.queue, entry.Node)
+	}
+	u.pending[entry.Node] = entry
+	metrics.SetGauge([]string{"esm", "coordinates", "pending"}, float32(len(u.pending)))
+	u.lock.Unlock()
+
+	select {
+	case u.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Retain forgets about the nodes that aren't in the given list, dropping
+// their pending updates.
+func (u *coordinateUpdater) Retain(nodes []*api.Node) {
+	keep := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		keep[node.Node] = true
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for name := range u.known {
+		if !keep[name] {
+			delete(u.known, name)
+		}
+	}
+	queue := u.queue[:0]
+	for _, name := range u.queue {
+		if keep[name] {
+			queue = append(queue, name)
+			continue
+		}
+		delete(u.pending, name)
+		coordinateDropped("removed")
+	}
+	u.queue = queue
+	metrics.SetGauge([]string{"esm", "coordinates", "pending"}, float32(len(u.pending)))
+}
+
+// next pops the oldest pending update, or returns nil if there is none.
+func (u *coordinateUpdater) next() *api.CoordinateEntry {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if len(u.queue) == 0 {
+		return nil
+	}
+	name := u.queue[0]
+	u.queue = u.queue[1:]
+	entry := u.pending[name]
+	delete(u.pending, name)
+	metrics.SetGauge([]string{"esm", "coordinates", "pending"}, float32(len(u.pending)))
+	return entry
+}
+
+// forget removes the known coordinate of a node so it is read from the
+// catalog again.
+func (u *coordinateUpdater) forget(node string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.known, node)
+}
+
+// Run is a long running goroutine that writes the queued coordinate updates
+// to Consul.
+func (u *coordinateUpdater) Run(shutdownCh <-chan struct{}) {
+	for {
+		select {
+		case <-u.notifyCh:
+		case <-shutdownCh:
+			return
+		}
+
+		for entry := u.next(); entry != nil; entry = u.next() {
+			if _, err := u.client.Coordinate().Update(entry, nil); err != nil {
+				u.logger.Warn("error applying coordinate update", "node", entry.Node, "error", err)
+				u.forget(entry.Node)
+				coordinateDropped("error")
+			} else {
+				u.logger.Info("Updated coordinates", "node", entry.Node)
+				metrics.IncrCounter([]string{"esm", "coordinates", "applied"}, 1)
+			}
+
+			if u.spacing > 0 {
+				select {
+				case <-time.After(u.spacing):
+				case <-shutdownCh:
+					return
+				}
+			}
+		}
+	}
+}
+
+// coordinateDropped counts a coordinate update that was not written.
+func coordinateDropped(reason string) {
+	metrics.IncrCounterWithLabels([]string{"esm", "coordinates", "dropped"}, 1,
+		[]metrics.Label{{Name: "reason", Value: reason}})
+}
@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/stretchr/testify/require"
+)
+
+func testCoordinateEntry(node string, x float64) *api.CoordinateEntry {
+	coord := coordinate.NewCoordinate(coordinate.DefaultConfig())
+	coord.Vec[0] = x
+	return &api.CoordinateEntry{Node: node, Coord: coord}
+}
+
+func TestCoordinateUpdater_merge(t *testing.T) {
+	u := newCoordinateUpdater(nil, hclog.NewNullLogger(), &Config{})
+
+	u.Enqueue(testCoordinateEntry("a", 1))
+	u.Enqueue(testCoordinateEntry("b", 1))
+	u.Enqueue(testCoordinateEntry("a", 2))
+
+	// The update for "a" keeps its place in the queue but has the newest
+	// coordinate.
+	entry := u.next()
+	require.Equal(t, "a", entry.Node)
+	require.Equal(t, 2.0, entry.Coord.Vec[0])
+	require.Equal(t, "b", u.next().Node)
+	require.Nil(t, u.next())
+
+	// Queued coordinates are known for the next ping.
+	known, ok := u.Known("a")
+	require.True(t, ok)
+	require.Equal(t, 2.0, known.Coord.Vec[0])
+
+	// Coordinates read from the catalog don't replace newer ones.
+	u.Remember(testCoordinateEntry("a", 3))
+	known, _ = u.Known("a")
+	require.Equal(t, 2.0, known.Coord.Vec[0])
+	u.Remember(testCoordinateEntry("c", 3))
+	_, ok = u.Known("c")
+	require.True(t, ok)
+}
+
+func TestCoordinateUpdater_retain(t *testing.T) {
+	u := newCoordinateUpdater(nil, hclog.NewNullLogger(), &Config{})
+
+	u.Enqueue(testCoordinateEntry("a", 1))
+	u.Enqueue(testCoordinateEntry("b", 1))
+	u.Enqueue(testCoordinateEntry("c", 1))
+	u.Retain([]*api.Node{{Node: "b"}})
+
+	require.Equal(t, "b", u.next().Node)
+	require.Nil(t, u.next())
+	_, ok := u.Known("a")
+	require.False(t, ok)
+	_, ok = u.Known("b")
+	require.True(t, ok)
+}
+
+func TestCoordinateUpdater_rateLimit(t *testing.T) {
+	u := newCoordinateUpdater(nil, hclog.NewNullLogger(), &Config{})
+	require.Zero(t, u.spacing)
+
+	u = newCoordinateUpdater(nil, hclog.NewNullLogger(), &Config{
+		CoordinateUpdateRateLimit: 4,
+	})
+	require.Equal(t, 250*time.Millisecond, u.spacing)
+}
@@ -0,0 +1,355 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnsDirective is the check notes directive making a check resolve a
+	// name, given as "<name> [type=<type>] [expect=<value>,...] [min=<n>]".
+	dnsDirective = "esm-dns"
+
+	// defaultDNSTimeout is the timeout of each DNS query, the same as
+	// Consul's TCP checks.
+	defaultDNSTimeout = 10 * time.Second
+)
+
+// dnsRecordTypes are the record types DNS checks can query.
+var dnsRecordTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"NS":    dns.TypeNS,
+	"PTR":   dns.TypePTR,
+	"SRV":   dns.TypeSRV,
+	"TXT":   dns.TypeTXT,
+}
+
+// dnsQuery is the query and the assertions of a DNS check.
+type dnsQuery struct {
+	name       string
+	recordType string
+	expect     []string
+	minAnswers int
+}
+
+// parseDNSDirective parses the value of a DNS check directive. The record
+// type defaults to A, and at least one answer is expected.
+func parseDNSDirective(value string) (dnsQuery, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return dnsQuery{}, fmt.Errorf("the name to resolve must be set")
+	}
+	query := dnsQuery{name: dns.Fqdn(fields[0]), recordType: "A", minAnswers: 1}
+	if _, ok := dns.IsDomainName(query.name); !ok {
+		return dnsQuery{}, fmt.Errorf("%q isn't a valid name", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		name, option, ok := strings.Cut(field, "=")
+		if !ok {
+			return dnsQuery{}, fmt.Errorf("%q isn't an <option>=<value> pair", field)
+		}
+		switch name {
+		case "type":
+			query.recordType = strings.ToUpper(option)
+			if _, ok := dnsRecordTypes[query.recordType]; !ok {
+				return dnsQuery{}, fmt.Errorf("unsupported record type %q", option)
+			}
+		case "expect":
+			for _, expected := range strings.Split(option, ",") {
+				if expected != "" {
+					query.expect = append(query.expect, expected)
+				}
+			}
+		case "min":
+			n, err := strconv.Atoi(option)
+			if err != nil || n < 0 {
+				return dnsQuery{}, fmt.Errorf("min must be a number of answers")
+			}
+			query.minAnswers = n
+		default:
+			return dnsQuery{}, fmt.Errorf("unknown option %q", name)
+		}
+	}
+
+	for i, expected := range query.expect {
+		query.expect[i] = normalizeDNSValue(query.recordType, expected)
+	}
+	return query, nil
+}
+
+// normalizeDNSValue returns the form answers and expected values of the
+// record type are compared in: IPs as parsed, names in lower case without
+// the trailing dot.
+func normalizeDNSValue(recordType, value string) string {
+	switch recordType {
+	case "A", "AAAA":
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String()
+		}
+		return value
+	case "TXT":
+		return value
+	case "SRV":
+		if host, port, err := net.SplitHostPort(value); err == nil {
+			return net.JoinHostPort(normalizeDNSValue("NS", host), port)
+		}
+		return value
+	default:
+		return strings.TrimSuffix(strings.ToLower(value), ".")
+	}
+}
+
+// dnsAnswerValue returns the value of an answer, or false if it isn't of the
+// record type. SRV answers are "<target>:<port>", and TXT answers have
+// their strings joined.
+func dnsAnswerValue(recordType string, rr dns.RR) (string, bool) {
+	var value string
+	switch answer := rr.(type) {
+	case *dns.A:
+		value = answer.A.String()
+	case *dns.AAAA:
+		value = answer.AAAA.String()
+	case *dns.CNAME:
+		value = answer.Target
+	case *dns.MX:
+		value = answer.Mx
+	case *dns.NS:
+		value = answer.Ns
+	case *dns.PTR:
+		value = answer.Ptr
+	case *dns.SRV:
+		value = net.JoinHostPort(answer.Target, strconv.Itoa(int(answer.Port)))
+	case *dns.TXT:
+		value = strings.Join(answer.Txt, "")
+	default:
+		return "", false
+	}
+	if dnsRecordTypes[recordType] != rr.Header().Rrtype {
+		return "", false
+	}
+	return normalizeDNSValue(recordType, value), true
+}
+
+// dnsResolverAddress returns the address of a resolver given as a host or a
+// host and port, defaulting to the DNS port.
+func dnsResolverAddress(resolver string) (string, error) {
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+	}
+	host, port, err := net.SplitHostPort(resolver)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return resolver, nil
+}
+
+// systemDNSResolvers returns the resolvers of /etc/resolv.conf.
+func systemDNSResolvers() ([]string, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]string, 0, len(conf.Servers))
+	for _, server := range conf.Servers {
+		resolvers = append(resolvers, net.JoinHostPort(server, conf.Port))
+	}
+	return resolvers, nil
+}
+
+// Update a DNS check
+func (c *CheckRunner) updateCheckDNS(
+	latestCheck *api.HealthCheck, checkHash types.CheckID,
+	definition *api.HealthCheckDefinition, directive string, updated, added checkIDSet,
+) bool {
+	dnsCheck := &CheckDNS{
+		CheckID:   structs.CheckID{ID: checkHash},
+		Resolvers: c.dnsResolvers,
+		Interval:  definition.IntervalDuration,
+		Timeout:   definition.TimeoutDuration,
+		Logger:    c.logger,
+		Notifier:  c,
+	}
+	dnsCheck.Query, dnsCheck.err = parseDNSDirective(directive)
+
+	if check, checkExists := c.checks.Load(checkHash); checkExists {
+		existing, dnsCheckExists := c.checksDNS.Load(checkHash)
+		if dnsCheckExists &&
+			reflect.DeepEqual(existing.Query, dnsCheck.Query) &&
+			fmt.Sprint(existing.err) == fmt.Sprint(dnsCheck.err) &&
+			slices.Equal(existing.Resolvers, dnsCheck.Resolvers) &&
+			existing.Interval == dnsCheck.Interval &&
+			existing.Timeout == dnsCheck.Timeout &&
+			check.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
+			return false
+		}
+
+		c.logger.Info("Updating DNS check", "checkHash", checkHash)
+
+		if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency: updated DNS check was not running", "checkHash", checkHash)
+			return false
+		}
+
+		updated[checkHash] = true
+	} else {
+		c.logger.Debug("Added DNS check", "checkHash", checkHash)
+		added[checkHash] = true
+	}
+
+	dnsCheck.Start()
+	c.checksDNS.Store(checkHash, dnsCheck)
+
+	return true
+}
+
+// CheckDNS resolves a name against the resolvers, tried in order until one
+// answers, and sets the status from the answers of the record type: critical
+// if the name doesn't resolve, if fewer than the minimum answers are
+// returned or if an expected value is missing.
+type CheckDNS struct {
+	CheckID structs.CheckID
+	Query   dnsQuery
+
+	// Resolvers are the resolvers as hosts or addresses. If empty, the ones
+	// of /etc/resolv.conf are used.
+	Resolvers []string
+
+	Interval time.Duration
+	Timeout  time.Duration
+	Logger   hclog.Logger
+	Notifier consulchecks.CheckNotifier
+
+	// err is the error of an invalid directive, reported as the output.
+	err error
+
+	periodicRunner
+}
+
+// Start is used to start the check. The check runs until stop is called.
+func (c *CheckDNS) Start() {
+	c.start(c.Interval, c.Notifier, c.check)
+}
+
+// RunOnce runs the check right away and passes its result to the notifier.
+func (c *CheckDNS) RunOnce(notifier consulchecks.CheckNotifier) {
+	c.check(notifier)
+}
+
+// check resolves the name and sets the status from the answers.
+func (c *CheckDNS) check(notifier consulchecks.CheckNotifier) {
+	if c.err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical,
+			fmt.Sprintf("Invalid %s directive: %s", dnsDirective, c.err))
+		return
+	}
+
+	prefix := fmt.Sprintf("DNS %s %s", c.Query.recordType, c.Query.name)
+	resolver, resp, rtt, err := c.resolve()
+	if err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("%s: %s", prefix, err))
+		return
+	}
+	prefix += fmt.Sprintf(" via %s", resolver)
+
+	if resp.Rcode != dns.RcodeSuccess {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical,
+			fmt.Sprintf("%s: %s in %s", prefix, dns.RcodeToString[resp.Rcode], rtt))
+		return
+	}
+
+	var answers []string
+	for _, rr := range resp.Answer {
+		if value, ok := dnsAnswerValue(c.Query.recordType, rr); ok {
+			answers = append(answers, value)
+		}
+	}
+	output := fmt.Sprintf("%s: %d answers in %s", prefix, len(answers), rtt)
+	if len(answers) > 0 {
+		output += ": " + strings.Join(answers, ", ")
+	}
+
+	var problems []string
+	if len(answers) < c.Query.minAnswers {
+		problems = append(problems, fmt.Sprintf("expected at least %d answers", c.Query.minAnswers))
+	}
+	var missing []string
+	for _, expected := range c.Query.expect {
+		if !slices.Contains(answers, expected) {
+			missing = append(missing, expected)
+		}
+	}
+	if len(missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(missing, ", "))
+	}
+	if len(problems) > 0 {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, output+"; "+strings.Join(problems, "; "))
+		return
+	}
+	notifier.UpdateCheck(c.CheckID, api.HealthPassing, output)
+}
+
+// resolve sends the query to the resolvers in order until one answers, over
+// TCP if the UDP answer is truncated. It returns the resolver that answered,
+// its answer and how long it took.
+func (c *CheckDNS) resolve() (string, *dns.Msg, time.Duration, error) {
+	resolvers := c.Resolvers
+	if len(resolvers) == 0 {
+		var err error
+		if resolvers, err = systemDNSResolvers(); err != nil {
+			return "", nil, 0, fmt.Errorf("no DNS resolvers: %w", err)
+		}
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(c.Query.name, dnsRecordTypes[c.Query.recordType])
+
+	var errs []string
+	for _, resolver := range resolvers {
+		resolver, err := dnsResolverAddress(resolver)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		client := &dns.Client{Timeout: timeout}
+		resp, rtt, err := client.Exchange(msg, resolver)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			resp, rtt, err = client.Exchange(msg, resolver)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", resolver, err))
+			continue
+		}
+		return resolver, resp, rtt.Round(time.Millisecond), nil
+	}
+	return "", nil, 0, fmt.Errorf("no resolver answered: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,196 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// testDNSServer starts a UDP DNS server answering from the records, keyed by
+// name, and NXDOMAIN for any other name. It returns its address.
+func testDNSServer(t *testing.T, records map[string][]string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			name := req.Question[0].Name
+			if _, ok := records[name]; !ok {
+				resp.Rcode = dns.RcodeNameError
+			}
+			for _, record := range records[name] {
+				rr, err := dns.NewRR(name + " 60 IN " + record)
+				require.NoError(t, err)
+				resp.Answer = append(resp.Answer, rr)
+			}
+			w.WriteMsg(resp)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestParseDNSDirective(t *testing.T) {
+	query, err := parseDNSDirective("api.example.com")
+	require.NoError(t, err)
+	require.Equal(t, dnsQuery{name: "api.example.com.", recordType: "A", minAnswers: 1}, query)
+
+	query, err = parseDNSDirective("_imap._tcp.example.com type=srv expect=Mail.Example.com.:993 min=2")
+	require.NoError(t, err)
+	require.Equal(t, dnsQuery{
+		name:       "_imap._tcp.example.com.",
+		recordType: "SRV",
+		expect:     []string{"mail.example.com:993"},
+		minAnswers: 2,
+	}, query)
+
+	for value, expected := range map[string]string{
+		"":                         "the name to resolve must be set",
+		"api.example.com A":        `"A" isn't an <option>=<value> pair`,
+		"api.example.com type=SOA": `unsupported record type "SOA"`,
+		"api.example.com min=-1":   "min must be a number of answers",
+		"api.example.com ttl=60":   `unknown option "ttl"`,
+	} {
+		_, err := parseDNSDirective(value)
+		require.EqualError(t, err, expected, value)
+	}
+}
+
+func TestDNSResolverAddress(t *testing.T) {
+	for resolver, expected := range map[string]string{
+		"10.0.0.2":        "10.0.0.2:53",
+		"10.0.0.2:5353":   "10.0.0.2:5353",
+		"dns.example.com": "dns.example.com:53",
+		"2001:db8::53":    "[2001:db8::53]:53",
+		"[2001:db8::53]":  "[2001:db8::53]:53",
+	} {
+		address, err := dnsResolverAddress(resolver)
+		require.NoError(t, err, resolver)
+		require.Equal(t, expected, address)
+	}
+
+	_, err := dnsResolverAddress(":53")
+	require.EqualError(t, err, "missing host")
+}
+
+func TestCheckDNS(t *testing.T) {
+	resolver := testDNSServer(t, map[string][]string{
+		"api.example.com.":   {"A 203.0.113.10", "A 203.0.113.11"},
+		"www.example.com.":   {"CNAME api.example.com.", "A 203.0.113.10"},
+		"example.com.":       {"MX 10 Mail.Example.com.", `TXT "v=spf1 " "-all"`},
+		"empty.example.com.": {},
+	})
+
+	run := func(directive string, resolvers ...string) *recordingNotifier {
+		check := &CheckDNS{
+			CheckID:   structs.CheckID{ID: "external/partner-api/dns"},
+			Resolvers: resolvers,
+			Timeout:   time.Second,
+			Logger:    hclog.NewNullLogger(),
+		}
+		check.Query, check.err = parseDNSDirective(directive)
+		notifier := &recordingNotifier{}
+		check.RunOnce(notifier)
+		return notifier
+	}
+
+	notifier := run("api.example.com expect=203.0.113.11 min=2", resolver)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Regexp(t, `^DNS A api.example.com. via 127.0.0.1:\d+: 2 answers in \d+m?s: 203.0.113.10, 203.0.113.11$`, notifier.output)
+
+	// Records of other types in the answer, like CNAMEs, aren't counted.
+	notifier = run("www.example.com min=2", resolver)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "1 answers")
+	require.Contains(t, notifier.output, "; expected at least 2 answers")
+
+	notifier = run("api.example.com expect=203.0.113.10,198.51.100.1", resolver)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "; missing 198.51.100.1")
+
+	notifier = run("example.com type=MX expect=mail.example.com", resolver)
+	require.Equal(t, api.HealthPassing, notifier.status)
+
+	notifier = run("example.com type=TXT min=1", resolver)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Contains(t, notifier.output, ": v=spf1 -all")
+
+	notifier = run("empty.example.com min=0", resolver)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Contains(t, notifier.output, "0 answers")
+
+	notifier = run("missing.example.com", resolver)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Regexp(t, `^DNS A missing.example.com. via 127.0.0.1:\d+: NXDOMAIN in \d+m?s$`, notifier.output)
+
+	// The resolvers are tried in order until one answers.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	notifier = run("api.example.com", closedAddr, resolver)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Contains(t, notifier.output, "via "+resolver)
+
+	notifier = run("api.example.com", closedAddr)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "DNS A api.example.com.: no resolver answered: "+closedAddr)
+
+	notifier = run("api.example.com type=SOA", resolver)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Equal(t, `Invalid esm-dns directive: unsupported record type "SOA"`, notifier.output)
+}
+
+func TestCheck_DNS(t *testing.T) {
+	runner := NewCheckRunner(hclog.NewNullLogger(), nil, 0, 0, &tls.Config{}, 0, 0)
+	defer runner.Stop()
+	runner.dnsResolvers = []string{"10.0.0.2"}
+
+	checks := api.HealthChecks{
+		{
+			Node:       "external",
+			CheckID:    "partner-dns",
+			Notes:      "esm-dns: api.partner.example.com min=2",
+			Definition: api.HealthCheckDefinition{IntervalDuration: time.Hour},
+		},
+	}
+	hash := hashCheck(checks[0])
+
+	runner.UpdateChecks(checks)
+	dnsCheck, ok := runner.checksDNS.Load(hash)
+	require.True(t, ok)
+	require.Equal(t, "api.partner.example.com.", dnsCheck.Query.name)
+	require.Equal(t, 2, dnsCheck.Query.minAnswers)
+	require.Equal(t, []string{"10.0.0.2"}, dnsCheck.Resolvers)
+
+	// Unchanged checks are left running.
+	runner.UpdateChecks(checks)
+	unchanged, ok := runner.checksDNS.Load(hash)
+	require.True(t, ok)
+	require.Same(t, dnsCheck, unchanged)
+
+	// Without the directive, it isn't a valid check anymore.
+	checks[0].Notes = ""
+	runner.UpdateChecks(checks)
+	_, ok = runner.checksDNS.Load(hash)
+	require.False(t, ok)
+}
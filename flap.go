@@ -0,0 +1,105 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+)
+
+// flapDetector tracks the percentage of state changes over a check's recent
+// results, the way Nagios does. A check starts flapping once the percentage
+// reaches the high threshold and stops once it falls below the low one.
+//
+// A nil flapDetector is valid and never reports flapping.
+type flapDetector struct {
+	history       int
+	highThreshold float64
+	lowThreshold  float64
+
+	results  []string
+	next     int
+	flapping bool
+}
+
+func newFlapDetector(history int, highThreshold, lowThreshold float64) *flapDetector {
+	return &flapDetector{
+		history:       history,
+		highThreshold: highThreshold,
+		lowThreshold:  lowThreshold,
+		results:       make([]string, 0, history),
+	}
+}
+
+// Record adds a result and returns whether the check is flapping, and whether
+// that changed with this result. A check can only start flapping once the
+// history is full.
+func (f *flapDetector) Record(status string) (flapping, changed bool) {
+	if f == nil {
+		return false, false
+	}
+	if len(f.results) < f.history {
+		f.results = append(f.results, status)
+	} else {
+		f.results[f.next] = status
+		f.next = (f.next + 1) % f.history
+	}
+
+	percent := f.Percent()
+	switch {
+	case !f.flapping && len(f.results) == f.history && percent >= f.highThreshold:
+		f.flapping = true
+		return true, true
+	case f.flapping && percent < f.lowThreshold:
+		f.flapping = false
+		return false, true
+	}
+	return f.flapping, false
+}
+
+// Percent returns the percentage of state changes between the recorded
+// results.
+func (f *flapDetector) Percent() float64 {
+	if f == nil || len(f.results) < 2 {
+		return 0
+	}
+	changes := 0
+	for i := 1; i < len(f.results); i++ {
+		// The oldest result is at f.next once the history is full, and at 0
+		// until then.
+		prev := f.results[(f.next+i-1)%len(f.results)]
+		if f.results[(f.next+i)%len(f.results)] != prev {
+			changes++
+		}
+	}
+	return float64(changes) * 100 / float64(len(f.results)-1)
+}
+
+// Reset forgets the recorded results and stops flapping.
+func (f *flapDetector) Reset() {
+	if f == nil {
+		return
+	}
+	f.results = f.results[:0]
+	f.next = 0
+	f.flapping = false
+}
+
+// flapDetectorFor returns the flap detector of a check, keeping the previous
+// one if the settings didn't change. Nil if flap detection is disabled.
+func (c *CheckRunner) flapDetectorFor(previous *flapDetector) *flapDetector {
+	if c.FlapHistory == 0 {
+		return nil
+	}
+	if previous != nil && previous.history == c.FlapHistory &&
+		previous.highThreshold == c.FlapHighThreshold && previous.lowThreshold == c.FlapLowThreshold {
+		return previous
+	}
+	return newFlapDetector(c.FlapHistory, c.FlapHighThreshold, c.FlapLowThreshold)
+}
+
+// flappingOutput is the output of a check pinned because it's flapping.
+func flappingOutput(percent float64, history int, status, output string) string {
+	return fmt.Sprintf("Check is flapping: %.1f%% state changes over the last %d results, "+
+		"status is held until it settles. Last result (%s): %s", percent, history, status, output)
+}
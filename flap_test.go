@@ -0,0 +1,140 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlapDetector(t *testing.T) {
+	// A nil detector never reports flapping.
+	var flap *flapDetector
+	flapping, changed := flap.Record(api.HealthCritical)
+	require.False(t, flapping)
+	require.False(t, changed)
+
+	flap = newFlapDetector(5, 50, 25)
+
+	// A check can't start flapping before the history is full.
+	for _, status := range []string{api.HealthPassing, api.HealthCritical, api.HealthPassing, api.HealthCritical} {
+		flapping, changed = flap.Record(status)
+		require.False(t, flapping)
+		require.False(t, changed)
+	}
+	require.Equal(t, 100.0, flap.Percent())
+
+	flapping, changed = flap.Record(api.HealthPassing)
+	require.True(t, flapping)
+	require.True(t, changed)
+
+	// It keeps flapping until the percentage falls below the low threshold.
+	for _, percent := range []float64{75, 50, 25} {
+		flapping, changed = flap.Record(api.HealthPassing)
+		require.True(t, flapping)
+		require.False(t, changed)
+		require.Equal(t, percent, flap.Percent())
+	}
+	flapping, changed = flap.Record(api.HealthPassing)
+	require.False(t, flapping)
+	require.True(t, changed)
+	require.Zero(t, flap.Percent())
+
+	flap.Reset()
+	require.Zero(t, flap.Percent())
+}
+
+func TestCheck_Flapping(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	runner.FlapHistory = 5
+	runner.FlapHighThreshold = 50
+	runner.FlapLowThreshold = 25
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Status:  api.HealthPassing,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://service.local/health",
+				IntervalDuration: time.Hour,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+
+	hash := hashCheck(checks[0])
+	id := structs.CheckID{ID: hash}
+	check, ok := runner.checks.Load(hash)
+	require.True(t, ok)
+
+	catalogCheck := func() *api.HealthCheck {
+		checks, _, err := client.Health().Node("external", nil)
+		require.NoError(t, err)
+		require.Len(t, checks, 1)
+		return checks[0]
+	}
+
+	// Once flapping, the check keeps its status with an output saying so,
+	// and the transitions aren't written.
+	for _, status := range []string{api.HealthPassing, api.HealthCritical, api.HealthPassing, api.HealthCritical} {
+		runner.UpdateCheck(id, status, status)
+	}
+	require.Equal(t, api.HealthCritical, catalogCheck().Status)
+	runner.UpdateCheck(id, api.HealthPassing, "up")
+	flapping := catalogCheck()
+	require.Equal(t, api.HealthCritical, flapping.Status)
+	require.True(t, strings.HasPrefix(flapping.Output, "Check is flapping"), flapping.Output)
+
+	runner.UpdateCheck(id, api.HealthCritical, "down")
+	runner.UpdateCheck(id, api.HealthPassing, "up")
+	require.Equal(t, flapping.ModifyIndex, catalogCheck().ModifyIndex)
+
+	// Once it settles, the latest result is written.
+	for i := 0; i < 3; i++ {
+		runner.UpdateCheck(id, api.HealthPassing, "up")
+		require.Equal(t, api.HealthCritical, check.Status)
+	}
+	runner.UpdateCheck(id, api.HealthPassing, "up")
+	settled := catalogCheck()
+	require.Equal(t, api.HealthPassing, settled.Status)
+	require.Equal(t, "up", settled.Output)
+	require.Equal(t, api.HealthPassing, check.Status)
+}
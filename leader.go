@@ -18,6 +18,13 @@ import (
 type NodeWatchList struct {
 	Nodes  []string
 	Probes []string
+	// Observe holds probe nodes owned by another agent that this agent pings
+	// only to contribute an observation towards the node's quorum.
+	Observe []string
+	// Quorum is the number of failed observations needed to mark the probe
+	// nodes critical, lowered to the number of observers there are. Zero if
+	// written by a leader that doesn't set it.
+	Quorum int `json:",omitempty"`
 }
 
 var LeaderGauges = []prometheus.GaugeDefinition{
@@ -153,6 +160,39 @@ func nodeLists(nodes []*api.Node, insts []*api.ServiceEntry,
 	return healthNodes, pingNodes
 }
 
+// observerLists builds the lists of probe nodes each agent should ping as an
+// additional observer, on top of the agent that owns the node's probe in
+// nodeLists. Each probe node gets up to observers-1 extra agents.
+func observerLists(nodes []*api.Node, insts []*api.ServiceEntry, observers int,
+) map[string][]string {
+	observeNodes := make(map[string][]string)
+	if observers > len(insts) {
+		observers = len(insts)
+	}
+	for i, node := range nodes {
+		if node.Meta == nil || node.Meta["external-probe"] != "true" {
+			continue
+		}
+		for offset := 1; offset < observers; offset++ {
+			agentID := insts[(i+offset)%len(insts)].Service.ID
+			observeNodes[agentID] = append(observeNodes[agentID], node.Node)
+		}
+	}
+	return observeNodes
+}
+
+// probeQuorum returns the quorum of failed observations a probe node needs,
+// which can't be more than the agents observing it.
+func probeQuorum(quorum, observers, instances int) int {
+	if observers > instances {
+		observers = instances
+	}
+	if quorum > observers {
+		return observers
+	}
+	return quorum
+}
+
 func (a *Agent) commitOps(ops api.KVTxnOps) bool {
 	success, results, _, err := a.client.KV().Txn(ops, a.ConsulQueryOption())
 	if err != nil || !success {
@@ -180,6 +220,8 @@ func (a *Agent) computeWatchedNodes(stopCh <-chan struct{}) {
 
 	var prevHealthNodes map[string][]string
 	var prevPingNodes map[string][]string
+	var prevObserveNodes map[string][]string
+	prevQuorum := a.config.NodeProbeQuorum
 
 	// Avoid blocking on first pass
 	retryTimer := time.After(0)
@@ -205,6 +247,15 @@ WATCH_NODES_WAIT:
 		}
 
 		healthNodes, pingNodes := nodeLists(externalNodes, healthyInstances)
+		observeNodes := observerLists(externalNodes, healthyInstances, a.config.NodeProbeObservers)
+		quorum := probeQuorum(a.config.NodeProbeQuorum, a.config.NodeProbeObservers, len(healthyInstances))
+		if quorum != prevQuorum {
+			if quorum < a.config.NodeProbeQuorum {
+				a.logger.Warn("Fewer ESM instances than node_probe_quorum, lowering the quorum",
+					"instances", len(healthyInstances), "quorum", quorum)
+			}
+			prevQuorum = quorum
+		}
 
 		// Write the KV update as a transaction.
 		kvOps := &api.KVTxnOp{
@@ -219,8 +270,10 @@ WATCH_NODES_WAIT:
 		}
 		for _, agent := range healthyInstances {
 			bytes, _ := json.Marshal(NodeWatchList{
-				Nodes:  healthNodes[agent.Service.ID],
-				Probes: pingNodes[agent.Service.ID],
+				Nodes:   healthNodes[agent.Service.ID],
+				Probes:  pingNodes[agent.Service.ID],
+				Observe: observeNodes[agent.Service.ID],
+				Quorum:  quorum,
 			})
 			op := &api.KVTxnOp{
 				Verb:  api.KVSet,
@@ -249,10 +302,12 @@ WATCH_NODES_WAIT:
 		}
 
 		// Log a message when the balancing changes.
-		if !reflect.DeepEqual(healthNodes, prevHealthNodes) || !reflect.DeepEqual(pingNodes, prevPingNodes) {
+		if !reflect.DeepEqual(healthNodes, prevHealthNodes) || !reflect.DeepEqual(pingNodes, prevPingNodes) ||
+			!reflect.DeepEqual(observeNodes, prevObserveNodes) {
 			a.logger.Info("Rebalanced external nodes across ESM instances", "nodes", len(externalNodes), "instances", len(healthyInstances))
 			prevHealthNodes = healthNodes
 			prevPingNodes = pingNodes
+			prevObserveNodes = observeNodes
 		}
 	}
 }
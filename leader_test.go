@@ -428,6 +428,79 @@ func TestLeader_nodeLists(t *testing.T) {
 	}
 }
 
+func TestLeader_observerLists(t *testing.T) {
+	nodes := []*api.Node{
+		{
+			Node: "node1",
+			Meta: map[string]string{"external-probe": "true"},
+		},
+		{
+			Node: "node2",
+			Meta: map[string]string{"external-probe": "false"},
+		},
+		{
+			Node: "node3",
+			Meta: map[string]string{"external-probe": "true"},
+		},
+	}
+	insts := []*api.ServiceEntry{
+		{Service: &api.AgentService{ID: "service1"}},
+		{Service: &api.AgentService{ID: "service2"}},
+		{Service: &api.AgentService{ID: "service3"}},
+	}
+
+	// A single observer means only the owning agent pings the node.
+	if observe := observerLists(nodes, insts, 1); len(observe) != 0 {
+		t.Fatalf("expected no observers, got %v", observe)
+	}
+
+	// node1 is owned by service1 and node3 by service3.
+	expected := map[string][]string{
+		"service1": {"node3"},
+		"service2": {"node1"},
+	}
+	if observe := observerLists(nodes, insts, 2); !reflect.DeepEqual(observe, expected) {
+		t.Fatalf("bad: want %v, got %v", expected, observe)
+	}
+
+	// Asking for more observers than agents is capped.
+	expected = map[string][]string{
+		"service1": {"node3"},
+		"service2": {"node1", "node3"},
+		"service3": {"node1"},
+	}
+	_, ping := nodeLists(nodes, insts)
+	if observe := observerLists(nodes, insts, 5); !reflect.DeepEqual(observe, expected) {
+		t.Fatalf("bad: want %v, got %v", expected, observe)
+	}
+	for agentID, probes := range ping {
+		for _, node := range probes {
+			for _, observed := range expected[agentID] {
+				if observed == node {
+					t.Fatalf("agent %s both owns and observes %s", agentID, node)
+				}
+			}
+		}
+	}
+}
+
+func TestLeader_probeQuorum(t *testing.T) {
+	cases := []struct {
+		quorum, observers, instances, expected int
+	}{
+		{2, 3, 3, 2},
+		{2, 3, 5, 2},
+		{3, 3, 2, 2},
+		{2, 3, 1, 1},
+	}
+	for _, c := range cases {
+		if quorum := probeQuorum(c.quorum, c.observers, c.instances); quorum != c.expected {
+			t.Fatalf("quorum %d with %d observers and %d instances: want %d, got %d",
+				c.quorum, c.observers, c.instances, c.expected, quorum)
+		}
+	}
+}
+
 const namespacesJSON = `[
   { "Name": "default", "Description": "Builtin Default Namespace" },
   { "Name": "foo", "Description": "foo" }
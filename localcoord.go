@@ -0,0 +1,163 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// CoordinateSourceAgent uses the coordinate of the local Consul agent.
+	CoordinateSourceAgent = "agent"
+	// CoordinateSourceServers computes a coordinate by pinging the Consul
+	// servers, for when there is no local agent.
+	CoordinateSourceServers = "servers"
+	// CoordinateSourceAnchor uses the coordinate of a node in the catalog.
+	CoordinateSourceAnchor = "anchor"
+)
+
+// coordinateSource returns the configured coordinate source, defaulting to the
+// Consul servers in agentless mode and to the local agent otherwise.
+func (a *Agent) coordinateSource() string {
+	if a.config.CoordinateSource != "" {
+		return a.config.CoordinateSource
+	}
+	if a.isAgentLess() {
+		return CoordinateSourceServers
+	}
+	return CoordinateSourceAgent
+}
+
+// maintainLocalCoordinate is a long running goroutine that refreshes the
+// cached coordinate of this agent once per CoordinateUpdateInterval.
+func (a *Agent) maintainLocalCoordinate() {
+	for {
+		if _, err := a.refreshLocalCoordinate(); err != nil {
+			a.logger.Warn("could not refresh local coordinate", "source", a.coordinateSource(), "error", err)
+		}
+
+		select {
+		case <-time.After(a.config.CoordinateUpdateInterval):
+		case <-a.shutdownCh:
+			return
+		}
+	}
+}
+
+// localCoordinate returns the cached coordinate of this agent, fetching it if
+// it hasn't been yet.
+func (a *Agent) localCoordinate() (*coordinate.Coordinate, error) {
+	a.localCoordLock.RLock()
+	coord := a.localCoord
+	a.localCoordLock.RUnlock()
+	if coord != nil {
+		return coord, nil
+	}
+	return a.refreshLocalCoordinate()
+}
+
+// refreshLocalCoordinate fetches the coordinate of this agent from the
+// configured source and caches it.
+func (a *Agent) refreshLocalCoordinate() (*coordinate.Coordinate, error) {
+	var coord *coordinate.Coordinate
+	var err error
+	switch a.coordinateSource() {
+	case CoordinateSourceServers:
+		coord, err = a.serversCoordinate()
+	case CoordinateSourceAnchor:
+		coord, err = a.nodeCoordinate(a.config.CoordinateAnchorNode, a.ConsulQueryOption())
+	default:
+		coord, err = a.agentCoordinate()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.localCoordLock.Lock()
+	a.localCoord = coord
+	a.localCoordLock.Unlock()
+	return coord, nil
+}
+
+// agentCoordinate returns the coordinate of the local Consul agent.
+func (a *Agent) agentCoordinate() (*coordinate.Coordinate, error) {
+	self, err := a.client.Agent().Self()
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve local agent's coordinate info: %v", err)
+	}
+
+	coordInfo, ok := self["Coord"]
+	if !ok {
+		return nil, errors.New("local agent has no coordinate info")
+	}
+
+	var coord coordinate.Coordinate
+	if err := mapstructure.Decode(coordInfo, &coord); err != nil {
+		return nil, fmt.Errorf("could not decode local agent's coordinate info: %v", err)
+	}
+	return &coord, nil
+}
+
+// nodeCoordinate returns the LAN coordinate of the given node in the catalog.
+func (a *Agent) nodeCoordinate(node string, opts *api.QueryOptions) (*coordinate.Coordinate, error) {
+	coords, _, err := a.client.Coordinate().Node(node, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting coordinate for node %q: %v", node, err)
+	}
+	if len(coords) == 0 || coords[0].Coord == nil {
+		return nil, fmt.Errorf("node %q has no coordinate", node)
+	}
+	return coords[0].Coord, nil
+}
+
+// serversCoordinate pings the Consul servers and feeds the round trip times
+// into this agent's own Vivaldi client, the same way an agent computes its
+// coordinate from its peers.
+func (a *Agent) serversCoordinate() (*coordinate.Coordinate, error) {
+	// Servers are always registered in the default partition.
+	opts := &api.QueryOptions{}
+	a.HasPartition(func(string) {
+		opts.Partition = "default"
+	})
+	servers, _, err := a.client.Catalog().Service("consul", "", opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not list Consul servers: %v", err)
+	}
+
+	a.localCoordLock.Lock()
+	if a.coordClient == nil {
+		a.coordClient, _ = coordinate.NewClient(coordinate.DefaultConfig())
+	}
+	client := a.coordClient
+	a.localCoordLock.Unlock()
+
+	updated := 0
+	for _, server := range servers {
+		rtt, err := pingNode(server.Address, a.config.PingType)
+		if err != nil {
+			a.logger.Debug("could not ping Consul server", "node", server.Node, "error", err)
+			continue
+		}
+		serverCoord, err := a.nodeCoordinate(server.Node, opts)
+		if err != nil {
+			a.logger.Debug("could not get Consul server coordinate", "node", server.Node, "error", err)
+			continue
+		}
+		if _, err := client.Update(server.Node, serverCoord, rtt); err != nil {
+			a.logger.Debug("could not update coordinate from Consul server", "node", server.Node, "error", err)
+			continue
+		}
+		updated++
+	}
+	if updated == 0 {
+		return nil, fmt.Errorf("could not update coordinate from any of %d Consul servers", len(servers))
+	}
+	return client.GetCoordinate(), nil
+}
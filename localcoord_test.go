@@ -0,0 +1,127 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalCoord_coordinateSource(t *testing.T) {
+	cases := []struct {
+		source    string
+		agentless bool
+		expected  string
+	}{
+		{"", false, CoordinateSourceAgent},
+		{"", true, CoordinateSourceServers},
+		{CoordinateSourceAnchor, true, CoordinateSourceAnchor},
+		{CoordinateSourceServers, false, CoordinateSourceServers},
+	}
+
+	for _, tc := range cases {
+		agent := &Agent{config: &Config{
+			CoordinateSource: tc.source,
+			EnableAgentless:  tc.agentless,
+		}}
+		require.Equal(t, tc.expected, agent.coordinateSource())
+	}
+}
+
+func TestLocalCoord_sources(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the server and an anchor node known coordinates.
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "anchor",
+		Address:    "127.0.0.1",
+		Datacenter: "dc1",
+	}, nil)
+	require.NoError(t, err)
+
+	anchorCoord := coordinate.NewCoordinate(coordinate.DefaultConfig())
+	anchorCoord.Vec[0] = 0.25
+	serverCoord := coordinate.NewCoordinate(coordinate.DefaultConfig())
+	serverCoord.Vec[0] = 0.5
+	retry.Run(t, func(r *retry.R) {
+		for node, coord := range map[string]*coordinate.Coordinate{
+			"anchor":          anchorCoord,
+			s.Config.NodeName: serverCoord,
+		} {
+			if _, err := client.Coordinate().Update(&api.CoordinateEntry{Node: node, Coord: coord}, nil); err != nil {
+				r.Fatal(err)
+			}
+			coords, _, err := client.Coordinate().Node(node, nil)
+			if err != nil {
+				r.Fatal(err)
+			}
+			if len(coords) == 0 || coords[0].Coord.Vec[0] != coord.Vec[0] {
+				r.Fatalf("coordinate for %q not updated yet", node)
+			}
+		}
+	})
+
+	conf, err := DefaultConfig()
+	require.NoError(t, err)
+
+	agent := &Agent{
+		client: client,
+		config: conf,
+		logger: hclog.New(&hclog.LoggerOptions{
+			Name:            "consul-esm",
+			Level:           hclog.LevelFromString("INFO"),
+			IncludeLocation: true,
+			Output:          LOGOUT,
+		}),
+		knownNodeStatuses: make(map[string]lastKnownStatus),
+	}
+
+	t.Run("anchor", func(t *testing.T) {
+		conf.CoordinateSource = CoordinateSourceAnchor
+		conf.CoordinateAnchorNode = "anchor"
+		coord, err := agent.refreshLocalCoordinate()
+		require.NoError(t, err)
+		require.Equal(t, anchorCoord.Vec, coord.Vec)
+
+		conf.CoordinateAnchorNode = "missing"
+		_, err = agent.refreshLocalCoordinate()
+		require.Error(t, err)
+	})
+
+	t.Run("servers", func(t *testing.T) {
+		conf.CoordinateSource = CoordinateSourceServers
+		coord, err := agent.refreshLocalCoordinate()
+		require.NoError(t, err)
+
+		// Our own coordinate moved away from the origin towards the server.
+		origin := coordinate.NewCoordinate(coordinate.DefaultConfig())
+		require.NotEqual(t, origin.Vec, coord.Vec)
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		cached := coordinate.NewCoordinate(coordinate.DefaultConfig())
+		agent.localCoordLock.Lock()
+		agent.localCoord = cached
+		agent.localCoordLock.Unlock()
+
+		coord, err := agent.localCoordinate()
+		require.NoError(t, err)
+		require.Same(t, cached, coord)
+	})
+}
@@ -27,6 +27,7 @@ func main() {
 	// Handle parsing the CLI flags.
 	var configFiles AppendSliceValue
 	var isVersion bool
+	var restoreNode string
 
 	f := flag.NewFlagSet("", flag.ContinueOnError)
 	f.Var(&configFiles, "config-file", "A config file to use. Can be either .hcl or .json "+
@@ -35,6 +36,8 @@ func main() {
 		"Can be specified multiple times.")
 	f.BoolVar(&isVersion, "v", false, "")
 	f.BoolVar(&isVersion, "version", false, "Print the version of this daemon.")
+	f.StringVar(&restoreNode, "restore-node", "", "Restore a node quarantined by the "+
+		"\"quarantine\" node_reap_policy to the catalog and exit.")
 
 	f.Usage = func() {
 		f.SetOutput(os.Stdout)
@@ -83,6 +86,14 @@ func main() {
 		panic(err)
 	}
 
+	if restoreNode != "" {
+		if err := agent.RestoreNode(restoreNode); err != nil {
+			fmt.Println(err)
+			os.Exit(ExitCodeError)
+		}
+		os.Exit(ExitCodeOK)
+	}
+
 	// Consul compatibility is only verified at startup. If new Consul servers
 	// join later with incompatible versions, inconsistent results may occur with
 	// updating health checks for external services.
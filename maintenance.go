@@ -0,0 +1,432 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// MaintenanceMetaKey puts a node or service in maintenance mode when set
+	// in its meta, see parseMaintenanceMeta.
+	MaintenanceMetaKey = "external-maintenance"
+
+	// defaultMaintenanceReason is used when no reason was given, matching the
+	// message of Consul agents.
+	defaultMaintenanceReason = "Maintenance mode is enabled, but no reason was " +
+		"provided. This is a default message."
+)
+
+// maintenanceWindow is a maintenance marker, from meta or from a KV entry under
+// <KVPath>maintenance/. Start and End are optional and make it a scheduled
+// window.
+type maintenanceWindow struct {
+	Reason string
+	Start  time.Time
+	End    time.Time
+}
+
+// active returns true if the window covers the given time.
+func (w maintenanceWindow) active(now time.Time) bool {
+	return (w.Start.IsZero() || !now.Before(w.Start)) && (w.End.IsZero() || now.Before(w.End))
+}
+
+// parseMaintenanceWindow decodes the value of a maintenance KV entry, which
+// is either a JSON encoded maintenanceWindow or a plain text reason.
+func parseMaintenanceWindow(value []byte) maintenanceWindow {
+	var window maintenanceWindow
+	if err := json.Unmarshal(value, &window); err != nil {
+		window = maintenanceWindow{Reason: strings.TrimSpace(string(value))}
+	}
+	return window
+}
+
+// parseMaintenanceMeta returns the maintenance marker of a MaintenanceMetaKey
+// meta value, or false if the value turns maintenance off: a false boolean
+// such as "false" or "0", "no" or "off". True booleans use the default
+// reason, and any other value is the reason.
+func parseMaintenanceMeta(value string) (maintenanceWindow, bool) {
+	value = strings.TrimSpace(value)
+	if on, err := strconv.ParseBool(strings.ToLower(value)); err == nil {
+		return maintenanceWindow{}, on
+	}
+	switch strings.ToLower(value) {
+	case "no", "off":
+		return maintenanceWindow{}, false
+	case "yes", "on":
+		return maintenanceWindow{}, true
+	}
+	return maintenanceWindow{Reason: value}, true
+}
+
+// maintenanceKey returns the key of a node's or service's markers.
+func maintenanceKey(node, serviceID string) string {
+	if serviceID == "" {
+		return node
+	}
+	return node + "/" + serviceID
+}
+
+// isMaintenanceCheck returns true for the checks marking a node or service
+// as in maintenance.
+func isMaintenanceCheck(checkID string) bool {
+	return checkID == api.NodeMaint || strings.HasPrefix(checkID, api.ServiceMaintPrefix)
+}
+
+// Sources of maintenance markers, in the order their reasons take precedence.
+const (
+	maintenanceSourceKV          = "kv"
+	maintenanceSourceNodeMeta    = "node-meta"
+	maintenanceSourceServiceMeta = "service-meta"
+)
+
+var maintenanceSources = []string{
+	maintenanceSourceKV,
+	maintenanceSourceNodeMeta,
+	maintenanceSourceServiceMeta,
+}
+
+// maintenanceTracker holds the maintenance markers of the external nodes and
+// services by source, and how long the reap timers have been frozen for.
+//
+// A nil maintenanceTracker is valid and never reports maintenance.
+type maintenanceTracker struct {
+	lock    sync.Mutex
+	markers map[string]map[string][]maintenanceWindow
+	ticks   map[string]time.Time
+
+	// changed is signaled when the markers change.
+	changed chan struct{}
+}
+
+func newMaintenanceTracker() *maintenanceTracker {
+	return &maintenanceTracker{
+		markers: make(map[string]map[string][]maintenanceWindow),
+		ticks:   make(map[string]time.Time),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Reason returns the reason the node, or the service if serviceID is set, is
+// in maintenance at the given time. A service is in maintenance when its node
+// is.
+func (m *maintenanceTracker) Reason(node, serviceID string, now time.Time) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	if reason, ok := m.marker(maintenanceKey(node, ""), now); ok {
+		return reason, true
+	}
+	if serviceID != "" {
+		return m.marker(maintenanceKey(node, serviceID), now)
+	}
+	return "", false
+}
+
+// marker returns the reason of the first active marker with the given key.
+func (m *maintenanceTracker) marker(key string, now time.Time) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, source := range maintenanceSources {
+		for _, window := range m.markers[source][key] {
+			if window.active(now) {
+				if window.Reason == "" || window.Reason == "true" {
+					return defaultMaintenanceReason, true
+				}
+				return window.Reason, true
+			}
+		}
+	}
+	return "", false
+}
+
+// nextChange returns the earliest start or end of a scheduled window after
+// the given time, when the maintenance of a node or service changes.
+func (m *maintenanceTracker) nextChange(now time.Time) (time.Time, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var next time.Time
+	for _, markers := range m.markers {
+		for _, windows := range markers {
+			for _, window := range windows {
+				for _, t := range []time.Time{window.Start, window.End} {
+					if t.After(now) && (next.IsZero() || t.Before(next)) {
+						next = t
+					}
+				}
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Freeze returns how long the timer with the given key has been frozen for
+// since the last call, which the caller pushes the timer forward by.
+func (m *maintenanceTracker) Freeze(key string, now time.Time) time.Duration {
+	if m == nil {
+		return 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	last, ok := m.ticks[key]
+	m.ticks[key] = now
+	if !ok {
+		return 0
+	}
+	return now.Sub(last)
+}
+
+// Thaw stops tracking the frozen timer with the given key.
+func (m *maintenanceTracker) Thaw(key string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.ticks, key)
+}
+
+// set replaces the markers of the given source, and signals changed if they
+// changed.
+func (m *maintenanceTracker) set(source string, markers map[string][]maintenanceWindow) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if reflect.DeepEqual(m.markers[source], markers) {
+		return
+	}
+	m.markers[source] = markers
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// kvMaintenancePath returns the path to the KV directory where maintenance
+// markers are written, as <node> or <node>/<serviceID>.
+func (a *Agent) kvMaintenancePath() string {
+	return a.config.KVPath + "maintenance/"
+}
+
+// watchMaintenance is a long running goroutine that keeps the maintenance
+// markers up to date with blocking queries, and the maintenance checks of our
+// nodes and services in sync with them. Our checks are received from
+// watchHealthChecks.
+func (a *Agent) watchMaintenance(checksCh chan api.HealthChecks) {
+	go a.watchBlocking("refreshing maintenance markers in KV", a.refreshMaintenanceKV)
+	go a.watchBlocking("refreshing maintenance markers in node meta", a.refreshMaintenanceNodeMeta)
+	go a.watchBlocking("refreshing maintenance markers in service meta", a.refreshMaintenanceServiceMeta)
+
+	var checks api.HealthChecks
+	var next <-chan time.Time
+	for {
+		select {
+		case <-a.shutdownCh:
+			return
+		case checks = <-checksCh:
+		case <-a.maintenance.changed:
+		case <-next:
+		}
+
+		now := time.Now()
+		if err := a.syncMaintenanceChecks(checks, now); err != nil {
+			a.logger.Warn("Error updating maintenance checks", "error", err)
+			next = time.After(retryTime)
+			continue
+		}
+
+		// Sync again when a scheduled window starts or ends.
+		next = nil
+		if at, ok := a.maintenance.nextChange(now); ok {
+			next = time.After(at.Sub(now))
+		}
+	}
+}
+
+// refreshMaintenanceKV reads the maintenance markers from the KV store.
+func (a *Agent) refreshMaintenanceKV(opts *api.QueryOptions) (*api.QueryMeta, error) {
+	prefix := a.kvMaintenancePath()
+	pairs, meta, err := a.client.KV().List(prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	markers := make(map[string][]maintenanceWindow)
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, prefix)
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		markers[key] = append(markers[key], parseMaintenanceWindow(pair.Value))
+	}
+	a.maintenance.set(maintenanceSourceKV, markers)
+	return meta, nil
+}
+
+// refreshMaintenanceNodeMeta reads the maintenance markers from the meta of
+// the external nodes.
+func (a *Agent) refreshMaintenanceNodeMeta(opts *api.QueryOptions) (*api.QueryMeta, error) {
+	opts.NodeMeta = a.config.NodeMeta
+	opts.Filter = `"` + MaintenanceMetaKey + `" in Meta`
+	nodes, meta, err := a.client.Catalog().Nodes(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	markers := make(map[string][]maintenanceWindow)
+	for _, node := range nodes {
+		if window, ok := parseMaintenanceMeta(node.Meta[MaintenanceMetaKey]); ok {
+			key := maintenanceKey(node.Node, "")
+			markers[key] = append(markers[key], window)
+		}
+	}
+	a.maintenance.set(maintenanceSourceNodeMeta, markers)
+	return meta, nil
+}
+
+// refreshMaintenanceServiceMeta reads the maintenance markers from the meta
+// of the services of the external nodes. Only the services having one are
+// looked up.
+func (a *Agent) refreshMaintenanceServiceMeta(opts *api.QueryOptions) (*api.QueryMeta, error) {
+	opts.NodeMeta = a.config.NodeMeta
+	opts.Filter = `"` + MaintenanceMetaKey + `" in ServiceMeta`
+	services, meta, err := a.client.Catalog().Services(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	markers := make(map[string][]maintenanceWindow)
+	instanceOpts := *opts
+	instanceOpts.WaitIndex = 0
+	for name := range services {
+		instances, _, err := a.client.Catalog().Service(name, "", &instanceOpts)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			if window, ok := parseMaintenanceMeta(instance.ServiceMeta[MaintenanceMetaKey]); ok {
+				key := maintenanceKey(instance.Node, instance.ServiceID)
+				markers[key] = append(markers[key], window)
+			}
+		}
+	}
+	a.maintenance.set(maintenanceSourceServiceMeta, markers)
+	return meta, nil
+}
+
+// syncMaintenanceChecks registers a critical maintenance check, the same as
+// the one set by Consul agents, on each of our nodes and services in
+// maintenance, and removes it once they leave maintenance. A service whose
+// node is in maintenance only gets the node check. Our nodes and services
+// are found through the given checks of our nodes.
+func (a *Agent) syncMaintenanceChecks(checks api.HealthChecks, now time.Time) error {
+	targets := make(map[string]*api.HealthCheck)
+	existing := make(map[string]*api.HealthCheck)
+	for _, check := range checks {
+		targets[maintenanceKey(check.Node, "")] = &api.HealthCheck{
+			Node:      check.Node,
+			Namespace: check.Namespace,
+			Partition: check.Partition,
+		}
+		key := maintenanceKey(check.Node, check.ServiceID)
+		targets[key] = check
+		if isMaintenanceCheck(check.CheckID) {
+			existing[key] = check
+		}
+	}
+
+	var ops api.TxnOps
+	for key, target := range targets {
+		reason, ok := a.maintenance.marker(key, now)
+		if target.ServiceID != "" {
+			if _, nodeMaint := a.maintenance.marker(target.Node, now); nodeMaint {
+				ok = false
+			}
+		}
+
+		current, exists := existing[key]
+		switch {
+		case ok && (!exists || current.Output != reason):
+			ops = append(ops, a.maintenanceCheckOp(api.CheckSet, target, reason))
+		case !ok && exists:
+			ops = append(ops, a.maintenanceCheckOp(api.CheckDelete, target, ""))
+		}
+	}
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maximumTransactionSize {
+			n = maximumTransactionSize
+		}
+		if err := a.runClientTxn(ops[:n]); err != nil {
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// maintenanceCheckOp returns the transaction operation to set or delete the
+// maintenance check of a node, or of a service if ServiceID is set.
+func (a *Agent) maintenanceCheckOp(verb api.CheckOp, target *api.HealthCheck, reason string) *api.TxnOp {
+	check := api.HealthCheck{
+		Node:      target.Node,
+		CheckID:   api.NodeMaint,
+		Name:      "Node Maintenance Mode",
+		Status:    api.HealthCritical,
+		Notes:     reason,
+		Output:    reason,
+		Namespace: target.Namespace,
+		Partition: target.Partition,
+	}
+	if target.ServiceID != "" {
+		check.CheckID = api.ServiceMaintPrefix + target.ServiceID
+		check.Name = "Service Maintenance Mode"
+		check.ServiceID = target.ServiceID
+		check.ServiceName = target.ServiceName
+	}
+	if verb == api.CheckSet {
+		a.logger.Info("Setting maintenance mode", "node", check.Node, "serviceID", check.ServiceID, "reason", reason)
+	} else {
+		a.logger.Info("Clearing maintenance mode", "node", check.Node, "serviceID", check.ServiceID)
+	}
+	return &api.TxnOp{Check: &api.CheckTxnOp{Verb: verb, Check: check}}
+}
+
+// freezeNodeReapTimer pushes the critical start time of a node in maintenance
+// forward by the time spent in maintenance since the last probe, so it isn't
+// reaped for being unreachable during maintenance.
+func (a *Agent) freezeNodeReapTimer(node string, kvClient *api.KV, key string, kvPair *api.KVPair) error {
+	frozen := a.maintenance.Freeze(key, time.Now())
+	if kvPair == nil || frozen == 0 {
+		return nil
+	}
+
+	var criticalStart time.Time
+	if err := criticalStart.GobDecode(kvPair.Value); err != nil {
+		return err
+	}
+	value, err := criticalStart.Add(frozen).GobEncode()
+	if err != nil {
+		return err
+	}
+	kvPair.Value = value
+	if _, _, err := kvClient.CAS(kvPair, nil); err != nil {
+		return err
+	}
+	a.logger.Debug("Froze reap timer of node in maintenance", "node", node, "frozen", frozen)
+	return nil
+}
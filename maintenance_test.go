@@ -0,0 +1,432 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance_tracker(t *testing.T) {
+	now := time.Now()
+
+	// A nil tracker never reports maintenance.
+	var tracker *maintenanceTracker
+	_, ok := tracker.Reason("node", "", now)
+	require.False(t, ok)
+
+	tracker = newMaintenanceTracker()
+	scheduled, err := json.Marshal(maintenanceWindow{
+		Reason: "patching",
+		Start:  now.Add(time.Hour),
+		End:    now.Add(2 * time.Hour),
+	})
+	require.NoError(t, err)
+	tracker.set(maintenanceSourceKV, map[string][]maintenanceWindow{
+		"node1": {parseMaintenanceWindow([]byte("disk swap\n"))},
+		"node2": {parseMaintenanceWindow(scheduled)},
+	})
+	require.Len(t, tracker.changed, 1)
+	tracker.set(maintenanceSourceServiceMeta, map[string][]maintenanceWindow{
+		"node3/web1": {{Reason: "true"}},
+	})
+
+	reason, ok := tracker.Reason("node1", "", now)
+	require.True(t, ok)
+	require.Equal(t, "disk swap", reason)
+
+	// Services are in maintenance along with their node.
+	reason, ok = tracker.Reason("node1", "web1", now)
+	require.True(t, ok)
+	require.Equal(t, "disk swap", reason)
+
+	// Scheduled windows only apply between their start and end.
+	_, ok = tracker.Reason("node2", "", now)
+	require.False(t, ok)
+	reason, ok = tracker.Reason("node2", "", now.Add(90*time.Minute))
+	require.True(t, ok)
+	require.Equal(t, "patching", reason)
+	_, ok = tracker.Reason("node2", "", now.Add(2*time.Hour))
+	require.False(t, ok)
+
+	// A service in maintenance doesn't put its node in maintenance.
+	reason, ok = tracker.Reason("node3", "web1", now)
+	require.True(t, ok)
+	require.Equal(t, defaultMaintenanceReason, reason)
+	_, ok = tracker.Reason("node3", "", now)
+	require.False(t, ok)
+	_, ok = tracker.Reason("node3", "web2", now)
+	require.False(t, ok)
+
+	// Sources are only signaled as changed when they are.
+	<-tracker.changed
+	tracker.set(maintenanceSourceServiceMeta, map[string][]maintenanceWindow{
+		"node3/web1": {{Reason: "true"}},
+	})
+	require.Empty(t, tracker.changed)
+
+	// The checks are synced again when the scheduled window starts and ends.
+	next, ok := tracker.nextChange(now)
+	require.True(t, ok)
+	require.True(t, now.Add(time.Hour).Equal(next))
+	next, ok = tracker.nextChange(now.Add(time.Hour))
+	require.True(t, ok)
+	require.True(t, now.Add(2*time.Hour).Equal(next))
+	_, ok = tracker.nextChange(now.Add(2 * time.Hour))
+	require.False(t, ok)
+
+	// Frozen timers report the time since the last call until thawed.
+	require.Zero(t, tracker.Freeze("node1", now))
+	require.Equal(t, time.Minute, tracker.Freeze("node1", now.Add(time.Minute)))
+	tracker.Thaw("node1")
+	require.Zero(t, tracker.Freeze("node1", now.Add(2*time.Minute)))
+}
+
+func TestParseMaintenanceMeta(t *testing.T) {
+	cases := []struct {
+		value  string
+		on     bool
+		reason string
+	}{
+		{"true", true, ""},
+		{"1", true, ""},
+		{"Yes", true, ""},
+		{"", true, ""},
+		{"rack move", true, "rack move"},
+		{" firmware upgrade ", true, "firmware upgrade"},
+		{"false", false, ""},
+		{"FALSE", false, ""},
+		{"fAlSe", false, ""},
+		{"0", false, ""},
+		{"no", false, ""},
+		{"Off", false, ""},
+	}
+	for _, tc := range cases {
+		window, on := parseMaintenanceMeta(tc.value)
+		require.Equal(t, tc.on, on, tc.value)
+		require.Equal(t, tc.reason, window.Reason, tc.value)
+	}
+}
+
+func TestMaintenance_syncChecks(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Register an external node with a service and an http check.
+	nodeMeta := map[string]string{"external-node": "true"}
+	registration := &api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Service: &api.AgentService{
+			ID:      "web1",
+			Service: "web",
+		},
+		Check: &api.AgentCheck{
+			Node:      "external",
+			CheckID:   "web-http",
+			Name:      "web-http",
+			ServiceID: "web1",
+			Status:    api.HealthPassing,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://service.local/health",
+				IntervalDuration: 10 * time.Second,
+			},
+		},
+	}
+	_, err = client.Catalog().Register(registration, nil)
+	require.NoError(t, err)
+
+	conf, err := DefaultConfig()
+	require.NoError(t, err)
+
+	agent := &Agent{
+		client: client,
+		config: conf,
+		logger: hclog.New(&hclog.LoggerOptions{
+			Name:            "consul-esm",
+			Level:           hclog.LevelFromString("INFO"),
+			IncludeLocation: true,
+			Output:          LOGOUT,
+		}),
+		knownNodeStatuses: make(map[string]lastKnownStatus),
+		maintenance:       newMaintenanceTracker(),
+	}
+
+	sync := func() api.HealthChecks {
+		_, err := agent.refreshMaintenanceKV(agent.ConsulQueryOption())
+		require.NoError(t, err)
+		_, err = agent.refreshMaintenanceNodeMeta(agent.ConsulQueryOption())
+		require.NoError(t, err)
+		_, err = agent.refreshMaintenanceServiceMeta(agent.ConsulQueryOption())
+		require.NoError(t, err)
+		checks, _, err := client.Health().Node("external", nil)
+		require.NoError(t, err)
+		require.NoError(t, agent.syncMaintenanceChecks(checks, time.Now()))
+		checks, _, err = client.Health().Node("external", nil)
+		require.NoError(t, err)
+		return checks
+	}
+	findCheck := func(checks api.HealthChecks, checkID string) *api.HealthCheck {
+		for _, check := range checks {
+			if check.CheckID == checkID {
+				return check
+			}
+		}
+		return nil
+	}
+
+	// Put the service in maintenance through the KV store.
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   agent.kvMaintenancePath() + "external/web1",
+		Value: []byte("deploying"),
+	}, nil)
+	require.NoError(t, err)
+
+	checks := sync()
+	serviceMaint := findCheck(checks, api.ServiceMaintPrefix+"web1")
+	require.NotNil(t, serviceMaint)
+	require.Equal(t, api.HealthCritical, serviceMaint.Status)
+	require.Equal(t, "deploying", serviceMaint.Output)
+	require.Equal(t, "web1", serviceMaint.ServiceID)
+	require.Equal(t, api.HealthMaint, checks.AggregatedStatus())
+
+	// Putting the node in maintenance through its meta replaces the service
+	// check with the node check.
+	registration.NodeMeta = map[string]string{"external-node": "true", MaintenanceMetaKey: "rack move"}
+	registration.Service, registration.Check = nil, nil
+	_, err = client.Catalog().Register(registration, nil)
+	require.NoError(t, err)
+
+	checks = sync()
+	require.Nil(t, findCheck(checks, api.ServiceMaintPrefix+"web1"))
+	nodeMaint := findCheck(checks, api.NodeMaint)
+	require.NotNil(t, nodeMaint)
+	require.Equal(t, "rack move", nodeMaint.Output)
+
+	// Clearing the markers removes the maintenance checks.
+	registration.NodeMeta = nodeMeta
+	_, err = client.Catalog().Register(registration, nil)
+	require.NoError(t, err)
+	_, err = client.KV().Delete(agent.kvMaintenancePath()+"external/web1", nil)
+	require.NoError(t, err)
+
+	checks = sync()
+	require.Len(t, checks, 1)
+	require.Equal(t, "web-http", checks[0].CheckID)
+
+	// A false value turns maintenance off.
+	registration.NodeMeta = map[string]string{"external-node": "true", MaintenanceMetaKey: "false"}
+	_, err = client.Catalog().Register(registration, nil)
+	require.NoError(t, err)
+
+	checks = sync()
+	require.Nil(t, findCheck(checks, api.NodeMaint))
+
+	// Services are put in maintenance through their meta too.
+	registration.Service = &api.AgentService{
+		ID:      "web1",
+		Service: "web",
+		Meta:    map[string]string{MaintenanceMetaKey: "cert rotation"},
+	}
+	_, err = client.Catalog().Register(registration, nil)
+	require.NoError(t, err)
+
+	checks = sync()
+	serviceMaint = findCheck(checks, api.ServiceMaintPrefix+"web1")
+	require.NotNil(t, serviceMaint)
+	require.Equal(t, "cert rotation", serviceMaint.Output)
+}
+
+func TestMaintenance_pausesChecks(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	runner.maintenance = newMaintenanceTracker()
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Status:  api.HealthCritical,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             server.URL,
+				IntervalDuration: 20 * time.Millisecond,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+
+	hash := hashCheck(checks[0])
+	id := structs.CheckID{ID: hash}
+	ok := false
+	var criticalTime time.Time
+	require.Eventually(t, func() bool {
+		criticalTime, ok = runner.checksCritical.Load(hash)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The check stops running while the node is in maintenance, stray
+	// results are ignored, and the reap timer is pushed forward by the time
+	// spent in maintenance.
+	runner.maintenance.set(maintenanceSourceKV, map[string][]maintenanceWindow{"external": {{}}})
+	runner.UpdateChecks(checks)
+	_, running := runner.checksHTTP.Load(hash)
+	require.False(t, running)
+
+	// Consul's checks don't wait for a request in flight to stop.
+	time.Sleep(50 * time.Millisecond)
+	check, ok := runner.checks.Load(hash)
+	require.True(t, ok)
+	require.True(t, check.paused)
+	paused := requests.Load()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, paused, requests.Load())
+	runner.UpdateCheck(id, api.HealthPassing, "up")
+	check, ok = runner.checks.Load(hash)
+	require.True(t, ok)
+	require.Equal(t, api.HealthCritical, check.Status)
+
+	// Once the maintenance is over, the check runs again and its results
+	// are applied.
+	runner.maintenance.set(maintenanceSourceKV, nil)
+	runner.UpdateChecks(checks)
+	frozenTime, ok := runner.checksCritical.Load(hash)
+	require.True(t, ok)
+	require.GreaterOrEqual(t, frozenTime.Sub(criticalTime), 150*time.Millisecond)
+	healthy.Store(true)
+	retry.Run(t, func(r *retry.R) {
+		if check, ok := runner.checks.Load(hash); !ok || check.paused {
+			r.Fatal("expected check to be resumed")
+		}
+		checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+		if err != nil {
+			r.Fatal(err)
+		}
+		if len(checks) != 1 || checks[0].Status != api.HealthPassing {
+			r.Fatalf("expected: %v, got: %v", api.HealthPassing, checks)
+		}
+	})
+	require.Greater(t, requests.Load(), paused)
+}
+
+func TestMaintenance_freezeNodeReapTimer(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   map[string]string{"external-node": "true"},
+	}, nil)
+	require.NoError(t, err)
+
+	conf, err := DefaultConfig()
+	require.NoError(t, err)
+
+	agent := &Agent{
+		client: client,
+		config: conf,
+		logger: hclog.New(&hclog.LoggerOptions{
+			Name:            "consul-esm",
+			Level:           hclog.LevelFromString("INFO"),
+			IncludeLocation: true,
+			Output:          LOGOUT,
+		}),
+		knownNodeStatuses: make(map[string]lastKnownStatus),
+		maintenance:       newMaintenanceTracker(),
+	}
+
+	// Fail the node to start its reap timer.
+	node := &api.Node{Node: "external"}
+	kvClient := client.KV()
+	require.NoError(t, agent.updateFailedNode(node, kvClient, "testkey", nil))
+	criticalStart := func() time.Time {
+		kvPair, _, err := kvClient.Get("testkey", nil)
+		require.NoError(t, err)
+		require.NotNil(t, kvPair)
+		var start time.Time
+		require.NoError(t, start.GobDecode(kvPair.Value))
+		return start
+	}
+	start := criticalStart()
+
+	// The first probe in maintenance starts the freeze, the next ones push
+	// the critical start forward.
+	for i := 0; i < 2; i++ {
+		kvPair, _, err := kvClient.Get("testkey", nil)
+		require.NoError(t, err)
+		require.NoError(t, agent.freezeNodeReapTimer(node.Node, kvClient, "testkey", kvPair))
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Greater(t, criticalStart().Sub(start), 90*time.Millisecond)
+}
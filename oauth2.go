@@ -0,0 +1,256 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	// oauth2Directive is the check notes directive naming the OAuth2 client
+	// whose access token is sent with an HTTP check.
+	oauth2Directive = "esm-oauth2"
+
+	// oauth2ExpiryDelta is how long before their expiry tokens are renewed,
+	// so they don't expire in flight.
+	oauth2ExpiryDelta = 10 * time.Second
+
+	// oauth2DefaultLifetime is how long tokens without an expires_in are
+	// reused.
+	oauth2DefaultLifetime = 5 * time.Minute
+)
+
+// OAuth2Client is an OAuth2 client whose access tokens, obtained with the
+// client credentials grant, are sent with the HTTP checks referencing it.
+// ClientSecret may be a secret reference, like check headers.
+type OAuth2Client struct {
+	Name         string   `mapstructure:"name"`
+	TokenURL     string   `mapstructure:"token_url"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	Scopes       []string `mapstructure:"scopes"`
+
+	// AuthStyle sends the client credentials in an HTTP Basic "header",
+	// the default, or in the request body "params".
+	AuthStyle string `mapstructure:"auth_style"`
+}
+
+// validate returns an error if the client can't be used.
+func (o OAuth2Client) validate() error {
+	if o.Name == "" {
+		return fmt.Errorf("oauth2_client name must be set")
+	}
+	if u, err := url.Parse(o.TokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("oauth2_client %q token_url must be an http or https URL", o.Name)
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("oauth2_client %q client_id must be set", o.Name)
+	}
+	switch o.AuthStyle {
+	case "", "header", "params":
+	default:
+		return fmt.Errorf("oauth2_client %q auth_style must be \"header\" or \"params\"", o.Name)
+	}
+	return nil
+}
+
+// oauth2Token is a cached access token.
+type oauth2Token struct {
+	accessToken string
+	tokenType   string
+	expiry      time.Time
+}
+
+// authorization returns the Authorization header value of the token.
+func (t oauth2Token) authorization() string {
+	tokenType := t.tokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + t.accessToken
+}
+
+// oauth2Tokens fetches and caches the access tokens of the OAuth2 clients.
+// Tokens are renewed shortly before they expire, or when a check using one
+// gets a 401 Unauthorized.
+type oauth2Tokens struct {
+	clients    map[string]OAuth2Client
+	secrets    *secretResolver
+	transport  *reloadableTransport
+	httpClient *http.Client
+
+	tokens     map[string]oauth2Token
+	tokensLock sync.Mutex
+
+	// fetchLocks serialize the token requests of each client, so concurrent
+	// checks wait for the same request without holding up other clients.
+	fetchLocks map[string]*sync.Mutex
+}
+
+// newOAuth2Tokens returns the token cache of the clients. Token requests use
+// the TLS config and proxies of the checks. Nil if there are no clients.
+func newOAuth2Tokens(clients []OAuth2Client, secrets *secretResolver, tlsConfig *tls.Config, proxies *proxyRules) *oauth2Tokens {
+	if len(clients) == 0 {
+		return nil
+	}
+
+	trans := cleanhttp.DefaultPooledTransport()
+	trans.TLSClientConfig = tlsConfig
+	trans.Proxy = proxies.transportProxy()
+	transport := newReloadableTransport(trans)
+
+	o := &oauth2Tokens{
+		clients:    make(map[string]OAuth2Client, len(clients)),
+		secrets:    secrets,
+		transport:  transport,
+		httpClient: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		tokens:     make(map[string]oauth2Token),
+		fetchLocks: make(map[string]*sync.Mutex, len(clients)),
+	}
+	for _, client := range clients {
+		o.clients[client.Name] = client
+		o.fetchLocks[client.Name] = &sync.Mutex{}
+	}
+	return o
+}
+
+// Token returns a valid access token of the named client, fetching a new one
+// if needed.
+func (o *oauth2Tokens) Token(name string) (oauth2Token, error) {
+	if o == nil {
+		return oauth2Token{}, fmt.Errorf("unknown OAuth2 client %q", name)
+	}
+	client, ok := o.clients[name]
+	if !ok {
+		return oauth2Token{}, fmt.Errorf("unknown OAuth2 client %q", name)
+	}
+
+	if token, ok := o.cached(name); ok {
+		return token, nil
+	}
+
+	// Another check may have fetched the token while we were waiting.
+	fetchLock := o.fetchLocks[name]
+	fetchLock.Lock()
+	defer fetchLock.Unlock()
+	if token, ok := o.cached(name); ok {
+		return token, nil
+	}
+
+	token, err := o.fetch(client)
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("OAuth2 token request for client %q failed: %w", name, err)
+	}
+	o.tokensLock.Lock()
+	o.tokens[name] = token
+	o.tokensLock.Unlock()
+	return token, nil
+}
+
+// cached returns the cached token of the named client, if it doesn't expire
+// soon.
+func (o *oauth2Tokens) cached(name string) (oauth2Token, bool) {
+	o.tokensLock.Lock()
+	defer o.tokensLock.Unlock()
+	token, ok := o.tokens[name]
+	return token, ok && time.Now().Add(oauth2ExpiryDelta).Before(token.expiry)
+}
+
+// setTLSConfig replaces the TLS config of the token requests.
+func (o *oauth2Tokens) setTLSConfig(tlsConfig *tls.Config) {
+	if o != nil {
+		o.transport.setTLSConfig(tlsConfig)
+	}
+}
+
+// Invalidate drops the cached token of the named client, if it's still the
+// given one.
+func (o *oauth2Tokens) Invalidate(name, accessToken string) {
+	if o == nil {
+		return
+	}
+	o.tokensLock.Lock()
+	defer o.tokensLock.Unlock()
+	if token, ok := o.tokens[name]; ok && token.accessToken == accessToken {
+		delete(o.tokens, name)
+	}
+}
+
+// fetch requests a token with the client credentials grant.
+func (o *oauth2Tokens) fetch(client OAuth2Client) (oauth2Token, error) {
+	secret, _, err := o.secrets.Resolve(client.ClientSecret)
+	if err != nil {
+		return oauth2Token{}, err
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(client.Scopes) > 0 {
+		form.Set("scope", strings.Join(client.Scopes, " "))
+	}
+	if client.AuthStyle == "params" {
+		form.Set("client_id", client.ClientID)
+		form.Set("client_secret", secret)
+	}
+	req, err := http.NewRequest("POST", client.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if client.AuthStyle != "params" {
+		req.SetBasicAuth(url.QueryEscape(client.ClientID), url.QueryEscape(secret))
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return oauth2Token{}, err
+	}
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	jsonErr := json.Unmarshal(body, &result)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if jsonErr == nil && result.Error != "" {
+			return oauth2Token{}, fmt.Errorf("%s: %s", resp.Status,
+				strings.TrimSpace(result.Error+" "+result.ErrorDescription))
+		}
+		return oauth2Token{}, fmt.Errorf("%s", resp.Status)
+	}
+	if jsonErr != nil {
+		return oauth2Token{}, fmt.Errorf("invalid token response: %w", jsonErr)
+	}
+	if result.AccessToken == "" {
+		return oauth2Token{}, fmt.Errorf("token response has no access_token")
+	}
+
+	lifetime := oauth2DefaultLifetime
+	if result.ExpiresIn > 0 {
+		lifetime = time.Duration(result.ExpiresIn) * time.Second
+	}
+	return oauth2Token{
+		accessToken: result.AccessToken,
+		tokenType:   result.TokenType,
+		expiry:      time.Now().Add(lifetime),
+	}, nil
+}
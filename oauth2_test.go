@@ -0,0 +1,215 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// testTokenServer is an OAuth2 token endpoint issuing numbered tokens to the
+// "esm" client with the "s3cr3t" secret.
+type testTokenServer struct {
+	*httptest.Server
+	expiresIn int
+	lock      sync.Mutex
+	issued    int
+	requests  []http.Request
+}
+
+func newTestTokenServer(t *testing.T, expiresIn int) *testTokenServer {
+	s := &testTokenServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		require.NoError(t, r.ParseForm())
+		s.requests = append(s.requests, *r)
+
+		clientID, secret, ok := r.BasicAuth()
+		if !ok {
+			clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("grant_type") != "client_credentials" || clientID != "esm" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"bad credentials"}`))
+			return
+		}
+		s.issued++
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("token-%d", s.issued),
+			"token_type":   "bearer",
+			"expires_in":   s.expiresIn,
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestOAuth2Tokens(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "client-secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cr3t\n"), 0o600))
+	secrets := newSecretResolver(nil, hclog.NewNullLogger(), &Config{SecretDirs: []string{dir}}, nil)
+
+	server := newTestTokenServer(t, 3600)
+	tokens := newOAuth2Tokens([]OAuth2Client{
+		{
+			Name:         "partner",
+			TokenURL:     server.URL + "/token",
+			ClientID:     "esm",
+			ClientSecret: "${file:" + secretFile + "}",
+			Scopes:       []string{"health:read", "status"},
+		},
+		{
+			Name:         "params",
+			TokenURL:     server.URL + "/token",
+			ClientID:     "esm",
+			ClientSecret: "s3cr3t",
+			AuthStyle:    "params",
+		},
+		{
+			Name:         "invalid",
+			TokenURL:     server.URL + "/token",
+			ClientID:     "esm",
+			ClientSecret: "wrong",
+		},
+	}, secrets, &tls.Config{}, nil)
+
+	// Tokens are cached until they expire.
+	token, err := tokens.Token("partner")
+	require.NoError(t, err)
+	require.Equal(t, "Bearer token-1", token.authorization())
+	token, err = tokens.Token("partner")
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token.accessToken)
+	require.Len(t, server.requests, 1)
+	require.Equal(t, "health:read status", server.requests[0].PostForm.Get("scope"))
+
+	// Invalidating an old token keeps the current one.
+	tokens.Invalidate("partner", "token-0")
+	token, err = tokens.Token("partner")
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token.accessToken)
+	tokens.Invalidate("partner", "token-1")
+	token, err = tokens.Token("partner")
+	require.NoError(t, err)
+	require.Equal(t, "token-2", token.accessToken)
+
+	token, err = tokens.Token("params")
+	require.NoError(t, err)
+	require.Equal(t, "token-3", token.accessToken)
+
+	_, err = tokens.Token("invalid")
+	require.EqualError(t, err,
+		`OAuth2 token request for client "invalid" failed: 401 Unauthorized: invalid_client bad credentials`)
+
+	_, err = tokens.Token("missing")
+	require.EqualError(t, err, `unknown OAuth2 client "missing"`)
+
+	var none *oauth2Tokens
+	_, err = none.Token("partner")
+	require.EqualError(t, err, `unknown OAuth2 client "partner"`)
+}
+
+func TestOAuth2Tokens_expiry(t *testing.T) {
+	// Tokens expiring within oauth2ExpiryDelta are renewed.
+	server := newTestTokenServer(t, 5)
+	tokens := newOAuth2Tokens([]OAuth2Client{{
+		Name:         "partner",
+		TokenURL:     server.URL,
+		ClientID:     "esm",
+		ClientSecret: "s3cr3t",
+	}}, nil, &tls.Config{}, nil)
+
+	token, err := tokens.Token("partner")
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token.accessToken)
+	token, err = tokens.Token("partner")
+	require.NoError(t, err)
+	require.Equal(t, "token-2", token.accessToken)
+}
+
+func TestOAuth2Tokens_concurrent(t *testing.T) {
+	// Concurrent checks share a single token request.
+	server := newTestTokenServer(t, 3600)
+	tokens := newOAuth2Tokens([]OAuth2Client{{
+		Name:         "partner",
+		TokenURL:     server.URL,
+		ClientID:     "esm",
+		ClientSecret: "s3cr3t",
+	}}, nil, &tls.Config{}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := tokens.Token("partner")
+			require.NoError(t, err)
+			require.Equal(t, "token-1", token.accessToken)
+		}()
+	}
+	wg.Wait()
+	require.Len(t, server.requests, 1)
+}
+
+func TestCheckHTTPESM_OAuth2(t *testing.T) {
+	tokenServer := newTestTokenServer(t, 3600)
+	tokens := newOAuth2Tokens([]OAuth2Client{
+		{Name: "partner", TokenURL: tokenServer.URL, ClientID: "esm", ClientSecret: "s3cr3t"},
+		{Name: "invalid", TokenURL: tokenServer.URL, ClientID: "esm", ClientSecret: "wrong"},
+	}, nil, &tls.Config{}, nil)
+
+	// The target revokes the first token.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Write([]byte("authorization: " + r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	run := func(client string) *recordingNotifier {
+		notifier := &recordingNotifier{}
+		check := &CheckHTTPESM{
+			CheckID:         structs.CheckID{ID: "oauth2"},
+			HTTP:            server.URL,
+			Interval:        time.Hour,
+			Logger:          hclog.NewNullLogger(),
+			TLSClientConfig: &tls.Config{},
+			OAuth2Client:    client,
+			OAuth2:          tokens,
+		}
+		check.RunOnce(notifier)
+		return notifier
+	}
+
+	notifier := run("partner")
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "401 Unauthorized Output: authorization: Bearer [redacted]")
+
+	notifier = run("partner")
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.NotContains(t, notifier.output, "token-2")
+
+	notifier = run("invalid")
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Equal(t,
+		`OAuth2 token request for client "invalid" failed: 401 Unauthorized: invalid_client bad credentials`,
+		notifier.output)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/lib"
+)
+
+// periodicRunner runs a check ESM runs itself, in place of Consul's checks,
+// until it's stopped. The checks embed it, which provides their Stop, and
+// start it with their check func.
+type periodicRunner struct {
+	stop     bool
+	stopCh   chan struct{}
+	stopLock sync.Mutex
+	stopWg   sync.WaitGroup
+}
+
+// start runs check every interval, passing its results to the notifier. The
+// first run is after a random stagger, so the checks added at once don't all
+// run together.
+func (r *periodicRunner) start(interval time.Duration, notifier consulchecks.CheckNotifier,
+	check func(consulchecks.CheckNotifier)) {
+	r.startLoop(func(stopCh <-chan struct{}) {
+		next := time.After(lib.RandomStagger(interval))
+		for {
+			select {
+			case <-next:
+				check(notifier)
+				next = time.After(interval)
+			case <-stopCh:
+				return
+			}
+		}
+	})
+}
+
+// startLoop runs loop in a goroutine, for the checks that don't run
+// periodically. The loop must return once stopCh is closed.
+func (r *periodicRunner) startLoop(loop func(stopCh <-chan struct{})) {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+
+	r.stop = false
+	r.stopCh = make(chan struct{})
+	r.stopWg.Add(1)
+	go func(stopCh <-chan struct{}) {
+		defer r.stopWg.Done()
+		loop(stopCh)
+	}(r.stopCh)
+}
+
+// Stop is used to stop the check.
+func (r *periodicRunner) Stop() {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+	if !r.stop {
+		r.stop = true
+		if r.stopCh != nil {
+			close(r.stopCh)
+		}
+	}
+
+	// Wait for the loop goroutine to complete before returning.
+	r.stopWg.Wait()
+}
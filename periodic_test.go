@@ -0,0 +1,57 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeriodicRunner(t *testing.T) {
+	t.Parallel()
+
+	var runs atomic.Int32
+	var runner periodicRunner
+	runner.start(10*time.Millisecond, &recordingNotifier{}, func(consulchecks.CheckNotifier) {
+		runs.Add(1)
+	})
+	require.Eventually(t, func() bool { return runs.Load() >= 3 }, time.Second, 5*time.Millisecond)
+
+	runner.Stop()
+	stopped := runs.Load()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, stopped, runs.Load(), "check ran after Stop")
+
+	// Stopping again is a no-op.
+	runner.Stop()
+}
+
+func TestPeriodicRunner_startLoop(t *testing.T) {
+	t.Parallel()
+
+	var runner periodicRunner
+	done := make(chan struct{})
+	runner.startLoop(func(stopCh <-chan struct{}) {
+		<-stopCh
+		close(done)
+	})
+	runner.Stop()
+
+	select {
+	case <-done:
+	default:
+		t.Fatal("Stop returned before the loop")
+	}
+}
+
+func TestPeriodicRunner_stopBeforeStart(t *testing.T) {
+	t.Parallel()
+
+	var runner periodicRunner
+	runner.Stop()
+}
@@ -0,0 +1,172 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ProxyRule sets the proxy of the HTTP checks whose target host matches the
+// Host glob pattern. An empty Proxy connects directly, as do the hosts in
+// NoProxy.
+type ProxyRule struct {
+	Host    string   `mapstructure:"host"`
+	Proxy   string   `mapstructure:"proxy"`
+	NoProxy []string `mapstructure:"no_proxy"`
+}
+
+// validate returns an error if the rule can't be used.
+func (r ProxyRule) validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("proxy_rule host must be set")
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("proxy_rule host is not a valid pattern: %q", r.Host)
+	}
+	if r.Proxy != "" {
+		if _, err := parseProxyURL(r.Proxy); err != nil {
+			return fmt.Errorf("proxy_rule proxy %s", err)
+		}
+	}
+	if err := validateNoProxy(r.NoProxy); err != nil {
+		return fmt.Errorf("proxy_rule %s", err)
+	}
+	return nil
+}
+
+// parseProxyURL parses the URL of an HTTP, HTTPS or SOCKS5 proxy.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("is not a valid URL: %q", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("must be an http, https or socks5 URL: %q", raw)
+}
+
+// validateNoProxy returns an error if a no_proxy entry isn't a valid pattern.
+func validateNoProxy(noProxy []string) error {
+	for _, entry := range noProxy {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			continue
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			return fmt.Errorf("no_proxy entry is not a valid pattern: %q", entry)
+		}
+	}
+	return nil
+}
+
+// noProxyMatch returns true if the host is in a no_proxy list, whose entries
+// are host names, glob patterns, ".domain" suffixes, IPs or CIDR ranges.
+func noProxyMatch(noProxy []string, host string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if domain, ok := strings.CutPrefix(entry, "."); ok {
+			host := strings.ToLower(host)
+			domain = strings.ToLower(domain)
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+			continue
+		}
+		if globMatch(entry, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares proxies, where nil means the requests aren't proxied
+func proxiesEqual(p1, p2 *url.URL) bool {
+	if p1 == nil || p2 == nil {
+		return p1 == p2
+	}
+	return p1.String() == p2.String()
+}
+
+// proxyRules selects the proxy of the HTTP checks from the proxy, no_proxy
+// and proxy_rule options. Nil if no proxy is configured.
+type proxyRules struct {
+	proxy   *url.URL
+	noProxy []string
+	rules   []proxyRule
+}
+
+// proxyRule is a ProxyRule with its parsed proxy URL.
+type proxyRule struct {
+	ProxyRule
+	proxy *url.URL
+}
+
+func newProxyRules(conf *Config) (*proxyRules, error) {
+	if conf.Proxy == "" && len(conf.ProxyRules) == 0 {
+		return nil, nil
+	}
+
+	p := &proxyRules{noProxy: conf.NoProxy}
+	if conf.Proxy != "" {
+		proxy, err := parseProxyURL(conf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %s", err)
+		}
+		p.proxy = proxy
+	}
+	for _, rule := range conf.ProxyRules {
+		var proxy *url.URL
+		if rule.Proxy != "" {
+			var err error
+			if proxy, err = parseProxyURL(rule.Proxy); err != nil {
+				return nil, fmt.Errorf("proxy_rule proxy %s", err)
+			}
+		}
+		p.rules = append(p.rules, proxyRule{ProxyRule: rule, proxy: proxy})
+	}
+	return p, nil
+}
+
+// proxyFor returns the proxy of the requests to the given host, from the
+// first rule matching it or else the default proxy. Nil means the requests
+// aren't sent through a configured proxy.
+func (p *proxyRules) proxyFor(host string) *url.URL {
+	if p == nil || noProxyMatch(p.noProxy, host) {
+		return nil
+	}
+	for _, rule := range p.rules {
+		if globMatch(rule.Host, host) {
+			if noProxyMatch(rule.NoProxy, host) {
+				return nil
+			}
+			return rule.proxy
+		}
+	}
+	return p.proxy
+}
+
+// transportProxy returns the Proxy function of a transport whose requests are
+// sent through the configured proxies. The hosts they exclude are connected to
+// directly, and the proxy environment variables are only used if no proxy is
+// configured.
+func (p *proxyRules) transportProxy() func(*http.Request) (*url.URL, error) {
+	if p == nil {
+		return http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		return p.proxyFor(req.URL.Hostname()), nil
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// ReapPolicyDelete removes reaped nodes from the catalog.
+	ReapPolicyDelete = "delete"
+	// ReapPolicyQuarantine snapshots reaped nodes into the KV store before
+	// removing them from the catalog, so they can be restored later.
+	ReapPolicyQuarantine = "quarantine"
+)
+
+// nodeSnapshot is the full catalog registration of a quarantined node.
+type nodeSnapshot struct {
+	Node          *api.Node
+	Services      []*api.AgentService
+	Checks        api.HealthChecks
+	QuarantinedAt time.Time
+}
+
+// kvQuarantinePath returns the path to the KV directory where the snapshots of
+// quarantined nodes are written.
+func (a *Agent) kvQuarantinePath() string {
+	return a.config.KVPath + "quarantine/"
+}
+
+// quarantineNodeOps returns the transaction operations to snapshot the node's
+// catalog registration into the KV store. The node itself is deleted by the
+// caller in the same transaction.
+func (a *Agent) quarantineNodeOps(existing *api.CatalogNode) (api.TxnOps, error) {
+	checks, _, err := a.client.Health().Node(existing.Node.Node, a.ConsulQueryOption())
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch checks for node %q: %v", existing.Node.Node, err)
+	}
+
+	snapshot := nodeSnapshot{
+		Node:          existing.Node,
+		QuarantinedAt: time.Now().UTC(),
+	}
+	for _, service := range existing.Services {
+		snapshot.Services = append(snapshot.Services, service)
+	}
+	for _, check := range checks {
+		// The node health check is recreated by the next probe, and the
+		// maintenance checks by the maintenance markers.
+		if check.CheckID != externalCheckName && !isMaintenanceCheck(check.CheckID) {
+			snapshot.Checks = append(snapshot.Checks, check)
+		}
+	}
+
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode snapshot for node %q: %v", existing.Node.Node, err)
+	}
+	kvOps := &api.KVTxnOp{
+		Verb:  api.KVSet,
+		Key:   a.kvQuarantinePath() + existing.Node.Node,
+		Value: bytes,
+	}
+	a.HasPartition(func(partition string) {
+		kvOps.Partition = partition
+	})
+	return api.TxnOps{&api.TxnOp{KV: kvOps}}, nil
+}
+
+// RestoreNode re-registers a quarantined node, its services and its checks
+// from the snapshot in the KV store and removes the snapshot.
+func (a *Agent) RestoreNode(name string) error {
+	key := a.kvQuarantinePath() + name
+	kvPair, _, err := a.client.KV().Get(key, a.ConsulQueryOption())
+	if err != nil {
+		return fmt.Errorf("could not fetch snapshot for node %q: %v", name, err)
+	}
+	if kvPair == nil {
+		return fmt.Errorf("no quarantined snapshot found for node %q", name)
+	}
+
+	var snapshot nodeSnapshot
+	if err := json.Unmarshal(kvPair.Value, &snapshot); err != nil {
+		return fmt.Errorf("could not decode snapshot for node %q: %v", name, err)
+	}
+	if snapshot.Node == nil {
+		return fmt.Errorf("snapshot for node %q has no node registration", name)
+	}
+
+	node := api.Node{
+		ID:              snapshot.Node.ID,
+		Node:            snapshot.Node.Node,
+		Address:         snapshot.Node.Address,
+		Datacenter:      snapshot.Node.Datacenter,
+		TaggedAddresses: snapshot.Node.TaggedAddresses,
+		Meta:            snapshot.Node.Meta,
+		Partition:       snapshot.Node.Partition,
+	}
+	ops := api.TxnOps{
+		&api.TxnOp{
+			Node: &api.NodeTxnOp{
+				Verb: api.NodeSet,
+				Node: node,
+			},
+		},
+	}
+	for _, service := range snapshot.Services {
+		service.CreateIndex, service.ModifyIndex = 0, 0
+		ops = append(ops, &api.TxnOp{
+			Service: &api.ServiceTxnOp{
+				Verb:    api.ServiceSet,
+				Node:    node.Node,
+				Service: *service,
+			},
+		})
+	}
+	for _, check := range snapshot.Checks {
+		check.CreateIndex, check.ModifyIndex = 0, 0
+		ops = append(ops, &api.TxnOp{
+			Check: &api.CheckTxnOp{
+				Verb:  api.CheckSet,
+				Check: *check,
+			},
+		})
+	}
+
+	// Write the registration in chunks, deleting the snapshot with the last one.
+	kvOps := &api.KVTxnOp{
+		Verb:  api.KVDeleteCAS,
+		Key:   key,
+		Index: kvPair.ModifyIndex,
+	}
+	a.HasPartition(func(partition string) {
+		kvOps.Partition = partition
+	})
+	ops = append(ops, &api.TxnOp{KV: kvOps})
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maximumTransactionSize {
+			n = maximumTransactionSize
+		}
+		if err := a.runClientTxn(ops[:n]); err != nil {
+			return fmt.Errorf("could not restore node %q: %v", name, err)
+		}
+		ops = ops[n:]
+	}
+
+	a.logger.Info("Restored quarantined node", "node", name,
+		"services", len(snapshot.Services), "checks", len(snapshot.Checks))
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantine_reapAndRestore(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Register an external node with a service and an http check.
+	nodeMeta := map[string]string{"external-node": "true", "rack": "r1"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:            "external",
+		Address:         "service.local",
+		Datacenter:      "dc1",
+		TaggedAddresses: map[string]string{"wan": "10.0.0.1"},
+		NodeMeta:        nodeMeta,
+		Service: &api.AgentService{
+			ID:      "web1",
+			Service: "web",
+			Tags:    []string{"v1"},
+			Port:    8000,
+			Meta:    map[string]string{"team": "a"},
+		},
+		Check: &api.AgentCheck{
+			Node:      "external",
+			CheckID:   "web-http",
+			Name:      "web-http",
+			ServiceID: "web1",
+			Status:    api.HealthCritical,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://service.local:8000/health",
+				IntervalDuration: 10 * time.Second,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	conf, err := DefaultConfig()
+	require.NoError(t, err)
+	conf.NodeReconnectTimeout = 200 * time.Millisecond
+	conf.NodeReapPolicy = ReapPolicyQuarantine
+
+	agent := &Agent{
+		client: client,
+		config: conf,
+		logger: hclog.New(&hclog.LoggerOptions{
+			Name:            "consul-esm",
+			Level:           hclog.LevelFromString("INFO"),
+			IncludeLocation: true,
+			Output:          LOGOUT,
+		}),
+		knownNodeStatuses: make(map[string]lastKnownStatus),
+	}
+
+	// Fail the node and wait for it to pass the reconnect timeout.
+	node := &api.Node{Node: "external", Meta: nodeMeta}
+	require.NoError(t, agent.updateFailedNode(node, client.KV(), "testkey", nil))
+	time.Sleep(conf.NodeReconnectTimeout)
+	kvPair, _, err := client.KV().Get("testkey", nil)
+	require.NoError(t, err)
+	require.NoError(t, agent.updateFailedNodeTxn(node, client.KV(), "testkey", kvPair))
+
+	// The node is gone from the catalog but has a snapshot.
+	existing, _, err := client.Catalog().Node("external", nil)
+	require.NoError(t, err)
+	require.Nil(t, existing)
+	snapshot, _, err := client.KV().Get(agent.kvQuarantinePath()+"external", nil)
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+
+	require.NoError(t, agent.RestoreNode("external"))
+
+	// The node, service and check are back and the snapshot is removed.
+	existing, _, err = client.Catalog().Node("external", nil)
+	require.NoError(t, err)
+	require.NotNil(t, existing)
+	require.Equal(t, "service.local", existing.Node.Address)
+	require.Equal(t, "10.0.0.1", existing.Node.TaggedAddresses["wan"])
+	require.Equal(t, "r1", existing.Node.Meta["rack"])
+	require.Contains(t, existing.Services, "web1")
+	require.Equal(t, []string{"v1"}, existing.Services["web1"].Tags)
+	require.Equal(t, "a", existing.Services["web1"].Meta["team"])
+
+	checks, _, err := client.Health().Node("external", nil)
+	require.NoError(t, err)
+	require.Len(t, checks, 1)
+	require.Equal(t, "web-http", checks[0].CheckID)
+	require.Equal(t, "web1", checks[0].ServiceID)
+	require.Equal(t, "http://service.local:8000/health", checks[0].Definition.HTTP)
+
+	snapshot, _, err = client.KV().Get(agent.kvQuarantinePath()+"external", nil)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+
+	// Restoring again fails since there is no snapshot left.
+	require.Error(t, agent.RestoreNode("external"))
+}
@@ -0,0 +1,126 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+)
+
+// ReapProtectMetaKey is the node or service meta key that, when set to "true",
+// exempts the node and its services or the service from being reaped.
+const ReapProtectMetaKey = "external-reap-protect"
+
+const (
+	reapKindNode    = "node"
+	reapKindService = "service"
+)
+
+// reapGuard decides whether a node or service that has been failing for too
+// long may actually be removed from the catalog. It enforces protection meta,
+// dry-run mode and the maximum number of deregistrations per window.
+//
+// A nil reapGuard is valid and allows every reap.
+type reapGuard struct {
+	logger hclog.Logger
+	dryRun bool
+	limit  int
+	window time.Duration
+
+	lock   sync.Mutex
+	reaped []time.Time
+
+	// limitLogged is when reaching the limit was last logged, at most once
+	// per window.
+	limitLogged time.Time
+
+	// dryRunLogged are the nodes and services, keyed by kind and name, that
+	// a dry-run reap was already logged for.
+	dryRunLogged map[string]bool
+}
+
+// newReapGuard returns a reapGuard configured from the given config.
+func newReapGuard(logger hclog.Logger, config *Config) *reapGuard {
+	return &reapGuard{
+		logger: logger,
+		dryRun: config.ReapDryRun,
+		limit:  config.ReapLimit,
+		window: config.ReapLimitWindow,
+	}
+}
+
+// Allow returns true if the named node or service may be reaped. The given
+// metas are checked for ReapProtectMetaKey. Only the reaps recorded with
+// Reaped count towards the rate limit, so callers must call it once they
+// deregistered.
+func (g *reapGuard) Allow(kind, name string, metas ...map[string]string) bool {
+	if g == nil {
+		return true
+	}
+
+	for _, meta := range metas {
+		if meta[ReapProtectMetaKey] == "true" {
+			g.skip(kind, name, "protected")
+			return false
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.dryRun {
+		if !g.dryRunLogged[kind+"/"+name] {
+			g.logger.Warn("Dry run: would reap "+kind+" that has been failed for too long", kind, name)
+			if g.dryRunLogged == nil {
+				g.dryRunLogged = make(map[string]bool)
+			}
+			g.dryRunLogged[kind+"/"+name] = true
+		}
+		g.skip(kind, name, "dry_run")
+		return false
+	}
+
+	if g.limit > 0 {
+		now := time.Now()
+		recent := g.reaped[:0]
+		for _, t := range g.reaped {
+			if now.Sub(t) < g.window {
+				recent = append(recent, t)
+			}
+		}
+		g.reaped = recent
+
+		if len(g.reaped) >= g.limit {
+			if now.Sub(g.limitLogged) >= g.window {
+				g.logger.Warn("Reap limit reached, not reaping until the window allows",
+					"limit", g.limit, "window", g.window.String())
+				g.limitLogged = now
+			}
+			g.skip(kind, name, "rate_limited")
+			return false
+		}
+	}
+	return true
+}
+
+// Reaped records that a node or service allowed by Allow was deregistered,
+// counting it towards the rate limit.
+func (g *reapGuard) Reaped(kind string) {
+	if g != nil && g.limit > 0 {
+		g.lock.Lock()
+		g.reaped = append(g.reaped, time.Now())
+		g.lock.Unlock()
+	}
+	metrics.IncrCounterWithLabels([]string{"esm", "reap", "deregistered"}, 1,
+		[]metrics.Label{{Name: "kind", Value: kind}})
+}
+
+func (g *reapGuard) skip(kind, name, reason string) {
+	g.logger.Debug("Skipped reaping "+kind, kind, name, "reason", reason)
+	metrics.IncrCounterWithLabels([]string{"esm", "reap", "skipped"}, 1,
+		[]metrics.Label{{Name: "kind", Value: kind}, {Name: "reason", Value: reason}})
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func testReapGuard(t *testing.T, cb func(*Config)) *reapGuard {
+	conf, err := DefaultConfig()
+	require.NoError(t, err)
+	if cb != nil {
+		cb(conf)
+	}
+	return newReapGuard(hclog.NewNullLogger(), conf)
+}
+
+func TestReapGuard_nil(t *testing.T) {
+	var g *reapGuard
+	require.True(t, g.Allow(reapKindNode, "node1"))
+}
+
+func TestReapGuard_protected(t *testing.T) {
+	g := testReapGuard(t, nil)
+
+	protected := map[string]string{ReapProtectMetaKey: "true"}
+	require.False(t, g.Allow(reapKindNode, "node1", protected))
+	require.False(t, g.Allow(reapKindService, "web", nil, protected))
+	require.True(t, g.Allow(reapKindService, "web", nil, map[string]string{ReapProtectMetaKey: "false"}))
+}
+
+func TestReapGuard_dryRun(t *testing.T) {
+	g := testReapGuard(t, func(c *Config) {
+		c.ReapDryRun = true
+	})
+
+	var logs bytes.Buffer
+	g.logger = hclog.New(&hclog.LoggerOptions{Output: &logs})
+
+	require.False(t, g.Allow(reapKindNode, "node1"))
+	require.False(t, g.Allow(reapKindService, "web"))
+
+	// Each node and service is only logged on the first reap pass.
+	require.False(t, g.Allow(reapKindNode, "node1"))
+	require.Equal(t, 1, strings.Count(logs.String(), "Dry run: would reap node"))
+	require.Equal(t, 1, strings.Count(logs.String(), "Dry run: would reap service"))
+}
+
+func TestReapGuard_limit(t *testing.T) {
+	g := testReapGuard(t, func(c *Config) {
+		c.ReapLimit = 2
+		c.ReapLimitWindow = 200 * time.Millisecond
+	})
+
+	var logs bytes.Buffer
+	g.logger = hclog.New(&hclog.LoggerOptions{Output: &logs})
+
+	// Allowed reaps that didn't happen don't count towards the limit.
+	require.True(t, g.Allow(reapKindNode, "node1"))
+	require.True(t, g.Allow(reapKindNode, "node1"))
+	g.Reaped(reapKindNode)
+	require.True(t, g.Allow(reapKindService, "web"))
+	g.Reaped(reapKindService)
+	require.False(t, g.Allow(reapKindNode, "node2"))
+	require.False(t, g.Allow(reapKindService, "api"))
+
+	// Reaching the limit is logged once per window.
+	require.Equal(t, 1, strings.Count(logs.String(), "Reap limit reached"))
+
+	// Once the window has passed reaping is allowed again.
+	time.Sleep(250 * time.Millisecond)
+	require.True(t, g.Allow(reapKindNode, "node2"))
+	g.Reaped(reapKindNode)
+	g.Reaped(reapKindNode)
+	require.False(t, g.Allow(reapKindNode, "node3"))
+	require.Equal(t, 2, strings.Count(logs.String(), "Reap limit reached"))
+}
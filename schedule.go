@@ -0,0 +1,205 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// suspectProbes is the number of consecutive failed probes that are
+	// retried at the retry interval before falling back to the node's interval.
+	suspectProbes = 3
+
+	// stableProbes is the number of consecutive successful probes after which
+	// the interval of a node is doubled, up to the maximum interval.
+	stableProbes = 10
+)
+
+// probeEntry is a node in the probe schedule along with the time of its next
+// probe.
+type probeEntry struct {
+	node  *api.Node
+	next  time.Time
+	index int
+
+	// The number of consecutive failed or successful probes of the node.
+	failures  int
+	successes int
+}
+
+// probeQueue is a min-heap of probe entries ordered by next probe time.
+type probeQueue []*probeEntry
+
+func (q probeQueue) Len() int           { return len(q) }
+func (q probeQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q probeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *probeQueue) Push(x any) {
+	entry := x.(*probeEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *probeQueue) Pop() any {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return entry
+}
+
+// probeSchedule keeps track of when each node should next be probed. Every
+// node is probed once per its own interval, and new nodes are spread out over
+// their interval so the probes don't all happen at once.
+//
+// When retryInterval is set, nodes that just failed a probe are re-probed at
+// that interval a few times. When maxInterval is set, nodes that have been
+// stable for a while back off towards it.
+type probeSchedule struct {
+	queue    probeQueue
+	entries  map[string]*probeEntry
+	interval func(*api.Node) time.Duration
+
+	retryInterval time.Duration
+	maxInterval   time.Duration
+}
+
+func newProbeSchedule(interval func(*api.Node) time.Duration) *probeSchedule {
+	return &probeSchedule{
+		entries:  make(map[string]*probeEntry),
+		interval: interval,
+	}
+}
+
+// Len returns the number of scheduled nodes.
+func (s *probeSchedule) Len() int {
+	return len(s.queue)
+}
+
+// Update replaces the set of scheduled nodes and returns the names of the
+// nodes that were removed. Nodes that were already scheduled keep their next
+// probe time unless their interval got shorter, new nodes are spread out in
+// random order over their interval.
+func (s *probeSchedule) Update(nodes []*api.Node, now time.Time) []string {
+	seen := make(map[string]bool, len(nodes))
+	var added []*api.Node
+	for _, node := range nodes {
+		seen[node.Node] = true
+		entry, ok := s.entries[node.Node]
+		if !ok {
+			added = append(added, node)
+			continue
+		}
+		entry.node = node
+		if next := now.Add(s.entryInterval(entry)); next.Before(entry.next) {
+			entry.next = next
+			heap.Fix(&s.queue, entry.index)
+		}
+	}
+
+	var removed []string
+	for name, entry := range s.entries {
+		if !seen[name] {
+			heap.Remove(&s.queue, entry.index)
+			delete(s.entries, name)
+			removed = append(removed, name)
+		}
+	}
+
+	shuffleNodes(added)
+	for i, node := range added {
+		offset := s.interval(node) * time.Duration(i) / time.Duration(len(added))
+		entry := &probeEntry{node: node, next: now.Add(offset)}
+		heap.Push(&s.queue, entry)
+		s.entries[node.Node] = entry
+	}
+	return removed
+}
+
+// Next returns the time of the next scheduled probe, or false if there are no
+// nodes to probe.
+func (s *probeSchedule) Next() (time.Time, bool) {
+	if len(s.queue) == 0 {
+		return time.Time{}, false
+	}
+	return s.queue[0].next, true
+}
+
+// Pop returns the next node to probe if it is due, and reschedules it one
+// interval later.
+func (s *probeSchedule) Pop(now time.Time) *api.Node {
+	if len(s.queue) == 0 || s.queue[0].next.After(now) {
+		return nil
+	}
+	entry := s.queue[0]
+
+	// Keep the node's place in the schedule, unless we've fallen behind.
+	interval := s.entryInterval(entry)
+	entry.next = entry.next.Add(interval)
+	if entry.next.Before(now) {
+		entry.next = now.Add(interval)
+	}
+	heap.Fix(&s.queue, 0)
+	return entry.node
+}
+
+// Report records the result of a probe of the given node. The first few
+// failed probes in a row bring the next probe of the node forward to the retry
+// interval.
+func (s *probeSchedule) Report(name string, healthy bool, now time.Time) {
+	entry, ok := s.entries[name]
+	if !ok {
+		return
+	}
+
+	if healthy {
+		entry.failures = 0
+		entry.successes++
+		return
+	}
+	entry.successes = 0
+	entry.failures++
+
+	if entry.failures > suspectProbes || s.retryInterval <= 0 {
+		return
+	}
+	if next := now.Add(s.retryInterval); next.Before(entry.next) {
+		entry.next = next
+		heap.Fix(&s.queue, entry.index)
+	}
+}
+
+// Interval returns the interval at which the node is currently probed, or
+// zero if it isn't scheduled.
+func (s *probeSchedule) Interval(name string) time.Duration {
+	entry, ok := s.entries[name]
+	if !ok {
+		return 0
+	}
+	return s.entryInterval(entry)
+}
+
+// entryInterval returns the interval at which the node should currently be
+// probed, backing off for nodes that have been stable for a while.
+func (s *probeSchedule) entryInterval(entry *probeEntry) time.Duration {
+	interval := s.interval(entry.node)
+	if s.maxInterval > interval {
+		for i := stableProbes; i <= entry.successes && interval < s.maxInterval; i += stableProbes {
+			interval *= 2
+		}
+		if interval > s.maxInterval {
+			interval = s.maxInterval
+		}
+	}
+	return interval
+}
@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeSchedule_spreadsNewNodes(t *testing.T) {
+	schedule := newProbeSchedule(func(*api.Node) time.Duration {
+		return 4 * time.Second
+	})
+
+	now := time.Now()
+	schedule.Update([]*api.Node{{Node: "a"}, {Node: "b"}, {Node: "c"}, {Node: "d"}}, now)
+	require.Equal(t, 4, schedule.Len())
+
+	// One node is due every second.
+	for i := 0; i < 4; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		next, ok := schedule.Next()
+		require.True(t, ok)
+		require.Equal(t, at, next)
+		require.NotNil(t, schedule.Pop(at))
+		require.Nil(t, schedule.Pop(at))
+	}
+
+	// Each node is rescheduled one interval after its previous probe.
+	next, _ := schedule.Next()
+	require.Equal(t, now.Add(4*time.Second), next)
+}
+
+func TestProbeSchedule_perNodeInterval(t *testing.T) {
+	schedule := newProbeSchedule(func(node *api.Node) time.Duration {
+		if node.Node == "fast" {
+			return time.Second
+		}
+		return time.Minute
+	})
+
+	now := time.Now()
+	schedule.Update([]*api.Node{{Node: "fast"}}, now)
+	schedule.Update([]*api.Node{{Node: "fast"}, {Node: "slow"}}, now)
+
+	// Both nodes are due right away, after which the fast node is probed once
+	// per second while the slow node waits a minute.
+	probes := map[string]int{}
+	for i := 0; i <= 10; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		for node := schedule.Pop(at); node != nil; node = schedule.Pop(at) {
+			probes[node.Node]++
+		}
+	}
+	require.Equal(t, 11, probes["fast"])
+	require.Equal(t, 1, probes["slow"])
+}
+
+func TestProbeSchedule_update(t *testing.T) {
+	interval := time.Minute
+	schedule := newProbeSchedule(func(*api.Node) time.Duration {
+		return interval
+	})
+
+	now := time.Now()
+	schedule.Update([]*api.Node{{Node: "a"}}, now)
+	require.Equal(t, "a", schedule.Pop(now).Node)
+
+	// Removed nodes are no longer scheduled.
+	require.Equal(t, []string{"a"}, schedule.Update([]*api.Node{{Node: "b"}}, now))
+	require.Equal(t, 1, schedule.Len())
+	require.Equal(t, "b", schedule.Pop(now).Node)
+
+	// Shortening the interval pulls the next probe in.
+	interval = time.Second
+	schedule.Update([]*api.Node{{Node: "b"}}, now)
+	next, _ := schedule.Next()
+	require.Equal(t, now.Add(time.Second), next)
+
+	// An empty schedule has nothing to do.
+	schedule.Update(nil, now)
+	_, ok := schedule.Next()
+	require.False(t, ok)
+	require.Nil(t, schedule.Pop(now))
+}
+
+func TestProbeSchedule_adaptive(t *testing.T) {
+	schedule := newProbeSchedule(func(*api.Node) time.Duration {
+		return 10 * time.Second
+	})
+	schedule.retryInterval = time.Second
+	schedule.maxInterval = 30 * time.Second
+
+	now := time.Now()
+	schedule.Update([]*api.Node{{Node: "a"}}, now)
+	require.NotNil(t, schedule.Pop(now))
+
+	// A failed probe is retried at the retry interval a few times, then falls
+	// back to the regular interval.
+	for i := 1; i <= suspectProbes; i++ {
+		schedule.Report("a", false, now)
+		next, _ := schedule.Next()
+		require.Equal(t, now.Add(time.Second), next)
+		now = next
+		require.NotNil(t, schedule.Pop(now))
+	}
+	schedule.Report("a", false, now)
+	next, _ := schedule.Next()
+	require.Equal(t, now.Add(10*time.Second), next)
+
+	// Stable nodes back off up to the maximum interval.
+	intervals := []time.Duration{}
+	for i := 0; i < 4*stableProbes; i++ {
+		now, _ = schedule.Next()
+		require.NotNil(t, schedule.Pop(now))
+		schedule.Report("a", true, now)
+		next, _ = schedule.Next()
+		if len(intervals) == 0 || intervals[len(intervals)-1] != next.Sub(now) {
+			intervals = append(intervals, next.Sub(now))
+		}
+	}
+	require.Equal(t, []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second}, intervals)
+	require.Equal(t, 30*time.Second, schedule.Interval("a"))
+	require.Zero(t, schedule.Interval("b"))
+
+	// A failure resets the backoff.
+	schedule.Report("a", false, now)
+	next, _ = schedule.Next()
+	require.Equal(t, now.Add(time.Second), next)
+
+	// Reports for unknown nodes are ignored.
+	schedule.Report("b", false, now)
+	require.Equal(t, 1, schedule.Len())
+}
@@ -0,0 +1,225 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// secretRefPattern matches the secret references in check header values:
+// ${kv:<key>}, ${file:<path>} and ${env:<name>}.
+var secretRefPattern = regexp.MustCompile(`\$\{(kv|file|env):([^}]+)\}`)
+
+// redactedSecret replaces the secret values in check output.
+const redactedSecret = "[redacted]"
+
+// hasSecretRefs returns true if any header value references a secret.
+func hasSecretRefs(header map[string][]string) bool {
+	for _, values := range header {
+		for _, value := range values {
+			if secretRefPattern.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactSecrets replaces the given secret values in s.
+func redactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redactedSecret)
+		}
+	}
+	return s
+}
+
+// cachedSecret is a resolved secret and when it was read.
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// secretResolver resolves the secret references in check headers. Each
+// source is only readable where configured: KV keys under secret_kv_path,
+// files in secret_dirs and environment variables starting with
+// secret_env_prefix. Secrets are cached for secret_refresh_interval, and
+// the cached value is kept if refreshing it fails.
+type secretResolver struct {
+	client    *api.Client
+	logger    hclog.Logger
+	kvPath    string
+	dirs      []string
+	envPrefix string
+	refresh   time.Duration
+	queryOpts *api.QueryOptions
+
+	cache     map[string]cachedSecret
+	cacheLock sync.Mutex
+}
+
+func newSecretResolver(client *api.Client, logger hclog.Logger, conf *Config, queryOpts *api.QueryOptions) *secretResolver {
+	return &secretResolver{
+		client:    client,
+		logger:    logger,
+		kvPath:    conf.SecretKVPath,
+		dirs:      conf.SecretDirs,
+		envPrefix: conf.SecretEnvPrefix,
+		refresh:   conf.SecretRefreshInterval,
+		queryOpts: queryOpts,
+		cache:     make(map[string]cachedSecret),
+	}
+}
+
+// ResolveHeader returns a copy of the header with its secret references
+// replaced, along with the secret values to redact from the check output.
+func (r *secretResolver) ResolveHeader(header map[string][]string) (map[string][]string, []string, error) {
+	resolved := make(map[string][]string, len(header))
+	var secrets []string
+	for name, values := range header {
+		resolvedValues := make([]string, len(values))
+		for i, value := range values {
+			resolvedValue, valueSecrets, err := r.Resolve(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			resolvedValues[i] = resolvedValue
+			secrets = append(secrets, valueSecrets...)
+		}
+		resolved[name] = resolvedValues
+	}
+	return resolved, secrets, nil
+}
+
+// Resolve returns the value with its secret references replaced, along with
+// the secret values.
+func (r *secretResolver) Resolve(value string) (string, []string, error) {
+	if !secretRefPattern.MatchString(value) {
+		return value, nil, nil
+	}
+	if r == nil {
+		return "", nil, fmt.Errorf("secret references aren't enabled")
+	}
+
+	var secrets []string
+	var err error
+	resolved := secretRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		var secret string
+		secret, err = r.lookup(ref)
+		secrets = append(secrets, secret)
+		return secret
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return resolved, secrets, nil
+}
+
+// lookup returns the value of a secret reference, from the cache if it was
+// read less than the refresh interval ago. Secrets are fetched without holding
+// the cache lock, so a slow source doesn't hold up the other checks.
+func (r *secretResolver) lookup(ref string) (string, error) {
+	r.cacheLock.Lock()
+	cached, ok := r.cache[ref]
+	r.cacheLock.Unlock()
+	if ok && time.Since(cached.fetched) < r.refresh {
+		return cached.value, nil
+	}
+
+	match := secretRefPattern.FindStringSubmatch(ref)
+	value, err := r.fetch(match[1], match[2])
+	if err != nil {
+		if ok {
+			r.logger.Warn("Could not refresh check secret, using the cached value", "secret", ref, "error", err)
+			return cached.value, nil
+		}
+		return "", fmt.Errorf("could not resolve %s: %w", ref, err)
+	}
+
+	r.cacheLock.Lock()
+	r.cache[ref] = cachedSecret{value: value, fetched: time.Now()}
+	r.cacheLock.Unlock()
+	return value, nil
+}
+
+// fetch reads a secret from its source.
+func (r *secretResolver) fetch(source, name string) (string, error) {
+	switch source {
+	case "kv":
+		if r.kvPath == "" {
+			return "", fmt.Errorf("secret_kv_path isn't set")
+		}
+		key := strings.TrimPrefix(name, "/")
+		for _, segment := range strings.Split(key, "/") {
+			if segment == ".." {
+				return "", fmt.Errorf("key must be within secret_kv_path")
+			}
+		}
+		pair, _, err := r.client.KV().Get(r.kvPath+key, r.queryOpts)
+		if err != nil {
+			return "", err
+		}
+		if pair == nil {
+			return "", fmt.Errorf("key %q not found", r.kvPath+key)
+		}
+		return strings.TrimRight(string(pair.Value), "\r\n"), nil
+
+	case "file":
+		path, ok := r.allowedFile(filepath.Clean(name))
+		if !ok {
+			return "", fmt.Errorf("file must be within secret_dirs")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+
+	case "env":
+		if r.envPrefix == "" || !strings.HasPrefix(name, r.envPrefix) {
+			return "", fmt.Errorf("environment variable must start with secret_env_prefix")
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q isn't set", name)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown secret source %q", source)
+}
+
+// allowedFile returns the path with its symlinks resolved, and true if that
+// is in one of the secret directories. The resolved path is the one to read,
+// so a symlink changed after the check can't point outside of them.
+func (r *secretResolver) allowedFile(path string) (string, bool) {
+	if !filepath.IsAbs(path) {
+		return "", false
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	for _, dir := range r.dirs {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return path, true
+		}
+	}
+	return "", false
+}
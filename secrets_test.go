@@ -0,0 +1,168 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasSecretRefs(t *testing.T) {
+	require.False(t, hasSecretRefs(nil))
+	require.False(t, hasSecretRefs(map[string][]string{"Authorization": {"Bearer $token"}}))
+	require.True(t, hasSecretRefs(map[string][]string{
+		"Accept":        {"application/json"},
+		"Authorization": {"Bearer ${kv:partner/token}"},
+	}))
+}
+
+func TestRedactSecrets(t *testing.T) {
+	require.Equal(t, "token [redacted] and [redacted]",
+		redactSecrets("token s3cr3t and hunter2", []string{"s3cr3t", "", "hunter2"}))
+}
+
+func TestSecretResolver(t *testing.T) {
+	s, err := NewTestServer(t)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	require.NoError(t, err)
+	_, err = client.KV().Put(&api.KVPair{Key: "esm-secrets/partner/token", Value: []byte("kv-token\n")}, nil)
+	require.NoError(t, err)
+	_, err = client.KV().Put(&api.KVPair{Key: "other/token", Value: []byte("other-token")}, nil)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	secretsDir := filepath.Join(dir, "secrets")
+	require.NoError(t, os.Mkdir(secretsDir, 0o700))
+	tokenFile := filepath.Join(secretsDir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("file-token\n"), 0o600))
+	outsideFile := filepath.Join(dir, "outside")
+	require.NoError(t, os.WriteFile(outsideFile, []byte("outside"), 0o600))
+	require.NoError(t, os.Symlink(outsideFile, filepath.Join(secretsDir, "link")))
+
+	t.Setenv("ESM_SECRET_TOKEN", "env-token")
+	t.Setenv("OTHER_TOKEN", "other-token")
+
+	resolver := newSecretResolver(client, hclog.NewNullLogger(), &Config{
+		SecretKVPath:          "esm-secrets/",
+		SecretDirs:            []string{secretsDir},
+		SecretEnvPrefix:       "ESM_SECRET_",
+		SecretRefreshInterval: time.Hour,
+	}, nil)
+
+	header, secrets, err := resolver.ResolveHeader(map[string][]string{
+		"Authorization": {"Bearer ${kv:partner/token}"},
+		"X-Api-Key":     {"${file:" + tokenFile + "}", "${env:ESM_SECRET_TOKEN}"},
+		"Accept":        {"application/json"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"Authorization": {"Bearer kv-token"},
+		"X-Api-Key":     {"file-token", "env-token"},
+		"Accept":        {"application/json"},
+	}, header)
+	require.ElementsMatch(t, []string{"kv-token", "file-token", "env-token"}, secrets)
+
+	// Secrets are cached until the refresh interval passes, and the cached
+	// value is kept if refreshing fails.
+	_, err = client.KV().Put(&api.KVPair{Key: "esm-secrets/partner/token", Value: []byte("rotated")}, nil)
+	require.NoError(t, err)
+	value, err := resolver.lookup("${kv:partner/token}")
+	require.NoError(t, err)
+	require.Equal(t, "kv-token", value)
+
+	resolver.refresh = 0
+	value, err = resolver.lookup("${kv:partner/token}")
+	require.NoError(t, err)
+	require.Equal(t, "rotated", value)
+
+	_, err = client.KV().Delete("esm-secrets/partner/token", nil)
+	require.NoError(t, err)
+	value, err = resolver.lookup("${kv:partner/token}")
+	require.NoError(t, err)
+	require.Equal(t, "rotated", value)
+
+	// Secrets can only be read from the configured sources.
+	for ref, expected := range map[string]string{
+		"${kv:missing}":                                              "not found",
+		"${kv:../other/token}":                                       "must be within secret_kv_path",
+		"${file:" + outsideFile + "}":                                "must be within secret_dirs",
+		"${file:" + filepath.Join(secretsDir, "link") + "}":          "must be within secret_dirs",
+		"${file:" + filepath.Join(secretsDir, "..", "outside") + "}": "must be within secret_dirs",
+		"${file:secrets/token}":                                      "must be within secret_dirs",
+		"${env:OTHER_TOKEN}":                                         "must start with secret_env_prefix",
+		"${env:ESM_SECRET_UNSET}":                                    "isn't set",
+	} {
+		_, _, err := resolver.ResolveHeader(map[string][]string{"Authorization": {ref}})
+		require.ErrorContains(t, err, expected, ref)
+	}
+
+	// Files are read through the path their symlinks resolve to.
+	require.NoError(t, os.Symlink(tokenFile, filepath.Join(secretsDir, "token-link")))
+	path, ok := resolver.allowedFile(filepath.Join(secretsDir, "token-link"))
+	require.True(t, ok)
+	resolvedToken, err := filepath.EvalSymlinks(tokenFile)
+	require.NoError(t, err)
+	require.Equal(t, resolvedToken, path)
+
+	disabled := newSecretResolver(client, hclog.NewNullLogger(), &Config{}, nil)
+	_, err = disabled.lookup("${kv:partner/token}")
+	require.ErrorContains(t, err, "secret_kv_path isn't set")
+	_, err = disabled.lookup("${env:ESM_SECRET_TOKEN}")
+	require.ErrorContains(t, err, "must start with secret_env_prefix")
+
+	var none *secretResolver
+	_, _, err = none.ResolveHeader(map[string][]string{"Authorization": {"${env:ESM_SECRET_TOKEN}"}})
+	require.ErrorContains(t, err, "aren't enabled")
+}
+
+func TestCheckHTTPESM_Secrets(t *testing.T) {
+	// A server that echoes the Authorization header, as misbehaving ones do.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer env-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Write([]byte("authorization: " + r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	t.Setenv("ESM_SECRET_TOKEN", "env-token")
+	resolver := newSecretResolver(nil, hclog.NewNullLogger(), &Config{SecretEnvPrefix: "ESM_SECRET_"}, nil)
+
+	run := func(authorization string) *recordingNotifier {
+		notifier := &recordingNotifier{}
+		check := &CheckHTTPESM{
+			CheckID:         structs.CheckID{ID: "secret"},
+			HTTP:            server.URL,
+			Header:          map[string][]string{"Authorization": {authorization}},
+			Interval:        time.Hour,
+			Logger:          hclog.NewNullLogger(),
+			TLSClientConfig: &tls.Config{},
+			Secrets:         resolver,
+		}
+		check.RunOnce(notifier)
+		return notifier
+	}
+
+	notifier := run("Bearer ${env:ESM_SECRET_TOKEN}")
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Contains(t, notifier.output, "authorization: Bearer [redacted]")
+	require.NotContains(t, notifier.output, "env-token")
+
+	notifier = run("Bearer ${env:ESM_SECRET_MISSING}")
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "Invalid header: could not resolve ${env:ESM_SECRET_MISSING}")
+}
@@ -0,0 +1,306 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-hclog"
+)
+
+// nodeHealthTracker tracks which of our probed nodes have a critical
+// externalNodeHealth check. The node check is the parent of the other checks
+// on the node, which are suppressed while it is critical.
+//
+// A nil nodeHealthTracker is valid and never reports a node as critical.
+type nodeHealthTracker struct {
+	lock     sync.Mutex
+	critical map[string]bool
+	changed  map[string]bool
+	notifyCh chan struct{}
+}
+
+func newNodeHealthTracker() *nodeHealthTracker {
+	return &nodeHealthTracker{
+		critical: make(map[string]bool),
+		changed:  make(map[string]bool),
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+// Set records the status of the node's externalNodeHealth check.
+func (t *nodeHealthTracker) Set(node string, critical bool) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if t.critical[node] == critical {
+		t.lock.Unlock()
+		return
+	}
+	if critical {
+		t.critical[node] = true
+	} else {
+		delete(t.critical, node)
+	}
+	t.changed[node] = critical
+	t.lock.Unlock()
+	t.notify()
+}
+
+// Retain forgets about the nodes that aren't in the given list, which counts
+// as a recovery for the critical ones.
+func (t *nodeHealthTracker) Retain(nodes []*api.Node) {
+	if t == nil {
+		return
+	}
+	keep := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		keep[node.Node] = true
+	}
+
+	t.lock.Lock()
+	dropped := false
+	for node := range t.critical {
+		if !keep[node] {
+			delete(t.critical, node)
+			t.changed[node] = false
+			dropped = true
+		}
+	}
+	t.lock.Unlock()
+	if dropped {
+		t.notify()
+	}
+}
+
+func (t *nodeHealthTracker) notify() {
+	select {
+	case t.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Critical returns true if the node's externalNodeHealth check is critical.
+func (t *nodeHealthTracker) Critical(node string) bool {
+	if t == nil {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.critical[node]
+}
+
+// changes returns the nodes whose status changed since the last call, and
+// their new status.
+func (t *nodeHealthTracker) changes() map[string]bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	changed := t.changed
+	t.changed = make(map[string]bool)
+	return changed
+}
+
+// suppressedOutput is the output of checks suppressed because their node is
+// critical.
+func suppressedOutput(node string) string {
+	return fmt.Sprintf("Check suppressed: node %q is unreachable (%s is critical)", node, externalCheckName)
+}
+
+// watchNodeHealth is a long running goroutine that suppresses the checks of
+// nodes whose externalNodeHealth check goes critical, and re-evaluates them
+// as soon as the node recovers.
+func (c *CheckRunner) watchNodeHealth(shutdownCh <-chan struct{}) {
+	if c.nodeHealth == nil {
+		return
+	}
+	for {
+		select {
+		case <-c.nodeHealth.notifyCh:
+			c.handleNodeHealthChanges()
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// handleNodeHealthChanges suppresses or re-evaluates the checks of the nodes
+// whose status changed.
+func (c *CheckRunner) handleNodeHealthChanges() {
+	for node, critical := range c.nodeHealth.changes() {
+		if critical {
+			c.suppressNodeChecks(node)
+		} else {
+			c.reevaluateNodeChecks(node)
+		}
+	}
+}
+
+// nodeChecks returns the hashes of our checks on the given node.
+func (c *CheckRunner) nodeChecks(node string) []types.CheckID {
+	var hashes []types.CheckID
+	c.checks.Range(func(_checkID, _check any) bool {
+		if _check.(*esmHealthCheck).Node == node {
+			hashes = append(hashes, _checkID.(types.CheckID))
+		}
+		return true
+	})
+	return hashes
+}
+
+// suppressNodeChecks marks the checks on a critical node with an output
+// naming the cause, keeping their status, in a single transaction.
+func (c *CheckRunner) suppressNodeChecks(node string) {
+	hashes := c.nodeChecks(node)
+	if len(hashes) == 0 {
+		return
+	}
+
+	catalogChecks, _, err := c.client.Health().Node(node, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		c.logger.Warn("error retrieving existing node entry", "node", node, "error", err)
+		return
+	}
+	existing := make(map[string]*api.HealthCheck)
+	for _, check := range catalogChecks {
+		existing[check.ServiceID+"/"+check.CheckID] = check
+	}
+
+	output := suppressedOutput(node)
+	var ops api.TxnOps
+	for _, checkHash := range hashes {
+		// Pending output syncs would overwrite the suppression.
+		if timer, ok := c.deferCheck.LoadAndDelete(checkHash); ok {
+			timer.Stop()
+		}
+
+		check, ok := c.checks.Load(checkHash)
+		if !ok {
+			continue
+		}
+		checkID := strings.TrimPrefix(check.CheckID, check.Node+"/")
+		current, ok := existing[check.ServiceID+"/"+checkID]
+		if !ok || current.Output == output {
+			continue
+		}
+		current.Output = output
+		ops = append(ops, &api.TxnOp{
+			Check: &api.CheckTxnOp{
+				Verb:  api.CheckCAS,
+				Check: *current,
+			},
+		})
+	}
+
+	c.logger.Info("Node is critical, suppressing its checks", "node", node, "checks", len(hashes))
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maximumTransactionSize {
+			n = maximumTransactionSize
+		}
+		ok, resp, _, err := c.client.Txn().Txn(ops[:n], nil)
+		if err != nil {
+			c.logger.Warn("Error marking suppressed checks in Consul", "node", node, "error", err)
+			return
+		}
+		if !ok {
+			c.logger.Warn("Failed to mark suppressed checks in Consul", "node", node, "errors", len(resp.Errors))
+		}
+		ops = ops[n:]
+	}
+}
+
+// reevaluateNodeChecks runs the checks on a recovered node right away, and
+// writes their first result without waiting for the thresholds.
+func (c *CheckRunner) reevaluateNodeChecks(node string) {
+	hashes := c.nodeChecks(node)
+	if len(hashes) == 0 {
+		return
+	}
+
+	c.logger.Info("Node recovered, re-evaluating its checks", "node", node, "checks", len(hashes))
+	for _, checkHash := range hashes {
+		check, ok := c.checks.LoadAndDelete(checkHash)
+		if !ok {
+			continue
+		}
+		check.reevaluate = true
+		check.failureCounter = 0
+		check.successCounter = 0
+		c.checks.Store(checkHash, check)
+
+		c.runCheckNow(checkHash)
+	}
+}
+
+// runCheckNow runs a check once right away and passes its result to
+// UpdateCheck. The checks themselves only run again after their interval.
+func (c *CheckRunner) runCheckNow(checkHash types.CheckID) {
+	if httpCheck, ok := c.checksHTTP.Load(checkHash); ok {
+		// Consul's CheckHTTP can't be run once, so it's run as an ESM HTTP
+		// check, which sets the status and output the same way.
+		oneShot := &CheckHTTPESM{
+			CheckID:          httpCheck.CheckID,
+			HTTP:             httpCheck.HTTP,
+			Header:           httpCheck.Header,
+			Method:           httpCheck.Method,
+			Body:             httpCheck.Body,
+			Timeout:          httpCheck.Timeout,
+			Logger:           c.logger,
+			TLSClientConfig:  httpCheck.TLSClientConfig,
+			OutputMaxSize:    httpCheck.OutputMaxSize,
+			DisableRedirects: httpCheck.DisableRedirects,
+		}
+		go oneShot.RunOnce(c)
+	} else if esmCheck, ok := c.checksHTTPESM.Load(checkHash); ok {
+		go esmCheck.RunOnce(c)
+	} else if syntheticCheck, ok := c.checksSynthetic.Load(checkHash); ok {
+		go syntheticCheck.RunOnce(c)
+	} else if certCheck, ok := c.checksCertExpiry.Load(checkHash); ok {
+		go certCheck.RunOnce(c)
+	} else if dnsCheck, ok := c.checksDNS.Load(checkHash); ok {
+		go dnsCheck.RunOnce(c)
+	} else if expectCheck, ok := c.checksTCPExpect.Load(checkHash); ok {
+		go expectCheck.RunOnce(c)
+	} else if aliasCheck, ok := c.checksAlias.Load(checkHash); ok {
+		go aliasCheck.RunOnce(c)
+	} else if tcpCheck, ok := c.checksTCP.Load(checkHash); ok {
+		go runTCPOnce(tcpCheck, c.logger, c)
+	}
+}
+
+// runTCPOnce connects to the target of a TCP check once and passes the
+// result to the notifier, the same way Consul's CheckTCP does, as it can't be
+// run once.
+func runTCPOnce(check *consulchecks.CheckTCP, logger hclog.Logger, notifier consulchecks.CheckNotifier) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if check.Timeout > 0 {
+		dialer.Timeout = check.Timeout
+	}
+
+	var conn net.Conn
+	var err error
+	checkType := "TCP"
+	if check.TLSClientConfig == nil {
+		conn, err = dialer.Dial("tcp", check.TCP)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", check.TCP, check.TLSClientConfig)
+		checkType = "TCP+TLS"
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Check %s connection failed", checkType), "check", check.CheckID.String(), "error", err)
+		notifier.UpdateCheck(check.CheckID, api.HealthCritical, err.Error())
+		return
+	}
+	conn.Close()
+	notifier.UpdateCheck(check.CheckID, api.HealthPassing, fmt.Sprintf("%s connect %s: Success", checkType, check.TCP))
+}
@@ -0,0 +1,151 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeHealthTracker(t *testing.T) {
+	// A nil tracker never reports a node as critical.
+	var tracker *nodeHealthTracker
+	tracker.Set("node1", true)
+	require.False(t, tracker.Critical("node1"))
+
+	tracker = newNodeHealthTracker()
+	tracker.Set("node1", true)
+	tracker.Set("node2", true)
+	require.True(t, tracker.Critical("node1"))
+	require.Equal(t, map[string]bool{"node1": true, "node2": true}, tracker.changes())
+	require.Empty(t, tracker.changes())
+
+	// Setting the same status again isn't a change.
+	tracker.Set("node1", true)
+	require.Empty(t, tracker.changes())
+
+	tracker.Set("node1", false)
+	require.False(t, tracker.Critical("node1"))
+	require.Equal(t, map[string]bool{"node1": false}, tracker.changes())
+
+	// Nodes dropped from the node list recover.
+	tracker.Retain([]*api.Node{{Node: "node1"}})
+	require.False(t, tracker.Critical("node2"))
+	require.Equal(t, map[string]bool{"node2": false}, tracker.changes())
+}
+
+func TestCheckRunner_suppressNodeChecks(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	runner.nodeHealth = newNodeHealthTracker()
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Status:  api.HealthCritical,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://" + s.HTTPAddr + "/v1/status/leader",
+				IntervalDuration: time.Hour,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+	hash := hashCheck(checks[0])
+
+	catalogCheck := func() *api.HealthCheck {
+		checks, _, err := client.Health().Node("external", nil)
+		require.NoError(t, err)
+		require.Len(t, checks, 1)
+		return checks[0]
+	}
+
+	// A critical node gets its checks marked as suppressed, keeping their
+	// status, and their results are ignored.
+	runner.nodeHealth.Set("external", true)
+	runner.handleNodeHealthChanges()
+	check := catalogCheck()
+	require.Equal(t, api.HealthCritical, check.Status)
+	require.Equal(t, suppressedOutput("external"), check.Output)
+
+	runner.UpdateCheck(structs.CheckID{ID: hash}, api.HealthPassing, "up")
+	cached, ok := runner.checks.Load(hash)
+	require.True(t, ok)
+	require.Equal(t, api.HealthCritical, cached.Status)
+
+	// Once the node recovers, its checks run right away and their result is
+	// written.
+	runner.nodeHealth.Set("external", false)
+	runner.handleNodeHealthChanges()
+	retry.Run(t, func(r *retry.R) {
+		checks, _, err := client.Health().Node("external", nil)
+		if err != nil {
+			r.Fatal(err)
+		}
+		if len(checks) != 1 || checks[0].Status != api.HealthPassing {
+			r.Fatalf("check not passing: %v", checks)
+		}
+		if checks[0].Output == suppressedOutput("external") {
+			r.Fatal("check still suppressed")
+		}
+	})
+}
+
+func TestRunTCPOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	check := &consulchecks.CheckTCP{
+		CheckID: structs.CheckID{ID: "external/tcp"},
+		TCP:     listener.Addr().String(),
+		Timeout: 200 * time.Millisecond,
+	}
+	notifier := &recordingNotifier{}
+	runTCPOnce(check, hclog.NewNullLogger(), notifier)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Equal(t, "TCP connect "+check.TCP+": Success", notifier.output)
+
+	check.TCP = "127.0.0.1:1"
+	runTCPOnce(check, hclog.NewNullLogger(), notifier)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "connection refused")
+}
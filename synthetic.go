@@ -0,0 +1,693 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// syntheticCheckPrefix is the prefix of the IDs of the catalog checks ESM
+	// registers for the synthetic checks, followed by their name.
+	syntheticCheckPrefix = "esm-synthetic:"
+
+	// syntheticCheckNotes are the notes of the synthetic catalog checks.
+	syntheticCheckNotes = "Synthetic HTTP transaction run by consul-esm"
+
+	// defaultSyntheticTimeout is the timeout of each step's request, the same
+	// as Consul's HTTP checks.
+	defaultSyntheticTimeout = 10 * time.Second
+)
+
+// syntheticVarPattern matches the references to extracted values in the URL,
+// headers and body of the steps.
+var syntheticVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// syntheticVarName matches the names values can be extracted to.
+var syntheticVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SyntheticCheck is a transaction of HTTP steps run in order, as a check of
+// the external service ServiceID. Node restricts it to the service on that
+// node; otherwise it's run for the service on every external node having one
+// with that ID.
+type SyntheticCheck struct {
+	Name      string          `mapstructure:"name"`
+	ServiceID string          `mapstructure:"service_id"`
+	Node      string          `mapstructure:"node"`
+	Interval  time.Duration   `mapstructure:"interval"`
+	Timeout   time.Duration   `mapstructure:"timeout"`
+	Steps     []SyntheticStep `mapstructure:"step"`
+}
+
+// SyntheticStep is a request of a synthetic check. Cookies set by earlier
+// responses are sent with it, and ${name} in its URL, headers and body is
+// replaced with the value an earlier step extracted as name.
+type SyntheticStep struct {
+	Name   string              `mapstructure:"name"`
+	Method string              `mapstructure:"method"`
+	URL    string              `mapstructure:"url"`
+	Header map[string][]string `mapstructure:"header"`
+	Body   string              `mapstructure:"body"`
+
+	// Assert is a CEL expression over the response, like the esm-assert
+	// directive. If empty, the status is set from the status code.
+	Assert string `mapstructure:"assert"`
+
+	// Extract maps names to CEL expressions over the response, whose values
+	// later steps can reference.
+	Extract map[string]string `mapstructure:"extract"`
+}
+
+// validate returns an error if the check can't be run.
+func (s SyntheticCheck) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("synthetic_check name must be set")
+	}
+	if strings.Contains(s.Name, "/") {
+		return fmt.Errorf("synthetic_check %q name cannot contain a /", s.Name)
+	}
+	if s.ServiceID == "" {
+		return fmt.Errorf("synthetic_check %q service_id must be set", s.Name)
+	}
+	if s.Interval < 0 || s.Timeout < 0 {
+		return fmt.Errorf("synthetic_check %q interval and timeout cannot be negative", s.Name)
+	}
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("synthetic_check %q must have at least one step", s.Name)
+	}
+
+	names := make(map[string]bool)
+	extracted := make(map[string]bool)
+	for _, step := range s.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("synthetic_check %q step name must be set", s.Name)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("synthetic_check %q step %q is defined more than once", s.Name, step.Name)
+		}
+		names[step.Name] = true
+		if step.URL == "" {
+			return fmt.Errorf("synthetic_check %q step %q url must be set", s.Name, step.Name)
+		}
+		for _, ref := range step.varRefs() {
+			if !extracted[ref] {
+				return fmt.Errorf("synthetic_check %q step %q references ${%s}, which no earlier step extracts",
+					s.Name, step.Name, ref)
+			}
+		}
+		if step.Assert != "" {
+			if _, err := compileAssertion(step.Assert); err != nil {
+				return fmt.Errorf("synthetic_check %q step %q assert is invalid: %v", s.Name, step.Name, err)
+			}
+		}
+		for name, expr := range step.Extract {
+			if !syntheticVarName.MatchString(name) {
+				return fmt.Errorf("synthetic_check %q step %q extracts to an invalid name %q", s.Name, step.Name, name)
+			}
+			if _, err := compileExtract(expr); err != nil {
+				return fmt.Errorf("synthetic_check %q step %q extract %q is invalid: %v", s.Name, step.Name, name, err)
+			}
+		}
+		for name := range step.Extract {
+			extracted[name] = true
+		}
+	}
+	return nil
+}
+
+// varRefs returns the names of the extracted values the step references.
+func (s SyntheticStep) varRefs() []string {
+	values := []string{s.URL, s.Body}
+	for _, headerValues := range s.Header {
+		values = append(values, headerValues...)
+	}
+	var refs []string
+	for _, value := range values {
+		for _, match := range syntheticVarPattern.FindAllStringSubmatch(value, -1) {
+			refs = append(refs, match[1])
+		}
+	}
+	return refs
+}
+
+// compileExtract compiles the expression of an extracted value.
+func compileExtract(expr string) (cel.Program, error) {
+	ast, issues := assertEnv.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	return assertEnv.Program(ast)
+}
+
+// decodeSyntheticCheck decodes a synthetic check stored in the KV store, in
+// HCL or JSON like a synthetic_check block. Its name is the key's.
+func decodeSyntheticCheck(name string, value []byte) (SyntheticCheck, error) {
+	var raw map[string]interface{}
+	if err := hcl.Decode(&raw, string(value)); err != nil {
+		return SyntheticCheck{}, fmt.Errorf("error parsing: %s", err)
+	}
+
+	var check SyntheticCheck
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:  configDecodeHook,
+		Result:      &check,
+		ErrorUnused: true,
+	})
+	if err != nil {
+		return SyntheticCheck{}, err
+	}
+	if err := decoder.Decode(raw); err != nil {
+		return SyntheticCheck{}, err
+	}
+	check.Name = name
+	return check, check.validate()
+}
+
+// isSyntheticCheck returns true for the catalog checks of synthetic checks.
+func isSyntheticCheck(checkID string) bool {
+	return strings.HasPrefix(checkID, syntheticCheckPrefix)
+}
+
+// syntheticChecks holds the synthetic checks from the config and the KV
+// store, by name.
+//
+// A nil syntheticChecks is valid and holds none.
+type syntheticChecks struct {
+	lock   sync.Mutex
+	checks map[string]SyntheticCheck
+
+	// changed is signaled when the checks change.
+	changed chan struct{}
+}
+
+func newSyntheticChecks() *syntheticChecks {
+	return &syntheticChecks{
+		checks:  make(map[string]SyntheticCheck),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// get returns the synthetic check with the given name.
+func (s *syntheticChecks) get(name string) (SyntheticCheck, bool) {
+	if s == nil {
+		return SyntheticCheck{}, false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	check, ok := s.checks[name]
+	return check, ok
+}
+
+// all returns the synthetic checks.
+func (s *syntheticChecks) all() map[string]SyntheticCheck {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.checks
+}
+
+// set replaces the synthetic checks, and returns true and signals changed if
+// they changed.
+func (s *syntheticChecks) set(checks map[string]SyntheticCheck) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if reflect.DeepEqual(s.checks, checks) {
+		return false
+	}
+	s.checks = checks
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// kvSyntheticChecksPath returns the path to the KV directory where synthetic
+// checks are written, keyed by their name.
+func (a *Agent) kvSyntheticChecksPath() string {
+	return a.config.KVPath + "synthetic-checks/"
+}
+
+// watchSyntheticChecks is a long running goroutine that watches the synthetic
+// checks and keeps their catalog checks on our services in sync with them, as
+// the checks of our nodes are received on checksCh.
+func (a *Agent) watchSyntheticChecks(checksCh chan api.HealthChecks) {
+	go a.watchBlocking("refreshing synthetic checks", a.refreshSyntheticChecks)
+
+	var checks api.HealthChecks
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-a.shutdownCh:
+			return
+		case checks = <-checksCh:
+		case <-a.synthetics.changed:
+		case <-retry:
+		}
+
+		retry = nil
+		if err := a.syncSyntheticChecks(checks); err != nil {
+			a.logger.Warn("Error updating synthetic checks", "error", err)
+			retry = time.After(retryTime)
+		}
+	}
+}
+
+// refreshSyntheticChecks reads the synthetic checks from the config and the
+// KV store, and signals syntheticsChanged if they changed so the running ones
+// are restarted. Invalid KV entries are skipped, and the config wins over KV
+// entries of the same name.
+func (a *Agent) refreshSyntheticChecks(opts *api.QueryOptions) (*api.QueryMeta, error) {
+	checks := make(map[string]SyntheticCheck)
+	for _, check := range a.config.SyntheticChecks {
+		checks[check.Name] = check
+	}
+
+	prefix := a.kvSyntheticChecksPath()
+	pairs, meta, err := a.client.KV().List(prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		name := strings.TrimPrefix(pair.Key, prefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		if _, ok := checks[name]; ok {
+			a.logger.Warn("Synthetic check is defined in the config, ignoring KV entry", "key", pair.Key)
+			continue
+		}
+		check, err := decodeSyntheticCheck(name, pair.Value)
+		if err != nil {
+			a.logger.Warn("Invalid synthetic check in KV", "key", pair.Key, "error", err)
+			continue
+		}
+		checks[name] = check
+	}
+
+	if a.synthetics.set(checks) {
+		a.logger.Info("Synthetic checks changed", "count", len(checks))
+		select {
+		case a.syntheticsChanged <- struct{}{}:
+		default:
+		}
+	}
+	return meta, nil
+}
+
+// syncSyntheticChecks registers the catalog check of each synthetic check on
+// its service on our nodes, and removes the ones whose synthetic check or
+// service is gone. The services are found through the given checks of our
+// nodes.
+func (a *Agent) syncSyntheticChecks(checks api.HealthChecks) error {
+	existing := make(map[types.CheckID]*api.HealthCheck)
+	services := make(map[string]map[string]*api.HealthCheck)
+	for _, check := range checks {
+		if isSyntheticCheck(check.CheckID) {
+			existing[hashCheck(check)] = check
+		}
+		if check.ServiceID == "" {
+			continue
+		}
+		if services[check.Node] == nil {
+			services[check.Node] = make(map[string]*api.HealthCheck)
+		}
+		services[check.Node][check.ServiceID] = check
+	}
+
+	desired := make(map[types.CheckID]*api.HealthCheck)
+	for name, synthetic := range a.synthetics.all() {
+		for node, nodeServices := range services {
+			if synthetic.Node != "" && synthetic.Node != node {
+				continue
+			}
+			service, ok := nodeServices[synthetic.ServiceID]
+			if !ok {
+				continue
+			}
+			check := &api.HealthCheck{
+				Node:        node,
+				CheckID:     syntheticCheckPrefix + name,
+				Name:        "Synthetic check " + name,
+				Status:      api.HealthCritical,
+				Notes:       syntheticCheckNotes,
+				ServiceID:   service.ServiceID,
+				ServiceName: service.ServiceName,
+				Namespace:   service.Namespace,
+				Partition:   service.Partition,
+				Definition: api.HealthCheckDefinition{
+					IntervalDuration: synthetic.Interval,
+					TimeoutDuration:  synthetic.Timeout,
+				},
+			}
+			desired[hashCheck(check)] = check
+		}
+	}
+
+	var ops api.TxnOps
+	for key, check := range desired {
+		current, ok := existing[key]
+		if ok && current.Name == check.Name &&
+			current.Definition.IntervalDuration == check.Definition.IntervalDuration &&
+			current.Definition.TimeoutDuration == check.Definition.TimeoutDuration {
+			continue
+		}
+		if ok {
+			// Keep the status until the check runs again.
+			check.Status = current.Status
+			check.Output = current.Output
+		}
+		a.logger.Info("Registering synthetic check", "node", check.Node, "serviceID", check.ServiceID,
+			"checkID", check.CheckID)
+		ops = append(ops, &api.TxnOp{Check: &api.CheckTxnOp{Verb: api.CheckSet, Check: *check}})
+	}
+	for key, check := range existing {
+		if _, ok := desired[key]; !ok {
+			a.logger.Info("Deregistering synthetic check", "node", check.Node, "serviceID", check.ServiceID,
+				"checkID", check.CheckID)
+			ops = append(ops, &api.TxnOp{Check: &api.CheckTxnOp{Verb: api.CheckDelete, Check: *check}})
+		}
+	}
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maximumTransactionSize {
+			n = maximumTransactionSize
+		}
+		if err := a.runClientTxn(ops[:n]); err != nil {
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// Update a synthetic check
+func (c *CheckRunner) updateCheckSynthetic(
+	latestCheck *api.HealthCheck, checkHash types.CheckID,
+	definition *api.HealthCheckDefinition, extras checkExtras, synthetic SyntheticCheck,
+	updated, added checkIDSet,
+) bool {
+	tlsConfigs := make([]*tls.Config, len(synthetic.Steps))
+	for i, step := range synthetic.Steps {
+		tlsConfigs[i] = c.checkTLSConfig(&api.HealthCheckDefinition{HTTP: step.URL}, extras)
+	}
+	check := &CheckSynthetic{
+		CheckID:          structs.CheckID{ID: checkHash},
+		Synthetic:        synthetic,
+		Interval:         definition.IntervalDuration,
+		Timeout:          definition.TimeoutDuration,
+		Logger:           c.logger,
+		TLSClientConfigs: tlsConfigs,
+		Proxies:          c.proxies,
+		Secrets:          c.secrets,
+		Notifier:         c,
+	}
+
+	if existing, checkExists := c.checks.Load(checkHash); checkExists {
+		syntheticCheck, syntheticCheckExists := c.checksSynthetic.Load(checkHash)
+		if syntheticCheckExists &&
+			reflect.DeepEqual(syntheticCheck.Synthetic, check.Synthetic) &&
+			syntheticCheck.tlsConfigsEqual(check.TLSClientConfigs) &&
+			syntheticCheck.Proxies == check.Proxies &&
+			syntheticCheck.Interval == check.Interval &&
+			syntheticCheck.Timeout == check.Timeout &&
+			existing.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
+			return false
+		}
+
+		c.logger.Info("Updating synthetic check", "checkHash", checkHash)
+
+		if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency: updated synthetic check was not running", "checkHash", checkHash)
+			return false
+		}
+
+		updated[checkHash] = true
+	} else {
+		c.logger.Debug("Added synthetic check", "checkHash", checkHash)
+		added[checkHash] = true
+	}
+
+	check.Start()
+	c.checksSynthetic.Store(checkHash, check)
+
+	return true
+}
+
+// CheckSynthetic runs the steps of a synthetic check in order, sharing a
+// cookie jar, and sets the status to the worst of theirs. A critical step
+// ends the transaction. The output lists the result and latency of each step.
+type CheckSynthetic struct {
+	CheckID   structs.CheckID
+	Synthetic SyntheticCheck
+	Interval  time.Duration
+	Timeout   time.Duration
+	Logger    hclog.Logger
+	Notifier  consulchecks.CheckNotifier
+
+	// TLSClientConfigs are the TLS configs of the steps.
+	TLSClientConfigs []*tls.Config
+
+	// Proxies select the proxy of each step. If nil, the proxy environment
+	// variables are used.
+	Proxies *proxyRules
+
+	// Secrets resolves the secret references in the step headers. The
+	// secrets are redacted from the output.
+	Secrets *secretResolver
+
+	steps    []syntheticStepProgram
+	initOnce sync.Once
+
+	periodicRunner
+}
+
+// syntheticStepProgram holds the compiled expressions and the transport of a
+// step.
+type syntheticStepProgram struct {
+	assert    cel.Program
+	extract   map[string]cel.Program
+	transport *http.Transport
+	err       error
+}
+
+// tlsConfigsEqual returns true if the steps use the same TLS configs.
+func (c *CheckSynthetic) tlsConfigsEqual(configs []*tls.Config) bool {
+	if len(c.TLSClientConfigs) != len(configs) {
+		return false
+	}
+	for i := range configs {
+		if !tlsConfigsEqual(c.TLSClientConfigs[i], configs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Start is used to start the check. The check runs until stop is called.
+func (c *CheckSynthetic) Start() {
+	c.initOnce.Do(c.init)
+	c.start(c.Interval, c.Notifier, c.check)
+}
+
+// init compiles the expressions and creates the transports of the steps.
+func (c *CheckSynthetic) init() {
+	c.steps = make([]syntheticStepProgram, len(c.Synthetic.Steps))
+	for i, step := range c.Synthetic.Steps {
+		program := &c.steps[i]
+		if step.Assert != "" {
+			if program.assert, program.err = compileAssertion(step.Assert); program.err != nil {
+				program.err = fmt.Errorf("invalid assertion: %w", program.err)
+			}
+		}
+		program.extract = make(map[string]cel.Program, len(step.Extract))
+		for name, expr := range step.Extract {
+			extract, err := compileExtract(expr)
+			if err != nil {
+				program.err = fmt.Errorf("invalid extract %q: %w", name, err)
+				continue
+			}
+			program.extract[name] = extract
+		}
+
+		// Keep-alives are disabled to prevent failing checks due to the
+		// keepalive interval.
+		trans := cleanhttp.DefaultTransport()
+		trans.DisableKeepAlives = true
+		if i < len(c.TLSClientConfigs) {
+			trans.TLSClientConfig = c.TLSClientConfigs[i]
+		}
+		trans.Proxy = c.Proxies.transportProxy()
+		program.transport = trans
+	}
+}
+
+// RunOnce runs the check right away and passes its result to the notifier.
+func (c *CheckSynthetic) RunOnce(notifier consulchecks.CheckNotifier) {
+	c.initOnce.Do(c.init)
+	c.check(notifier)
+}
+
+// check runs the steps and sets the status from their results.
+func (c *CheckSynthetic) check(notifier consulchecks.CheckNotifier) {
+	jar, _ := cookiejar.New(nil)
+	vars := make(map[string]string)
+	var secrets []string
+
+	status := api.HealthPassing
+	lines := make([]string, 0, len(c.Synthetic.Steps))
+	for i, step := range c.Synthetic.Steps {
+		if status == api.HealthCritical {
+			lines = append(lines, fmt.Sprintf("%s: skipped", step.Name))
+			continue
+		}
+		stepStatus, line, stepSecrets := c.runStep(step, c.steps[i], jar, vars)
+		secrets = append(secrets, stepSecrets...)
+		lines = append(lines, line)
+		status = worseStatus(status, stepStatus)
+	}
+
+	output := fmt.Sprintf("Synthetic check %s: %s\n%s", c.Synthetic.Name, status, strings.Join(lines, "\n"))
+	notifier.UpdateCheck(c.CheckID, status, redactSecrets(output, secrets))
+}
+
+// runStep performs the request of a step, and returns its status, its output
+// line and the secrets it used. The values it extracts are added to vars, and
+// to the secrets as they are sent in the requests of later steps.
+func (c *CheckSynthetic) runStep(step SyntheticStep, program syntheticStepProgram, jar http.CookieJar,
+	vars map[string]string,
+) (string, string, []string) {
+	method := step.Method
+	if method == "" {
+		method = "GET"
+	}
+	prefix := fmt.Sprintf("%s: %s %s", step.Name, method, step.URL)
+	if program.err != nil {
+		return api.HealthCritical, prefix + ": " + program.err.Error(), nil
+	}
+
+	header := step.Header
+	var secrets []string
+	var err error
+	if hasSecretRefs(header) {
+		if header, secrets, err = c.Secrets.ResolveHeader(header); err != nil {
+			return api.HealthCritical, prefix + ": invalid header: " + err.Error(), nil
+		}
+	}
+	replace := func(value string) string {
+		return syntheticVarPattern.ReplaceAllStringFunc(value, func(ref string) string {
+			return vars[ref[2:len(ref)-1]]
+		})
+	}
+
+	req, err := http.NewRequest(method, replace(step.URL), strings.NewReader(replace(step.Body)))
+	if err != nil {
+		return api.HealthCritical, prefix + ": " + err.Error(), secrets
+	}
+	req.Header = make(http.Header, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, replace(value))
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", consulchecks.UserAgent)
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json, text/plain, text/*, */*")
+	}
+
+	client := &http.Client{
+		Transport: program.transport,
+		Jar:       jar,
+		Timeout:   defaultSyntheticTimeout,
+	}
+	if c.Timeout > 0 {
+		client.Timeout = c.Timeout
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return api.HealthCritical, fmt.Sprintf("%s: %s (%s)", prefix, err, elapsedSince(start)), secrets
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAssertBodySize))
+	if err != nil {
+		c.Logger.Warn("Check error while reading body", "check", c.CheckID.String(), "step", step.Name, "error", err)
+	}
+	elapsed := elapsedSince(start)
+
+	line := fmt.Sprintf("%s: %s", prefix, resp.Status)
+	var status string
+	if program.assert == nil {
+		status = statusFromCode(resp.StatusCode)
+	} else if status, err = evaluateAssertion(program.assert, resp, body); err != nil {
+		line += fmt.Sprintf(", assertion failed: %s", err)
+	} else {
+		line += fmt.Sprintf(", assertion returned %s", status)
+	}
+
+	if status != api.HealthCritical {
+		respVars := responseVars(resp, body)
+		for name, extract := range program.extract {
+			result, _, err := extract.Eval(respVars)
+			if err != nil {
+				status = api.HealthCritical
+				line += fmt.Sprintf(", extracting %s failed: %s", name, err)
+				continue
+			}
+			vars[name] = fmt.Sprint(result.Value())
+			secrets = append(secrets, vars[name])
+		}
+	}
+
+	line += fmt.Sprintf(" (%s)", elapsed)
+	if status != api.HealthPassing {
+		if len(body) > consulchecks.DefaultBufSize {
+			body = body[:consulchecks.DefaultBufSize]
+		}
+		line += " Output: " + string(body)
+	}
+	return status, line, secrets
+}
+
+// elapsedSince returns the time elapsed since start, rounded for the output.
+func elapsedSince(start time.Time) time.Duration {
+	return time.Since(start).Round(time.Millisecond)
+}
+
+// worseStatus returns the worst of two statuses.
+func worseStatus(a, b string) string {
+	rank := map[string]int{api.HealthPassing: 0, api.HealthWarning: 1, api.HealthCritical: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
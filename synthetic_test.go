@@ -0,0 +1,366 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeSyntheticCheck(t *testing.T) {
+	expected := SyntheticCheck{
+		Name:      "partner-login",
+		ServiceID: "partner-api",
+		Interval:  time.Minute,
+		Steps: []SyntheticStep{
+			{
+				Name:    "login",
+				Method:  "POST",
+				URL:     "https://api.partner.example.com/login",
+				Body:    `{"user":"esm"}`,
+				Extract: map[string]string{"token": "json.token"},
+			},
+			{
+				Name:   "orders",
+				URL:    "https://api.partner.example.com/orders",
+				Header: map[string][]string{"Authorization": {"Bearer ${token}"}},
+				Assert: "status == 200 && size(json.orders) > 0",
+			},
+		},
+	}
+
+	check, err := decodeSyntheticCheck("partner-login", []byte(`
+service_id = "partner-api"
+interval = "1m"
+step {
+  name = "login"
+  method = "POST"
+  url = "https://api.partner.example.com/login"
+  body = "{\"user\":\"esm\"}"
+  extract {
+    token = "json.token"
+  }
+}
+step {
+  name = "orders"
+  url = "https://api.partner.example.com/orders"
+  header {
+    Authorization = ["Bearer ${token}"]
+  }
+  assert = "status == 200 && size(json.orders) > 0"
+}`))
+	require.NoError(t, err)
+	require.Equal(t, expected, check)
+
+	check, err = decodeSyntheticCheck("partner-login", []byte(`{
+  "service_id": "partner-api",
+  "interval": "1m",
+  "step": [
+    {
+      "name": "login",
+      "method": "POST",
+      "url": "https://api.partner.example.com/login",
+      "body": "{\"user\":\"esm\"}",
+      "extract": {"token": "json.token"}
+    },
+    {
+      "name": "orders",
+      "url": "https://api.partner.example.com/orders",
+      "header": {"Authorization": ["Bearer ${token}"]},
+      "assert": "status == 200 && size(json.orders) > 0"
+    }
+  ]
+}`))
+	require.NoError(t, err)
+	require.Equal(t, expected, check)
+
+	_, err = decodeSyntheticCheck("partner-login", []byte(`service_id = "partner-api"`))
+	require.EqualError(t, err, `synthetic_check "partner-login" must have at least one step`)
+	_, err = decodeSyntheticCheck("partner-login", []byte(`services = "partner-api"`))
+	require.ErrorContains(t, err, "invalid keys: services")
+}
+
+func TestSyntheticCheck_validate(t *testing.T) {
+	step := SyntheticStep{Name: "home", URL: "https://example.com"}
+	cases := map[string]SyntheticCheck{
+		`synthetic_check name must be set`: {ServiceID: "web", Steps: []SyntheticStep{step}},
+		`synthetic_check "a/b" name cannot contain a /`: {
+			Name: "a/b", ServiceID: "web", Steps: []SyntheticStep{step},
+		},
+		`synthetic_check "home" service_id must be set`: {Name: "home", Steps: []SyntheticStep{step}},
+		`synthetic_check "home" step "home" is defined more than once`: {
+			Name: "home", ServiceID: "web", Steps: []SyntheticStep{step, step},
+		},
+		`synthetic_check "home" step "home" url must be set`: {
+			Name: "home", ServiceID: "web", Steps: []SyntheticStep{{Name: "home"}},
+		},
+		`synthetic_check "home" step "home" references ${token}, which no earlier step extracts`: {
+			Name: "home", ServiceID: "web", Steps: []SyntheticStep{{
+				Name:    "home",
+				URL:     "https://example.com/${token}",
+				Extract: map[string]string{"token": "body"},
+			}},
+		},
+		`synthetic_check "home" step "home" extracts to an invalid name "a-b"`: {
+			Name: "home", ServiceID: "web", Steps: []SyntheticStep{{
+				Name: "home", URL: "https://example.com", Extract: map[string]string{"a-b": "body"},
+			}},
+		},
+	}
+	for expected, check := range cases {
+		require.EqualError(t, check.validate(), expected)
+	}
+
+	invalid := SyntheticCheck{Name: "home", ServiceID: "web", Steps: []SyntheticStep{{
+		Name: "home", URL: "https://example.com", Assert: "status ==",
+	}}}
+	require.ErrorContains(t, invalid.validate(), `synthetic_check "home" step "home" assert is invalid`)
+}
+
+func TestCheckSynthetic(t *testing.T) {
+	var orders string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+			w.Write([]byte(`{"token":"t0k3n","account":4242}`))
+		case "/accounts/4242/orders":
+			cookie, err := r.Cookie("session")
+			if err != nil || cookie.Value != "abc" || r.Header.Get("Authorization") != "Bearer t0k3n" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"orders":` + orders + `}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	run := func(steps ...SyntheticStep) *recordingNotifier {
+		notifier := &recordingNotifier{}
+		check := &CheckSynthetic{
+			CheckID: structs.CheckID{ID: "synthetic"},
+			Synthetic: SyntheticCheck{
+				Name:      "partner-login",
+				ServiceID: "partner-api",
+				Steps:     steps,
+			},
+			Interval:         time.Hour,
+			Logger:           hclog.NewNullLogger(),
+			TLSClientConfigs: []*tls.Config{{}, {}, {}},
+		}
+		check.RunOnce(notifier)
+		return notifier
+	}
+	login := SyntheticStep{
+		Name:    "login",
+		Method:  "POST",
+		URL:     server.URL + "/login",
+		Extract: map[string]string{"token": "json.token", "account": "json.account"},
+	}
+	list := SyntheticStep{
+		Name:   "orders",
+		URL:    server.URL + "/accounts/${account}/orders",
+		Header: map[string][]string{"Authorization": {"Bearer ${token}"}},
+		Assert: "json.orders != null ? 'passing' : 'warning'",
+	}
+	logout := SyntheticStep{Name: "logout", URL: server.URL + "/logout"}
+
+	orders = "[{}]"
+	notifier := run(login, list)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	lines := strings.Split(notifier.output, "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "Synthetic check partner-login: passing", lines[0])
+	require.Regexp(t, `^login: POST http://.*/login: 200 OK \(\d+m?s\)$`, lines[1])
+	require.Regexp(t, `^orders: GET http://.*/accounts/\$\{account\}/orders: 200 OK, assertion returned passing \(\d+m?s\)$`,
+		lines[2])
+
+	// Warning steps don't end the transaction, critical ones do.
+	orders = "null"
+	notifier = run(login, list, logout)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	lines = strings.Split(notifier.output, "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, "Synthetic check partner-login: critical", lines[0])
+	require.Contains(t, lines[2], "assertion returned warning")
+	require.Contains(t, lines[2], `Output: {"orders":null}`)
+	require.Contains(t, lines[3], "404 Not Found")
+
+	notifier = run(SyntheticStep{Name: "login", URL: server.URL + "/missing"}, logout)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "login: GET "+server.URL+"/missing: 404 Not Found")
+	require.Contains(t, notifier.output, "\nlogout: skipped")
+
+	// Extracted values are redacted from the output.
+	notifier = run(SyntheticStep{
+		Name:    "login",
+		URL:     server.URL + "/login",
+		Extract: map[string]string{"token": "json.token"},
+		Assert:  "'warning'",
+	})
+	require.Equal(t, api.HealthWarning, notifier.status)
+	require.Contains(t, notifier.output, `Output: {"token":"[redacted]","account":4242}`)
+
+	notifier = run(SyntheticStep{Name: "login", URL: server.URL + "/login", Extract: map[string]string{"token": "json.missing"}})
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "extracting token failed: no such key: missing")
+}
+
+func TestSyntheticChecks_sync(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	require.NoError(t, err)
+
+	// The services are found through their checks, and only on our nodes.
+	for _, node := range []string{"external1", "external2", "external3"} {
+		_, err = client.Catalog().Register(&api.CatalogRegistration{
+			Node:       node,
+			Address:    "service.local",
+			Datacenter: "dc1",
+			NodeMeta:   map[string]string{"external-node": "true"},
+			Service: &api.AgentService{
+				ID:      "partner-api",
+				Service: "partner",
+			},
+			Check: &api.AgentCheck{
+				CheckID:   "partner-tcp",
+				Name:      "partner-tcp",
+				ServiceID: "partner-api",
+				Definition: api.HealthCheckDefinition{
+					TCP:              "service.local:443",
+					IntervalDuration: time.Minute,
+				},
+			},
+		}, nil)
+		require.NoError(t, err)
+	}
+
+	conf, err := DefaultConfig()
+	require.NoError(t, err)
+	conf.SyntheticChecks = []SyntheticCheck{{
+		Name:      "home",
+		ServiceID: "partner-api",
+		Node:      "external2",
+		Steps:     []SyntheticStep{{Name: "home", URL: "http://service.local"}},
+	}}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	agent := &Agent{
+		client:            client,
+		config:            conf,
+		logger:            logger,
+		synthetics:        newSyntheticChecks(),
+		syntheticsChanged: make(chan struct{}, 1),
+	}
+	ourNodes := map[string]bool{"external1": true, "external2": true}
+
+	sync := func() map[string]*api.HealthCheck {
+		state := func() api.HealthChecks {
+			checks, _, err := client.Health().State(api.HealthAny, nil)
+			require.NoError(t, err)
+			return checks
+		}
+
+		_, err := agent.refreshSyntheticChecks(agent.ConsulQueryOption())
+		require.NoError(t, err)
+		var nodeChecks api.HealthChecks
+		for _, check := range state() {
+			if ourNodes[check.Node] {
+				nodeChecks = append(nodeChecks, check)
+			}
+		}
+		require.NoError(t, agent.syncSyntheticChecks(nodeChecks))
+		found := make(map[string]*api.HealthCheck)
+		for _, check := range state() {
+			if isSyntheticCheck(check.CheckID) {
+				found[check.Node+"/"+check.CheckID] = check
+			}
+		}
+		return found
+	}
+
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   agent.kvSyntheticChecksPath() + "login",
+		Value: []byte("service_id = \"partner-api\"\ninterval = \"1m\"\nstep {\n  name = \"login\"\n  url = \"http://service.local/login\"\n}"),
+	}, nil)
+	require.NoError(t, err)
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   agent.kvSyntheticChecksPath() + "invalid",
+		Value: []byte(`service_id = "partner-api"`),
+	}, nil)
+	require.NoError(t, err)
+
+	checks := sync()
+	require.Len(t, checks, 3)
+	login := checks["external1/esm-synthetic:login"]
+	require.NotNil(t, login)
+	require.Equal(t, "partner-api", login.ServiceID)
+	require.Equal(t, "partner", login.ServiceName)
+	require.Equal(t, api.HealthCritical, login.Status)
+	require.Equal(t, time.Minute, login.Definition.IntervalDuration)
+	require.NotNil(t, checks["external2/esm-synthetic:login"])
+	require.NotNil(t, checks["external2/esm-synthetic:home"])
+	require.Len(t, agent.syntheticsChanged, 1)
+	<-agent.syntheticsChanged
+
+	// The runner runs the catalog checks with the steps of their synthetic
+	// check.
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	defer runner.Stop()
+	runner.synthetics = agent.synthetics
+	runner.UpdateChecks(api.HealthChecks{login})
+	syntheticCheck, ok := runner.checksSynthetic.Load(hashCheck(login))
+	require.True(t, ok)
+	require.Equal(t, "login", syntheticCheck.Synthetic.Steps[0].Name)
+	require.Equal(t, time.Minute, syntheticCheck.Interval)
+
+	// Changing a check only signals the change, the catalog check stays.
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   agent.kvSyntheticChecksPath() + "login",
+		Value: []byte("service_id = \"partner-api\"\ninterval = \"1m\"\nstep {\n  name = \"signin\"\n  url = \"http://service.local/signin\"\n}"),
+	}, nil)
+	require.NoError(t, err)
+	checks = sync()
+	require.Len(t, checks, 3)
+	require.Len(t, agent.syntheticsChanged, 1)
+
+	runner.UpdateChecks(api.HealthChecks{login})
+	updated, ok := runner.checksSynthetic.Load(hashCheck(login))
+	require.True(t, ok)
+	require.NotSame(t, syntheticCheck, updated)
+	require.Equal(t, "signin", updated.Synthetic.Steps[0].Name)
+
+	// Removed checks are deregistered, and stop running.
+	_, err = client.KV().Delete(agent.kvSyntheticChecksPath()+"login", nil)
+	require.NoError(t, err)
+	checks = sync()
+	require.Len(t, checks, 1)
+	require.NotNil(t, checks["external2/esm-synthetic:home"])
+
+	runner.UpdateChecks(api.HealthChecks{login})
+	_, ok = runner.checksSynthetic.Load(hashCheck(login))
+	require.False(t, ok)
+}
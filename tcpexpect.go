@@ -0,0 +1,306 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulchecks "github.com/hashicorp/consul/agent/checks"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// tcpPresetDirective is the check notes directive selecting the payload
+	// and expected response of a TCP check from tcpPresets.
+	tcpPresetDirective = "esm-tcp-preset"
+
+	// tcpSendDirective is the check notes directive holding the payload a TCP
+	// check sends once connected, with the escapes unescapeTCPPayload handles.
+	tcpSendDirective = "esm-tcp-send"
+
+	// tcpExpectDirective is the check notes directive holding the regular
+	// expression a TCP check's response must match.
+	tcpExpectDirective = "esm-tcp-expect"
+
+	// maxTCPResponseSize is the size of the response matched against the
+	// expected pattern. Reading stops there.
+	maxTCPResponseSize = 4096
+)
+
+// tcpPresets are the payloads and expected responses of common protocols.
+var tcpPresets = map[string]tcpExpect{
+	"redis-ping": {
+		send:   "PING\r\n",
+		expect: regexp.MustCompile(`^\+PONG\r\n`),
+	},
+	"smtp-banner": {
+		expect: regexp.MustCompile(`^220[ -]`),
+	},
+	"postgres-ssl-request": {
+		// An SSLRequest message, answered with a single S or N byte.
+		send:   "\x00\x00\x00\x08\x04\xd2\x16\x2f",
+		expect: regexp.MustCompile(`^[SN]`),
+	},
+}
+
+// tcpExpect is the payload a TCP check sends and the pattern its response
+// must match.
+type tcpExpect struct {
+	send   string
+	expect *regexp.Regexp
+}
+
+// equal returns whether both send the same payload and expect the same
+// pattern.
+func (t tcpExpect) equal(other tcpExpect) bool {
+	if t.send != other.send || (t.expect == nil) != (other.expect == nil) {
+		return false
+	}
+	return t.expect == nil || t.expect.String() == other.expect.String()
+}
+
+// parseTCPExpect returns the payload and expected response set by a check's
+// directives, and false if it has none. The send and expect directives
+// override those of the preset.
+func parseTCPExpect(check *api.HealthCheck) (tcpExpect, bool, error) {
+	preset, hasPreset := checkDirective(check, tcpPresetDirective)
+	send, hasSend := checkDirective(check, tcpSendDirective)
+	expect, hasExpect := checkDirective(check, tcpExpectDirective)
+	if !hasPreset && !hasSend && !hasExpect {
+		return tcpExpect{}, false, nil
+	}
+
+	var options tcpExpect
+	if hasPreset {
+		var ok bool
+		if options, ok = tcpPresets[preset]; !ok {
+			names := make([]string, 0, len(tcpPresets))
+			for name := range tcpPresets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return tcpExpect{}, true, fmt.Errorf("unknown %s %q, must be one of %s",
+				tcpPresetDirective, preset, strings.Join(names, ", "))
+		}
+	}
+	if hasSend {
+		payload, err := unescapeTCPPayload(send)
+		if err != nil {
+			return tcpExpect{}, true, fmt.Errorf("invalid %s: %s", tcpSendDirective, err)
+		}
+		options.send = payload
+	}
+	if hasExpect {
+		pattern, err := regexp.Compile(expect)
+		if err != nil {
+			return tcpExpect{}, true, fmt.Errorf("invalid %s: %s", tcpExpectDirective, err)
+		}
+		options.expect = pattern
+	}
+	if options.expect == nil {
+		return tcpExpect{}, true, fmt.Errorf("%s must be set", tcpExpectDirective)
+	}
+	return options, true, nil
+}
+
+// unescapeTCPPayload replaces the \r, \n, \t, \xNN and \\ escapes in the
+// payload of a TCP check. Other escapes are invalid, and all other characters,
+// quotes included, are sent as is.
+func unescapeTCPPayload(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		i++
+		switch s[i] {
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case '\\':
+			b.WriteByte('\\')
+		case 'x':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("incomplete escape \\x%s", s[i+1:])
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape \\x%s", s[i+1:i+3])
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// Update a send/expect TCP check
+func (c *CheckRunner) updateCheckTCPExpect(
+	latestCheck *api.HealthCheck, checkHash types.CheckID,
+	definition *api.HealthCheckDefinition, extras checkExtras, options tcpExpect, optionsErr error,
+	updated, added checkIDSet,
+) bool {
+	expectCheck := &CheckTCPExpect{
+		CheckID:  structs.CheckID{ID: checkHash},
+		TCP:      definition.TCP,
+		Send:     options.send,
+		Expect:   options.expect,
+		Interval: definition.IntervalDuration,
+		Timeout:  definition.TimeoutDuration,
+		Logger:   c.logger,
+		Notifier: c,
+		err:      optionsErr,
+	}
+	if definition.TCPUseTLS {
+		expectCheck.TLSClientConfig = c.checkTLSConfig(definition, extras)
+	}
+
+	if check, checkExists := c.checks.Load(checkHash); checkExists {
+		existing, expectCheckExists := c.checksTCPExpect.Load(checkHash)
+		if expectCheckExists &&
+			existing.TCP == expectCheck.TCP &&
+			existing.options().equal(options) &&
+			fmt.Sprint(existing.err) == fmt.Sprint(expectCheck.err) &&
+			tlsConfigsEqual(existing.TLSClientConfig, expectCheck.TLSClientConfig) &&
+			existing.Interval == expectCheck.Interval &&
+			existing.Timeout == expectCheck.Timeout &&
+			check.Definition.DeregisterCriticalServiceAfter == definition.DeregisterCriticalServiceAfter {
+			return false
+		}
+
+		c.logger.Info("Updating send/expect TCP check", "checkHash", checkHash)
+
+		if !c.stopCheck(checkHash) {
+			c.logger.Warn("Inconsistency: updated send/expect TCP check was not running", "checkHash", checkHash)
+			return false
+		}
+
+		updated[checkHash] = true
+	} else {
+		c.logger.Debug("Added send/expect TCP check", "checkHash", checkHash)
+		added[checkHash] = true
+	}
+
+	expectCheck.Start()
+	c.checksTCPExpect.Store(checkHash, expectCheck)
+
+	return true
+}
+
+// CheckTCPExpect is a TCP check run by ESM in place of Consul's CheckTCP for
+// the checks with a payload or an expected response. It connects, over TLS
+// if TLSClientConfig is set, sends the payload and reads the response until
+// it matches the expected pattern. The check is critical if the connection
+// fails, or if the response doesn't match by the time the server stops
+// sending, the timeout expires or maxTCPResponseSize bytes are read.
+type CheckTCPExpect struct {
+	CheckID         structs.CheckID
+	TCP             string
+	Send            string
+	Expect          *regexp.Regexp
+	Interval        time.Duration
+	Timeout         time.Duration
+	Logger          hclog.Logger
+	TLSClientConfig *tls.Config
+	Notifier        consulchecks.CheckNotifier
+
+	// err is the error of invalid directives, reported as the output.
+	err error
+
+	periodicRunner
+}
+
+// options returns the payload and the expected pattern of the check.
+func (c *CheckTCPExpect) options() tcpExpect {
+	return tcpExpect{send: c.Send, expect: c.Expect}
+}
+
+// Start is used to start the check. The check runs until stop is called.
+func (c *CheckTCPExpect) Start() {
+	c.start(c.Interval, c.Notifier, c.check)
+}
+
+// RunOnce runs the check right away and passes its result to the notifier.
+func (c *CheckTCPExpect) RunOnce(notifier consulchecks.CheckNotifier) {
+	c.check(notifier)
+}
+
+// check sends the payload and matches the response.
+func (c *CheckTCPExpect) check(notifier consulchecks.CheckNotifier) {
+	if c.err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("Invalid TCP check directives: %s", c.err))
+		return
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	start := time.Now()
+	conn, err := c.dial(timeout)
+	if err != nil {
+		notifier.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("TCP connect %s: %s", c.TCP, err))
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+
+	if c.Send != "" {
+		if _, err := io.WriteString(conn, c.Send); err != nil {
+			notifier.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("TCP send to %s: %s", c.TCP, err))
+			return
+		}
+	}
+
+	// Read until the response matches, as it may come in several segments.
+	var response []byte
+	buf := make([]byte, maxTCPResponseSize)
+	for len(response) < maxTCPResponseSize {
+		n, err := conn.Read(buf[:maxTCPResponseSize-len(response)])
+		response = append(response, buf[:n]...)
+		if c.Expect.Match(response) {
+			notifier.UpdateCheck(c.CheckID, api.HealthPassing,
+				fmt.Sprintf("TCP %s: response %q matched %s in %s", c.TCP, response, c.Expect, elapsedSince(start)))
+			return
+		}
+		if err != nil {
+			if len(response) == 0 {
+				notifier.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("TCP %s: no response: %s", c.TCP, err))
+				return
+			}
+			break
+		}
+	}
+	notifier.UpdateCheck(c.CheckID, api.HealthCritical,
+		fmt.Sprintf("TCP %s: response %q doesn't match %s", c.TCP, response, c.Expect))
+}
+
+// dial connects to the target, with TLS if the check uses it.
+func (c *CheckTCPExpect) dial(timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if c.TLSClientConfig == nil {
+		return dialer.Dial("tcp", c.TCP)
+	}
+	return tls.DialWithDialer(dialer, "tcp", c.TCP, c.TLSClientConfig)
+}
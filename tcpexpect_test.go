@@ -0,0 +1,214 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// testTCPServer starts a TCP server handling each connection with the
+// handler, over TLS if tlsConfig is set. It returns its address.
+func testTCPServer(t *testing.T, tlsConfig *tls.Config, handler func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestParseTCPExpect(t *testing.T) {
+	parse := func(notes string) (tcpExpect, bool, error) {
+		return parseTCPExpect(&api.HealthCheck{Notes: notes})
+	}
+
+	_, ok, err := parse("Partner SMTP relay")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	options, ok, err := parse("esm-tcp-preset: redis-ping")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "PING\r\n", options.send)
+	require.Equal(t, `^\+PONG\r\n`, options.expect.String())
+
+	// The send and expect directives override the preset's.
+	options, _, err = parse("esm-tcp-preset: redis-ping\nesm-tcp-expect: ^(\\+PONG|-NOAUTH)")
+	require.NoError(t, err)
+	require.Equal(t, "PING\r\n", options.send)
+	require.Equal(t, `^(\+PONG|-NOAUTH)`, options.expect.String())
+
+	// Quotes and escaped backslashes are sent as is.
+	for send, expected := range map[string]string{
+		`HELLO "esm"\r\n`:  "HELLO \"esm\"\r\n",
+		`SET k \\"v\\"\t1`: `SET k \"v\"` + "\t1",
+		`C:\\esm\\"x"`:     `C:\esm\"x"`,
+		`\x00\x1b[0m\n`:    "\x00\x1b[0m\n",
+		`"\\\\"`:           `"\\"`,
+	} {
+		options, _, err = parse("esm-tcp-send: " + send + "\nesm-tcp-expect: ^OK")
+		require.NoError(t, err, send)
+		require.Equal(t, expected, options.send, send)
+	}
+
+	for notes, expected := range map[string]string{
+		"esm-tcp-preset: mysql":                    `unknown esm-tcp-preset "mysql", must be one of postgres-ssl-request, redis-ping, smtp-banner`,
+		"esm-tcp-send: \\q\nesm-tcp-expect: ^OK":   `invalid esm-tcp-send: invalid escape \q`,
+		"esm-tcp-send: \\\"\nesm-tcp-expect: ^OK":  `invalid esm-tcp-send: invalid escape \"`,
+		"esm-tcp-send: \\xg0\nesm-tcp-expect: ^OK": `invalid esm-tcp-send: invalid escape \xg0`,
+		"esm-tcp-send: \\x0\nesm-tcp-expect: ^OK":  `invalid esm-tcp-send: incomplete escape \x0`,
+		"esm-tcp-send: OK\\\nesm-tcp-expect: ^OK":  "invalid esm-tcp-send: trailing backslash",
+		"esm-tcp-expect: ^(OK":                     "invalid esm-tcp-expect: error parsing regexp: missing closing ): `^(OK`",
+		"esm-tcp-send: PING\\r\\n":                 "esm-tcp-expect must be set",
+	} {
+		_, ok, err := parse(notes)
+		require.True(t, ok)
+		require.EqualError(t, err, expected, notes)
+	}
+}
+
+func TestCheckTCPExpect(t *testing.T) {
+	run := func(address string, notes string, tlsConfig *tls.Config) *recordingNotifier {
+		options, _, err := parseTCPExpect(&api.HealthCheck{Notes: notes})
+		check := &CheckTCPExpect{
+			CheckID:         structs.CheckID{ID: "external/redis/tcp"},
+			TCP:             address,
+			Send:            options.send,
+			Expect:          options.expect,
+			Timeout:         200 * time.Millisecond,
+			Logger:          hclog.NewNullLogger(),
+			TLSClientConfig: tlsConfig,
+			err:             err,
+		}
+		notifier := &recordingNotifier{}
+		check.RunOnce(notifier)
+		return notifier
+	}
+
+	redis := testTCPServer(t, nil, func(conn net.Conn) {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil && line == "PING\r\n" {
+			conn.Write([]byte("+PONG\r\n"))
+		} else {
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	})
+	notifier := run(redis, "esm-tcp-preset: redis-ping", nil)
+	require.Equal(t, api.HealthPassing, notifier.status)
+	require.Regexp(t, `^TCP 127.0.0.1:\d+: response "\+PONG\\r\\n" matched \^\\\+PONG\\r\\n in \d+m?s$`, notifier.output)
+
+	notifier = run(redis, "esm-tcp-send: INFO\\r\\n\nesm-tcp-expect: ^\\+PONG", nil)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, `response "-ERR unknown command\r\n" doesn't match ^\+PONG`)
+
+	// Servers accepting the connection without answering are critical.
+	hanging := testTCPServer(t, nil, func(conn net.Conn) {
+		time.Sleep(time.Second)
+	})
+	notifier = run(hanging, "esm-tcp-preset: redis-ping", nil)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, ": no response: ")
+	require.Contains(t, notifier.output, "i/o timeout")
+
+	// Responses are matched as they come in.
+	smtp := testTCPServer(t, nil, func(conn net.Conn) {
+		conn.Write([]byte("22"))
+		time.Sleep(20 * time.Millisecond)
+		conn.Write([]byte("0 mail.example.com ESMTP\r\n"))
+		time.Sleep(time.Second)
+	})
+	notifier = run(smtp, "esm-tcp-preset: smtp-banner", nil)
+	require.Equal(t, api.HealthPassing, notifier.status)
+
+	postgres := testTCPServer(t, nil, func(conn net.Conn) {
+		request := make([]byte, 8)
+		if _, err := conn.Read(request); err == nil && string(request) == "\x00\x00\x00\x08\x04\xd2\x16\x2f" {
+			conn.Write([]byte("S"))
+		}
+	})
+	notifier = run(postgres, "esm-tcp-preset: postgres-ssl-request", nil)
+	require.Equal(t, api.HealthPassing, notifier.status)
+
+	cert := testCertificate(t, "server", time.Hour, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	smtps := testTCPServer(t, &tls.Config{Certificates: []tls.Certificate{cert}}, func(conn net.Conn) {
+		conn.Write([]byte("220 mail.example.com ESMTP\r\n"))
+	})
+	notifier = run(smtps, "esm-tcp-preset: smtp-banner", &tls.Config{RootCAs: roots})
+	require.Equal(t, api.HealthPassing, notifier.status)
+
+	notifier = run("127.0.0.1:1", "esm-tcp-preset: smtp-banner", nil)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, "TCP connect 127.0.0.1:1: ")
+
+	notifier = run(redis, "esm-tcp-preset: memcached", nil)
+	require.Equal(t, api.HealthCritical, notifier.status)
+	require.Contains(t, notifier.output, `Invalid TCP check directives: unknown esm-tcp-preset "memcached"`)
+}
+
+func TestCheck_TCPExpect(t *testing.T) {
+	runner := NewCheckRunner(hclog.NewNullLogger(), nil, 0, 0, &tls.Config{}, 0, 0)
+	defer runner.Stop()
+
+	checks := api.HealthChecks{
+		{
+			Node:    "external",
+			CheckID: "redis",
+			Notes:   "esm-tcp-preset: redis-ping",
+			Definition: api.HealthCheckDefinition{
+				TCP:              "redis.example.com:6379",
+				IntervalDuration: time.Hour,
+			},
+		},
+	}
+	hash := hashCheck(checks[0])
+
+	runner.UpdateChecks(checks)
+	expectCheck, ok := runner.checksTCPExpect.Load(hash)
+	require.True(t, ok)
+	require.Equal(t, "redis.example.com:6379", expectCheck.TCP)
+	require.Equal(t, "PING\r\n", expectCheck.Send)
+	_, ok = runner.checksTCP.Load(hash)
+	require.False(t, ok)
+
+	// Unchanged checks are left running.
+	runner.UpdateChecks(checks)
+	unchanged, ok := runner.checksTCPExpect.Load(hash)
+	require.True(t, ok)
+	require.Same(t, expectCheck, unchanged)
+
+	// Removing the directive turns it back into a plain TCP check.
+	checks[0].Notes = ""
+	runner.UpdateChecks(checks)
+	_, ok = runner.checksTCPExpect.Load(hash)
+	require.False(t, ok)
+	_, ok = runner.checksTCP.Load(hash)
+	require.True(t, ok)
+}
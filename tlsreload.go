@@ -0,0 +1,235 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+var TLSGauges = []prometheus.GaugeDefinition{
+	{
+		Name: []string{"esm", "tls", "seconds_since_reload"},
+		Help: "Seconds since the TLS configuration was last loaded successfully, by config (consul or checks)",
+	},
+}
+
+// checksTLS is the TLS configuration of the checks, swapped as a whole when
+// the files it's built from change.
+type checksTLS struct {
+	tlsConfig *tls.Config
+	rules     []tlsClientRule
+}
+
+// loadChecksTLS builds the TLS configuration of the checks from the https_*
+// options and the TLS client rules.
+func (a *Agent) loadChecksTLS() (*checksTLS, error) {
+	tlsConfig := api.TLSConfig{
+		CAFile:   a.config.HTTPSCAFile,
+		CAPath:   a.config.HTTPSCAPath,
+		CertFile: a.config.HTTPSCertFile,
+		KeyFile:  a.config.HTTPSKeyFile,
+	}
+	tlsClientConfig, err := api.SetupTLSConfig(&tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := newTLSClientRules(a.config)
+	if err != nil {
+		return nil, err
+	}
+	return &checksTLS{tlsConfig: tlsClientConfig, rules: rules}, nil
+}
+
+// checksTLSFiles returns the files and directories the TLS configuration of
+// the checks is built from.
+func (a *Agent) checksTLSFiles() []string {
+	paths := []string{
+		a.config.HTTPSCAFile, a.config.HTTPSCAPath,
+		a.config.HTTPSCertFile, a.config.HTTPSKeyFile,
+	}
+	for _, rule := range a.config.TLSClientRules {
+		paths = append(paths, rule.CAFile, rule.CAPath, rule.CertFile, rule.KeyFile)
+	}
+	return paths
+}
+
+// reloadChecksTLS swaps the TLS configuration of the checks and wakes up
+// watchHealthChecks to restart the checks using it.
+func (a *Agent) reloadChecksTLS() error {
+	checksTLS, err := a.loadChecksTLS()
+	if err != nil {
+		return err
+	}
+	a.checksTLS.Store(checksTLS)
+
+	select {
+	case a.checksTLSReloaded <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// reloadableTransport is the transport of the Consul client, which is
+// replaced when its TLS files change. Requests in flight complete on the
+// transport they were sent with.
+type reloadableTransport struct {
+	transport atomic.Pointer[http.Transport]
+}
+
+func newReloadableTransport(transport *http.Transport) *reloadableTransport {
+	t := &reloadableTransport{}
+	t.transport.Store(transport)
+	return t
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *reloadableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.Load().RoundTrip(req)
+}
+
+// setTLSConfig replaces the transport with one using the given TLS config.
+func (t *reloadableTransport) setTLSConfig(tlsConfig *tls.Config) {
+	old := t.transport.Load()
+	transport := old.Clone()
+	transport.TLSClientConfig = tlsConfig
+	t.transport.Store(transport)
+	old.CloseIdleConnections()
+}
+
+// tlsFileWatcher reloads a TLS configuration when the contents of the files
+// and directories it's built from change.
+type tlsFileWatcher struct {
+	name   string
+	paths  []string
+	reload func() error
+	logger hclog.Logger
+
+	fingerprint [sha256.Size]byte
+	lastReload  time.Time
+}
+
+func newTLSFileWatcher(logger hclog.Logger, name string, paths []string, reload func() error) *tlsFileWatcher {
+	return &tlsFileWatcher{
+		name:        name,
+		paths:       paths,
+		reload:      reload,
+		logger:      logger,
+		fingerprint: tlsFilesFingerprint(paths),
+		lastReload:  time.Now(),
+	}
+}
+
+// check reloads the TLS configuration if the files changed since the last
+// check, and returns true if it was reloaded. A configuration that fails to
+// load is logged and the current one kept until the files change again.
+func (w *tlsFileWatcher) check() bool {
+	defer func() {
+		metrics.SetGaugeWithLabels([]string{"esm", "tls", "seconds_since_reload"},
+			float32(time.Since(w.lastReload).Seconds()),
+			[]metrics.Label{{Name: "config", Value: w.name}})
+	}()
+
+	fingerprint := tlsFilesFingerprint(w.paths)
+	if fingerprint == w.fingerprint {
+		return false
+	}
+	w.fingerprint = fingerprint
+
+	if err := w.reload(); err != nil {
+		w.logger.Error("Could not reload TLS config, keeping the current one", "config", w.name, "error", err)
+		return false
+	}
+	w.lastReload = time.Now()
+	w.logger.Info("Reloaded TLS config", "config", w.name)
+	return true
+}
+
+// tlsFilesFingerprint hashes the contents of the given files, and of the files
+// in the given directories. Missing files hash differently from empty ones.
+func tlsFilesFingerprint(paths []string) [sha256.Size]byte {
+	h := sha256.New()
+	hashFile := func(path string) {
+		io.WriteString(h, path+"\x00")
+		f, err := os.Open(path)
+		if err != nil {
+			io.WriteString(h, err.Error())
+			return
+		}
+		defer f.Close()
+		io.Copy(h, f)
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			hashFile(path)
+			continue
+		}
+		filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				hashFile(file)
+			}
+			return nil
+		})
+	}
+
+	var fingerprint [sha256.Size]byte
+	h.Sum(fingerprint[:0])
+	return fingerprint
+}
+
+// watchTLSFiles polls the TLS files of the Consul client and of the checks
+// every tls_reload_interval, reloading them when they change.
+func (a *Agent) watchTLSFiles() {
+	if a.config.TLSReloadInterval == 0 {
+		return
+	}
+
+	watchers := []*tlsFileWatcher{
+		newTLSFileWatcher(a.logger, "checks", a.checksTLSFiles(), a.reloadChecksTLS),
+	}
+	if a.consulTransport != nil {
+		clientConf := a.config.ClientConfig()
+		paths := []string{
+			clientConf.TLSConfig.CAFile, clientConf.TLSConfig.CAPath,
+			clientConf.TLSConfig.CertFile, clientConf.TLSConfig.KeyFile,
+		}
+		watchers = append(watchers, newTLSFileWatcher(a.logger, "consul", paths, func() error {
+			tlsConfig, err := api.SetupTLSConfig(&clientConf.TLSConfig)
+			if err != nil {
+				return err
+			}
+			a.consulTransport.setTLSConfig(tlsConfig)
+			return nil
+		}))
+	}
+
+	for {
+		select {
+		case <-a.shutdownCh:
+			return
+		case <-time.After(a.config.TLSReloadInterval):
+		}
+		for _, w := range watchers {
+			w.check()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSFilesFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	caDir := filepath.Join(dir, "ca")
+	require.NoError(t, os.Mkdir(caDir, 0o700))
+	certFile := filepath.Join(dir, "cert.pem")
+	require.NoError(t, os.WriteFile(certFile, []byte("cert"), 0o600))
+
+	paths := []string{"", certFile, caDir}
+	fingerprint := tlsFilesFingerprint(paths)
+	require.Equal(t, fingerprint, tlsFilesFingerprint(paths))
+
+	require.NoError(t, os.WriteFile(filepath.Join(caDir, "ca.pem"), []byte("ca"), 0o600))
+	require.NotEqual(t, fingerprint, tlsFilesFingerprint(paths))
+	fingerprint = tlsFilesFingerprint(paths)
+
+	require.NoError(t, os.WriteFile(certFile, []byte("rotated"), 0o600))
+	require.NotEqual(t, fingerprint, tlsFilesFingerprint(paths))
+	fingerprint = tlsFilesFingerprint(paths)
+
+	require.NoError(t, os.WriteFile(certFile, []byte{}, 0o600))
+	empty := tlsFilesFingerprint(paths)
+	require.NotEqual(t, fingerprint, empty)
+	require.NoError(t, os.Remove(certFile))
+	require.NotEqual(t, empty, tlsFilesFingerprint(paths))
+}
+
+func TestTLSFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	require.NoError(t, os.WriteFile(certFile, []byte("cert"), 0o600))
+
+	reloads := 0
+	var reloadErr error
+	watcher := newTLSFileWatcher(hclog.NewNullLogger(), "checks", []string{certFile}, func() error {
+		reloads++
+		return reloadErr
+	})
+	lastReload := watcher.lastReload
+
+	require.False(t, watcher.check())
+	require.Equal(t, 0, reloads)
+
+	// A failed reload isn't retried until the files change again.
+	reloadErr = errors.New("key doesn't match certificate")
+	require.NoError(t, os.WriteFile(certFile, []byte("rotated"), 0o600))
+	require.False(t, watcher.check())
+	require.False(t, watcher.check())
+	require.Equal(t, 1, reloads)
+	require.Equal(t, lastReload, watcher.lastReload)
+
+	reloadErr = nil
+	require.NoError(t, os.WriteFile(certFile, []byte("fixed"), 0o600))
+	require.True(t, watcher.check())
+	require.Equal(t, 2, reloads)
+	require.True(t, watcher.lastReload.After(lastReload))
+}
+
+func TestReloadableTransport(t *testing.T) {
+	dir := t.TempDir()
+	_, _, oldCA := writeTestCert(t, dir, "old-ca", nil)
+	newCAFile, _, newCA := writeTestCert(t, dir, "new-ca", nil)
+	_, _, serverCert := writeTestCert(t, dir, "server", &newCA)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.StartTLS()
+	defer server.Close()
+
+	oldCAs := x509.NewCertPool()
+	oldCAs.AddCert(oldCA.Leaf)
+	transport := newReloadableTransport(&http.Transport{TLSClientConfig: &tls.Config{RootCAs: oldCAs}})
+	client := &http.Client{Transport: transport}
+
+	// The server's certificate was issued by the new CA.
+	_, err := client.Get(server.URL)
+	require.Error(t, err)
+
+	tlsConfig, err := api.SetupTLSConfig(&api.TLSConfig{CAFile: newCAFile})
+	require.NoError(t, err)
+	transport.setTLSConfig(tlsConfig)
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAgent_reloadChecksTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _, _ := writeTestCert(t, dir, "ca", nil)
+
+	agent := &Agent{
+		config: &Config{
+			HTTPSCAFile: caFile,
+			TLSClientRules: []TLSClientRule{{
+				Host:   "*.partner.example.com",
+				CAFile: caFile,
+			}},
+		},
+		checksTLSReloaded: make(chan struct{}, 1),
+	}
+	require.Equal(t, []string{caFile, "", "", "", caFile, "", "", ""}, agent.checksTLSFiles())
+
+	require.NoError(t, agent.reloadChecksTLS())
+	current := agent.checksTLS.Load()
+	require.NotNil(t, current)
+	require.Len(t, current.rules, 1)
+	require.Len(t, agent.checksTLSReloaded, 1)
+
+	// Reloads don't block on the signal, and a failed one keeps the current
+	// config.
+	require.NoError(t, agent.reloadChecksTLS())
+	require.NotSame(t, current, agent.checksTLS.Load())
+	current = agent.checksTLS.Load()
+
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+	require.Error(t, agent.reloadChecksTLS())
+	require.Same(t, current, agent.checksTLS.Load())
+}
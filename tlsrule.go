@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// TLSClientRule selects the client certificate and CA bundle presented by the
+// checks it matches. Host and ServerName are glob patterns matched against the
+// host a check connects to and the server name it verifies, which defaults to
+// the host. ServiceMeta matches checks whose service has all the given meta.
+type TLSClientRule struct {
+	Host        string            `mapstructure:"host"`
+	ServerName  string            `mapstructure:"server_name"`
+	ServiceMeta map[string]string `mapstructure:"service_meta"`
+
+	CAFile   string `mapstructure:"ca_file"`
+	CAPath   string `mapstructure:"ca_path"`
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// validate returns an error if the rule can't be used.
+func (r TLSClientRule) validate() error {
+	if r.Host == "" && r.ServerName == "" && len(r.ServiceMeta) == 0 {
+		return fmt.Errorf("tls_client_rule must set at least one of host, server_name or service_meta")
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("tls_client_rule host is not a valid pattern: %q", r.Host)
+	}
+	if _, err := path.Match(r.ServerName, ""); err != nil {
+		return fmt.Errorf("tls_client_rule server_name is not a valid pattern: %q", r.ServerName)
+	}
+	if (r.CertFile == "") != (r.KeyFile == "") {
+		return fmt.Errorf("tls_client_rule cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// matches returns true if the rule applies to a check connecting to the given
+// host and verifying the given server name.
+func (r TLSClientRule) matches(host, serverName string, serviceMeta map[string]string) bool {
+	if r.Host != "" && !globMatch(r.Host, host) {
+		return false
+	}
+	if r.ServerName != "" && !globMatch(r.ServerName, serverName) {
+		return false
+	}
+	for key, value := range r.ServiceMeta {
+		if v, ok := serviceMeta[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch matches host names case-insensitively.
+func globMatch(pattern, name string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return ok
+}
+
+// tlsRulesUseServiceMeta returns true if any rule matches on service meta,
+// which then has to be looked up.
+func tlsRulesUseServiceMeta(rules []TLSClientRule) bool {
+	for _, rule := range rules {
+		if len(rule.ServiceMeta) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsClientRule is a TLSClientRule with its loaded TLS configuration.
+type tlsClientRule struct {
+	TLSClientRule
+	tlsConfig *tls.Config
+}
+
+// newTLSClientRules loads the certificates of the rules. Rules without their
+// own CA use the https_ca_file and https_ca_path ones.
+func newTLSClientRules(conf *Config) ([]tlsClientRule, error) {
+	rules := make([]tlsClientRule, 0, len(conf.TLSClientRules))
+	for _, rule := range conf.TLSClientRules {
+		tlsConfig := api.TLSConfig{
+			CAFile:   rule.CAFile,
+			CAPath:   rule.CAPath,
+			CertFile: rule.CertFile,
+			KeyFile:  rule.KeyFile,
+		}
+		if rule.CAFile == "" && rule.CAPath == "" {
+			tlsConfig.CAFile = conf.HTTPSCAFile
+			tlsConfig.CAPath = conf.HTTPSCAPath
+		}
+		tlsClientConfig, err := api.SetupTLSConfig(&tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, tlsClientRule{TLSClientRule: rule, tlsConfig: tlsClientConfig})
+	}
+	return rules, nil
+}
+
+// checkHost returns the host an HTTP or TCP check connects to.
+func checkHost(definition *api.HealthCheckDefinition) string {
+	if definition.HTTP != "" {
+		if u, err := url.Parse(definition.HTTP); err == nil {
+			return u.Hostname()
+		}
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(definition.TCP); err == nil {
+		return host
+	}
+	return definition.TCP
+}
+
+// checkTLSConfig returns the TLS configuration of a check, from the first TLS
+// client rule matching it or else from the https_* options.
+func (c *CheckRunner) checkTLSConfig(definition *api.HealthCheckDefinition, extras checkExtras) *tls.Config {
+	host := checkHost(definition)
+	serverName := definition.TLSServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	base := c.tlsConfig
+	for _, rule := range c.tlsRules {
+		if rule.matches(host, serverName, extras.ServiceMeta) {
+			base = rule.tlsConfig
+			break
+		}
+	}
+
+	tlsConfig := base.Clone()
+	tlsConfig.InsecureSkipVerify = definition.TLSSkipVerify
+	tlsConfig.ServerName = definition.TLSServerName
+	return tlsConfig
+}
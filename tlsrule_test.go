@@ -0,0 +1,206 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSClientRule_matches(t *testing.T) {
+	cases := []struct {
+		name        string
+		rule        TLSClientRule
+		host        string
+		serverName  string
+		serviceMeta map[string]string
+		match       bool
+	}{
+		{"host glob", TLSClientRule{Host: "*.partner.example.com"}, "api.partner.example.com", "api.partner.example.com", nil, true},
+		{"host case", TLSClientRule{Host: "*.Partner.example.com"}, "API.partner.example.com", "", nil, true},
+		{"host mismatch", TLSClientRule{Host: "*.partner.example.com"}, "partner.example.com", "", nil, false},
+		{"server name", TLSClientRule{ServerName: "payments.internal"}, "10.0.0.1", "payments.internal", nil, true},
+		{"server name mismatch", TLSClientRule{ServerName: "payments.internal"}, "10.0.0.1", "10.0.0.1", nil, false},
+		{"service meta", TLSClientRule{ServiceMeta: map[string]string{"mtls": "payments"}}, "10.0.0.1", "", map[string]string{"mtls": "payments", "env": "prod"}, true},
+		{"service meta mismatch", TLSClientRule{ServiceMeta: map[string]string{"mtls": "payments"}}, "10.0.0.1", "", map[string]string{"mtls": "billing"}, false},
+		{"service meta missing", TLSClientRule{ServiceMeta: map[string]string{"mtls": "payments"}}, "10.0.0.1", "", nil, false},
+		{"all selectors", TLSClientRule{Host: "10.0.0.*", ServiceMeta: map[string]string{"mtls": "payments"}}, "10.0.0.1", "", map[string]string{"mtls": "payments"}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.match, tc.rule.matches(tc.host, tc.serverName, tc.serviceMeta))
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	require.Equal(t, "api.example.com", checkHost(&api.HealthCheckDefinition{HTTP: "https://api.example.com:8443/health"}))
+	require.Equal(t, "::1", checkHost(&api.HealthCheckDefinition{HTTP: "https://[::1]/health"}))
+	require.Equal(t, "db.example.com", checkHost(&api.HealthCheckDefinition{TCP: "db.example.com:5432"}))
+	require.Equal(t, "db.example.com", checkHost(&api.HealthCheckDefinition{TCP: "db.example.com"}))
+}
+
+func TestCheckRunner_checkTLSConfig(t *testing.T) {
+	global := &tls.Config{}
+	partner := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{[]byte("partner")}}}}
+	payments := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{[]byte("payments")}}}}
+
+	runner := &CheckRunner{
+		tlsConfig: global,
+		tlsRules: []tlsClientRule{
+			{TLSClientRule{Host: "*.partner.example.com"}, partner},
+			{TLSClientRule{ServiceMeta: map[string]string{"mtls": "payments"}}, payments},
+			{TLSClientRule{ServerName: "*.internal"}, partner},
+		},
+	}
+
+	config := runner.checkTLSConfig(&api.HealthCheckDefinition{HTTP: "https://api.partner.example.com/"}, checkExtras{})
+	require.Equal(t, partner.Certificates, config.Certificates)
+
+	config = runner.checkTLSConfig(&api.HealthCheckDefinition{
+		TCP:           "10.0.0.1:443",
+		TLSServerName: "payments.internal",
+		TLSSkipVerify: true,
+	}, checkExtras{ServiceMeta: map[string]string{"mtls": "payments"}})
+	require.Equal(t, payments.Certificates, config.Certificates)
+	require.Equal(t, "payments.internal", config.ServerName)
+	require.True(t, config.InsecureSkipVerify)
+
+	config = runner.checkTLSConfig(&api.HealthCheckDefinition{HTTP: "https://10.0.0.1/", TLSServerName: "ledger.internal"}, checkExtras{})
+	require.Equal(t, partner.Certificates, config.Certificates)
+
+	config = runner.checkTLSConfig(&api.HealthCheckDefinition{HTTP: "https://example.com/"}, checkExtras{})
+	require.Empty(t, config.Certificates)
+
+	// The runner's configs are cloned, not modified.
+	require.Empty(t, partner.ServerName)
+	require.False(t, payments.InsecureSkipVerify)
+
+	require.False(t, tlsConfigsEqual(partner, payments))
+	require.True(t, tlsConfigsEqual(partner, partner.Clone()))
+}
+
+// writeTestCert writes a certificate and key signed by the given CA, or a self
+// signed CA if ca is nil, and returns their paths.
+func writeTestCert(t *testing.T, dir, name string, ca *tls.Certificate) (string, string, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, any(key)
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent = ca.Leaf
+		signer = ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+"-cert.pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	cert.Leaf, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certFile, keyFile, cert
+}
+
+func TestNewTLSClientRules(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _, ca := writeTestCert(t, dir, "ca", nil)
+	_, _, serverCert := writeTestCert(t, dir, "server", &ca)
+	clientCertFile, clientKeyFile, _ := writeTestCert(t, dir, "client", &ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &Config{
+		HTTPSCAFile: caFile,
+		TLSClientRules: []TLSClientRule{{
+			Host:     "127.0.0.1",
+			CertFile: clientCertFile,
+			KeyFile:  clientKeyFile,
+		}},
+	}
+	rules, err := newTLSClientRules(conf)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	require.Len(t, rules[0].tlsConfig.Certificates, 1)
+
+	runner := &CheckRunner{tlsConfig: &tls.Config{}, tlsRules: rules}
+	run := func(url string) *recordingNotifier {
+		definition := &api.HealthCheckDefinition{HTTP: url}
+		notifier := &recordingNotifier{}
+		check := &CheckHTTPESM{
+			CheckID:         structs.CheckID{ID: "mtls"},
+			HTTP:            url,
+			Interval:        time.Hour,
+			Logger:          hclog.NewNullLogger(),
+			TLSClientConfig: runner.checkTLSConfig(definition, checkExtras{}),
+			Assertion:       `status == 200 && body == "client"`,
+		}
+		check.RunOnce(notifier)
+		return notifier
+	}
+
+	// The rule's client certificate is presented to the matching host.
+	notifier := run(server.URL)
+	require.Equal(t, api.HealthPassing, notifier.status, notifier.output)
+
+	// Other hosts get no client certificate and fail the handshake.
+	notifier = run(fmt.Sprintf("https://localhost:%d", server.Listener.Addr().(*net.TCPAddr).Port))
+	require.Equal(t, api.HealthCritical, notifier.status)
+
+	conf.TLSClientRules[0].KeyFile = filepath.Join(dir, "missing.pem")
+	_, err = newTLSClientRules(conf)
+	require.Error(t, err)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// EvaluationWindow is a sliding-window policy for the checks it matches: a
+// check goes critical once Failures of its last Size results failed, and
+// passing once Successes of them passed. CheckID, ServiceName and Node select
+// the checks the policy applies to; a policy without any applies to every
+// check.
+type EvaluationWindow struct {
+	CheckID     string `mapstructure:"check_id"`
+	ServiceName string `mapstructure:"service_name"`
+	Node        string `mapstructure:"node"`
+
+	Size      int `mapstructure:"size"`
+	Failures  int `mapstructure:"failures"`
+	Successes int `mapstructure:"successes"`
+}
+
+// matches returns true if the policy applies to the check.
+func (w EvaluationWindow) matches(check *api.HealthCheck) bool {
+	checkID := strings.TrimPrefix(check.CheckID, check.Node+"/")
+	return (w.CheckID == "" || w.CheckID == checkID) &&
+		(w.ServiceName == "" || w.ServiceName == check.ServiceName) &&
+		(w.Node == "" || w.Node == check.Node)
+}
+
+// successes returns the number of passing results needed to pass, which
+// defaults to the check not being critical anymore.
+func (w EvaluationWindow) successes() int {
+	if w.Successes > 0 {
+		return w.Successes
+	}
+	return w.Size - w.Failures + 1
+}
+
+// findEvaluationWindow returns the first policy matching the check, or nil if
+// the check uses the threshold counters.
+func findEvaluationWindow(policies []EvaluationWindow, check *api.HealthCheck) *EvaluationWindow {
+	for i := range policies {
+		if policies[i].matches(check) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// resultWindow is a ring buffer of a check's most recent results.
+//
+// A nil resultWindow is valid, for checks using the threshold counters.
+type resultWindow struct {
+	policy  EvaluationWindow
+	results []string
+	next    int
+}
+
+func newResultWindow(policy EvaluationWindow) *resultWindow {
+	return &resultWindow{
+		policy:  policy,
+		results: make([]string, 0, policy.Size),
+	}
+}
+
+// Add records a result, replacing the oldest one once the window is full.
+func (w *resultWindow) Add(status string) {
+	if w == nil {
+		return
+	}
+	if len(w.results) < w.policy.Size {
+		w.results = append(w.results, status)
+		return
+	}
+	w.results[w.next] = status
+	w.next = (w.next + 1) % w.policy.Size
+}
+
+// Reset forgets the recorded results.
+func (w *resultWindow) Reset() {
+	if w == nil {
+		return
+	}
+	w.results = w.results[:0]
+	w.next = 0
+}
+
+// Reached returns true if enough of the recorded results have the given
+// status to update the check to it. Warnings are never reached, they use the
+// warning threshold.
+func (w *resultWindow) Reached(status string) bool {
+	var needed int
+	switch status {
+	case api.HealthCritical:
+		needed = w.policy.Failures
+	case api.HealthPassing:
+		needed = w.policy.successes()
+	default:
+		return false
+	}
+
+	count := 0
+	for _, result := range w.results {
+		if result == status {
+			count++
+		}
+	}
+	return count >= needed
+}
+
+// resultWindowFor returns the window of a check with the given policy,
+// keeping the previous results if the policy didn't change.
+func resultWindowFor(policy *EvaluationWindow, previous *resultWindow) *resultWindow {
+	if policy == nil {
+		return nil
+	}
+	if previous != nil && previous.policy == *policy {
+		return previous
+	}
+	return newResultWindow(*policy)
+}
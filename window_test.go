@@ -0,0 +1,210 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluationWindow_find(t *testing.T) {
+	policies := []EvaluationWindow{
+		{CheckID: "web-http", Size: 10, Failures: 2},
+		{ServiceName: "db", Node: "external", Size: 5, Failures: 3},
+		{Size: 3, Failures: 3},
+	}
+
+	check := &api.HealthCheck{Node: "external", CheckID: "external/web-http", ServiceName: "web"}
+	require.Equal(t, &policies[0], findEvaluationWindow(policies, check))
+
+	check = &api.HealthCheck{Node: "external", CheckID: "db-tcp", ServiceName: "db"}
+	require.Equal(t, &policies[1], findEvaluationWindow(policies, check))
+
+	check = &api.HealthCheck{Node: "other", CheckID: "db-tcp", ServiceName: "db"}
+	require.Equal(t, &policies[2], findEvaluationWindow(policies, check))
+
+	require.Nil(t, findEvaluationWindow(policies[:2], check))
+}
+
+func TestResultWindow(t *testing.T) {
+	// A nil window records nothing.
+	var window *resultWindow
+	window.Add(api.HealthCritical)
+	window.Reset()
+
+	policy := EvaluationWindow{Size: 5, Failures: 3}
+	require.Equal(t, 3, policy.successes())
+	window = newResultWindow(policy)
+
+	for _, status := range []string{api.HealthCritical, api.HealthPassing, api.HealthCritical} {
+		window.Add(status)
+	}
+	require.False(t, window.Reached(api.HealthCritical))
+	window.Add(api.HealthCritical)
+	require.True(t, window.Reached(api.HealthCritical))
+	require.False(t, window.Reached(api.HealthPassing))
+	require.False(t, window.Reached(api.HealthWarning))
+
+	// The oldest results are replaced once the window is full.
+	for _, status := range []string{api.HealthPassing, api.HealthPassing, api.HealthPassing} {
+		window.Add(status)
+	}
+	require.Len(t, window.results, 5)
+	require.False(t, window.Reached(api.HealthCritical))
+	require.True(t, window.Reached(api.HealthPassing))
+
+	// The results are kept as long as the policy doesn't change.
+	require.Same(t, window, resultWindowFor(&policy, window))
+	require.NotSame(t, window, resultWindowFor(&EvaluationWindow{Size: 5, Failures: 2}, window))
+	require.Nil(t, resultWindowFor(nil, window))
+
+	window.Reset()
+	require.False(t, window.Reached(api.HealthPassing))
+}
+
+func TestCheck_EvaluationWindow(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:            "consul-esm",
+		Level:           hclog.LevelFromString("INFO"),
+		IncludeLocation: true,
+		Output:          LOGOUT,
+	})
+	runner := NewCheckRunner(logger, client, 0, 0, &tls.Config{}, 0, 0)
+	runner.EvaluationWindows = []EvaluationWindow{{CheckID: "ext-http", Size: 5, Failures: 3, Successes: 4}}
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Status:  api.HealthPassing,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://service.local/health",
+				IntervalDuration: time.Hour,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+
+	hash := hashCheck(checks[0])
+	id := structs.CheckID{ID: hash}
+	check, ok := runner.checks.Load(hash)
+	require.True(t, ok)
+	require.NotNil(t, check.window)
+
+	// Non-consecutive failures count as long as they are within the window.
+	for _, status := range []string{api.HealthCritical, api.HealthPassing, api.HealthCritical, api.HealthPassing} {
+		runner.UpdateCheck(id, status, status)
+		require.Equal(t, api.HealthPassing, check.Status)
+	}
+	runner.UpdateCheck(id, api.HealthCritical, "down")
+	require.Equal(t, api.HealthCritical, check.Status)
+
+	// The window is kept across catalog updates.
+	checks, _, err = client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+	check, ok = runner.checks.Load(hash)
+	require.True(t, ok)
+	require.Len(t, check.window.results, 5)
+
+	// It passes again once 4 of the last 5 results passed.
+	for i := 0; i < 2; i++ {
+		runner.UpdateCheck(id, api.HealthPassing, "up")
+		require.Equal(t, api.HealthCritical, check.Status)
+	}
+	runner.UpdateCheck(id, api.HealthPassing, "up")
+	require.Equal(t, api.HealthPassing, check.Status)
+}
+
+func TestCheck_EvaluationWindowThreshold(t *testing.T) {
+	t.Parallel()
+	s, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: s.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoint fails every other request, so there are never two
+	// failures in a row.
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	// Every result reaches the window, even with a critical threshold.
+	runner := NewCheckRunner(hclog.NewNullLogger(), client, 0, 0, &tls.Config{}, 0, 2)
+	runner.EvaluationWindows = []EvaluationWindow{{CheckID: "ext-http", Size: 3, Failures: 2}}
+	defer runner.Stop()
+
+	nodeMeta := map[string]string{"external-node": "true"}
+	_, err = client.Catalog().Register(&api.CatalogRegistration{
+		Node:       "external",
+		Address:    "service.local",
+		Datacenter: "dc1",
+		NodeMeta:   nodeMeta,
+		Check: &api.AgentCheck{
+			Node:    "external",
+			CheckID: "ext-http",
+			Name:    "http-test",
+			Status:  api.HealthPassing,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             server.URL,
+				IntervalDuration: 50 * time.Millisecond,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	checks, _, err := client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+	require.NoError(t, err)
+	runner.UpdateChecks(checks)
+
+	retry.Run(t, func(r *retry.R) {
+		checks, _, err = client.Health().State(api.HealthAny, &api.QueryOptions{NodeMeta: nodeMeta})
+		if len(checks) != 1 || checks[0].Status != api.HealthCritical {
+			r.Fatalf("expected: %v, got: %v", api.HealthCritical, checks[0].Status)
+		}
+	})
+}